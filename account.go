@@ -0,0 +1,347 @@
+package quickfile
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	AccountKeyBytes   = 16
+	AccountSaltBytes  = 16
+	KeyIdBytes        = 8
+	KeyHashPrefix     = "sha256$"
+	configAccountsKey = "configaccounts" // In sysvalues once the config accounts were imported
+)
+
+// An account as stored in the database. Files are owned by the account name,
+// which is public. The key is the secret used to log in, and the database only
+// ever stores a salted hash of it
+type Account struct {
+	ID       int64
+	Name     string
+	Key      string // Only filled in when the account is first created
+	Limits   AccountConfig
+	Created  time.Time
+	Disabled time.Time // Zero if the account is usable
+	keyHash  string
+}
+
+func (a *Account) IsDisabled() bool {
+	return !a.Disabled.IsZero()
+}
+
+// Whether the given key is the login key for this account
+func (a *Account) CheckKey(key string) bool {
+	salt, _, ok := strings.Cut(strings.TrimPrefix(a.keyHash, KeyHashPrefix), "$")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashKeyWithSalt(key, salt)), []byte(a.keyHash)) == 1
+}
+
+const accountColumns = "aid,name,key,uploadlimit,filelimit,minexpire,maxexpire,created,disabled"
+
+func scanAccount(row interface{ Scan(...any) error }) (*Account, error) {
+	var account Account
+	var minExpire, maxExpire int64
+	var disabled sql.NullTime
+	err := row.Scan(&account.ID, &account.Name, &account.keyHash, &account.Limits.UploadLimit,
+		&account.Limits.FileLimit, &minExpire, &maxExpire, &account.Created, &disabled)
+	if err != nil {
+		return nil, err
+	}
+	account.Limits.MinExpire = Duration(minExpire)
+	account.Limits.MaxExpire = Duration(maxExpire)
+	if disabled.Valid {
+		account.Disabled = disabled.Time
+	}
+	return &account, nil
+}
+
+// Fill in any unset (zero) limits with the defaults from the config
+func (s *Store) limitsWithDefaults(limits *AccountConfig) AccountConfig {
+	result := AccountConfig{
+		UploadLimit: s.Config.DefaultUploadLimit,
+		FileLimit:   s.Config.DefaultFileLimit,
+		MinExpire:   s.Config.DefaultMinExpire,
+		MaxExpire:   s.Config.DefaultMaxExpire,
+	}
+	if limits != nil {
+		if limits.UploadLimit != 0 {
+			result.UploadLimit = limits.UploadLimit
+		}
+		if limits.FileLimit != 0 {
+			result.FileLimit = limits.FileLimit
+		}
+		if limits.MinExpire != 0 {
+			result.MinExpire = limits.MinExpire
+		}
+		if limits.MaxExpire != 0 {
+			result.MaxExpire = limits.MaxExpire
+		}
+	}
+	return result
+}
+
+func randomHex(length int) (string, error) {
+	raw := make([]byte, length)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func hashKeyWithSalt(key string, salt string) string {
+	hash := sha256.Sum256([]byte(salt + key))
+	return KeyHashPrefix + salt + "$" + hex.EncodeToString(hash[:])
+}
+
+// A short unsalted hash of the key, so logging in only has to check the salted
+// hash of the account it points to. Too short to be worth much on its own
+func keyId(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:KeyIdBytes])
+}
+
+// Produce the value stored in the database for the given login key
+func hashKey(key string) (string, error) {
+	salt, err := randomHex(AccountSaltBytes)
+	if err != nil {
+		return "", err
+	}
+	return hashKeyWithSalt(key, salt), nil
+}
+
+// Insert the account under a name, hashing the key for storage. Returns the new aid
+func (s *Store) insertAccount(ctx context.Context, tx *sql.Tx, name string, key string, limits *AccountConfig) (int64, error) {
+	name = strings.Trim(name, " ")
+	if name == "" {
+		return 0, fmt.Errorf("account name can't be empty")
+	}
+	keyHash, err := hashKey(key)
+	if err != nil {
+		return 0, err
+	}
+	realLimits := s.limitsWithDefaults(limits)
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO accounts(name, key, keyid, uploadlimit, filelimit, minexpire, maxexpire, created) VALUES(?,?,?,?,?,?,?,?)",
+		name, keyHash, keyId(key), realLimits.UploadLimit, realLimits.FileLimit, int64(realLimits.MinExpire), int64(realLimits.MaxExpire), time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Create a brand new account with a random key. Any zero limits are set to the
+// current defaults from the config. This is the only time you can see the key
+func (s *Store) AddAccount(name string, limits *AccountConfig) (*Account, error) {
+	key, err := randomHex(AccountKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	aid, err := s.insertAccount(context.Background(), tx, name, key, limits)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	account, err := s.getAccountBy(context.Background(), "aid", aid)
+	if err != nil {
+		return nil, err
+	}
+	account.Key = key
+	return account, nil
+}
+
+// Config accounts used their secret key as their name, so they get a public
+// name instead, and everything they own goes with them, so the key isn't left
+// lying around and their usage still counts against them
+func renameKeyAccount(tx *sql.Tx, aid int64, key string) error {
+	name := fmt.Sprintf("account%d", aid)
+	_, err := tx.Exec("UPDATE accounts SET name = ? WHERE aid = ?", name, aid)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"meta", "buckets", "usage", "uploadsessions"} {
+		_, err = tx.Exec("UPDATE "+table+" SET account = ? WHERE account = ?", name, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bring the accounts from the config into the database, the first time only.
+// After that the database is in charge, so accounts deleted or changed there
+// don't come back from the config. Accounts already in the database (by key)
+// are left alone, in case the import was cut short. The key was the only
+// identifier in the config and it was what owned the files, so imported
+// accounts get a generated name and take over those files
+func (s *Store) ImportConfigAccounts() (int, error) {
+	var done int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM sysvalues WHERE \"key\" = ?", configAccountsKey).Scan(&done)
+	if err != nil {
+		return 0, err
+	}
+	if done > 0 {
+		if len(s.Config.Accounts) > 0 {
+			log.Printf("Accounts in the config were already imported, use \"quickfile account\" to manage them\n")
+		}
+		return 0, nil
+	}
+	imported := 0
+	for key, limits := range s.Config.Accounts {
+		_, err := s.GetAccountByKey(key)
+		if err == nil {
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return imported, err
+		}
+		err = func() error {
+			tx, err := s.db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			// Name must be unique before we know the aid, the hash will do for a moment
+			placeholder, err := hashKey(key)
+			if err != nil {
+				return err
+			}
+			aid, err := s.insertAccount(context.Background(), tx, placeholder, key, limits)
+			if err != nil {
+				return err
+			}
+			err = renameKeyAccount(tx, aid, key)
+			if err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return imported, err
+		}
+		imported += 1
+	}
+	_, err = s.db.Exec("INSERT OR IGNORE INTO sysvalues VALUES(?,?)", configAccountsKey, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return imported, err
+	}
+	return imported, nil
+}
+
+func (s *Store) getAccountBy(ctx context.Context, column string, value any) (*Account, error) {
+	account, err := scanAccount(s.db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT %s FROM accounts WHERE %s = ?", accountColumns, column), value))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: account", ErrNotFound)
+	}
+	return account, err
+}
+
+func (s *Store) GetAccountById(id int64) (*Account, error) {
+	return s.getAccountBy(context.Background(), "aid", id)
+}
+
+func (s *Store) GetAccountByName(name string) (*Account, error) {
+	return s.GetAccountByNameContext(context.Background(), name)
+}
+
+func (s *Store) GetAccountByNameContext(ctx context.Context, name string) (*Account, error) {
+	return s.getAccountBy(ctx, "name", name)
+}
+
+func (s *Store) GetAccountByKey(key string) (*Account, error) {
+	return s.GetAccountByKeyContext(context.Background(), key)
+}
+
+// Find the account the login key belongs to. Keys are salted, so the key id
+// picks out which accounts to check
+func (s *Store) GetAccountByKeyContext(ctx context.Context, key string) (*Account, error) {
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM accounts WHERE keyid = ? ORDER BY aid", accountColumns), keyId(key))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		if account.CheckKey(key) {
+			return account, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: account", ErrNotFound)
+}
+
+// All accounts, including disabled ones, in the order they were created
+func (s *Store) GetAccounts() ([]*Account, error) {
+	return s.getAccounts(context.Background())
+}
+
+func (s *Store) getAccounts(ctx context.Context) ([]*Account, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM accounts ORDER BY aid", accountColumns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*Account, 0)
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, account)
+	}
+	return result, rows.Err()
+}
+
+func (s *Store) updateAccount(name string, query string, params ...any) error {
+	result, err := s.db.Exec(query, append(params, name)...)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("%w: account %s", ErrNotFound, name)
+	}
+	return nil
+}
+
+// Disabled accounts can't log in or upload, and any existing sessions stop
+// working. Their files are left alone
+func (s *Store) DisableAccount(name string) error {
+	return s.updateAccount(name, "UPDATE accounts SET disabled = ? WHERE name = ?", time.Now())
+}
+
+// Replace all limits on the account. Unlike when adding, zero values are stored as-is
+func (s *Store) SetAccountLimits(name string, limits *AccountConfig) error {
+	return s.updateAccount(name, "UPDATE accounts SET uploadlimit = ?, filelimit = ?, minexpire = ?, maxexpire = ? WHERE name = ?",
+		limits.UploadLimit, limits.FileLimit, int64(limits.MinExpire), int64(limits.MaxExpire))
+}
@@ -0,0 +1,205 @@
+package quickfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccounts(t *testing.T) {
+	store := createTables(t, "accounts")
+
+	// The config account should have been imported with the defaults applied
+	var configKey string
+	for key := range store.Config.Accounts {
+		configKey = key
+	}
+	imported, err := store.GetAccountByKey(configKey)
+	if err != nil {
+		t.Fatalf("Config account wasn't imported: %s\n", err)
+	}
+	if imported.Name != fmt.Sprintf("account%d", imported.ID) {
+		t.Fatalf("Imported account should get a generated name, got %s\n", imported.Name)
+	}
+	if imported.Limits.FileLimit != store.Config.DefaultFileLimit {
+		t.Fatalf("Expected default file limit %d, got %d\n", store.Config.DefaultFileLimit, imported.Limits.FileLimit)
+	}
+	count, err := store.ImportConfigAccounts()
+	if err != nil {
+		t.Fatalf("Couldn't reimport: %s\n", err)
+	}
+	if count != 0 {
+		t.Fatalf("Reimport shouldn't add anything, added %d\n", count)
+	}
+	// Only the first import counts, even with new accounts in the config
+	store.Config.Accounts["latecomer"] = &AccountConfig{}
+	count, err = store.ImportConfigAccounts()
+	if err != nil || count != 0 {
+		t.Fatalf("Expected nothing imported after the first time, got %d: %v\n", count, err)
+	}
+	delete(store.Config.Accounts, "latecomer")
+	_, err = store.GetAccountByKey("latecomer")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected latecomer to not be imported, got %v\n", err)
+	}
+
+	account, err := store.AddAccount("newbie", &AccountConfig{FileLimit: 1})
+	if err != nil {
+		t.Fatalf("Couldn't add account: %s\n", err)
+	}
+	if len(account.Key) != AccountKeyBytes*2 {
+		t.Fatalf("Expected a random hex key, got %s\n", account.Key)
+	}
+	if !account.CheckKey(account.Key) || account.CheckKey(configKey) {
+		t.Fatalf("Key check doesn't work\n")
+	}
+	var stored string
+	err = store.Db().QueryRow("SELECT key FROM accounts WHERE aid = ?", account.ID).Scan(&stored)
+	if err != nil {
+		t.Fatalf("Couldn't read stored key: %s\n", err)
+	}
+	if strings.Contains(stored, account.Key) {
+		t.Fatalf("Raw key stored in database: %s\n", stored)
+	}
+	if account.Limits.FileLimit != 1 || account.Limits.UploadLimit != store.Config.DefaultUploadLimit {
+		t.Fatalf("Limits not filled in properly: %v\n", account.Limits)
+	}
+	_, err = store.AddAccount("newbie", nil)
+	if err == nil {
+		t.Fatalf("Shouldn't be able to add the same name twice\n")
+	}
+
+	// Limits should apply immediately
+	meta := workingMeta()
+	meta.Account = account.Name
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("one")))
+	if err != nil {
+		t.Fatalf("Couldn't insert first file: %s\n", err)
+	}
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("two")))
+	if !errors.Is(err, ErrFileCountExceeded) {
+		t.Fatalf("Expected file limit error, got %v\n", err)
+	}
+	account.Limits.FileLimit = 2
+	account.Limits.MaxExpire = Duration(time.Minute)
+	account.Limits.MinExpire = 0
+	err = store.SetAccountLimits(account.Name, &account.Limits)
+	if err != nil {
+		t.Fatalf("Couldn't set limits: %s\n", err)
+	}
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("two")))
+	if !errors.Is(err, ErrBadExpire) {
+		t.Fatalf("Expected expire error after lowering max expire, got %v\n", err)
+	}
+	meta.Expire = time.Minute
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("two")))
+	if err != nil {
+		t.Fatalf("Couldn't insert after raising limit: %s\n", err)
+	}
+
+	err = store.DisableAccount(account.Name)
+	if err != nil {
+		t.Fatalf("Couldn't disable account: %s\n", err)
+	}
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("three")))
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Disabled account shouldn't be able to upload, got %v\n", err)
+	}
+	err = store.DisableAccount("nobody")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found disabling missing account, got %v\n", err)
+	}
+
+	accounts, err := store.GetAccounts()
+	if err != nil {
+		t.Fatalf("Couldn't list accounts: %s\n", err)
+	}
+	if len(accounts) != len(store.Config.Accounts)+2 {
+		t.Fatalf("Expected %d accounts, got %d\n", len(store.Config.Accounts)+2, len(accounts))
+	}
+	for _, a := range accounts {
+		if a.IsDisabled() != (a.Name == account.Name) {
+			t.Fatalf("Only the new account should be disabled\n")
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	store := createTables(t, "sessions")
+	account, err := store.AddAccount("sessionuser", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add account: %s\n", err)
+	}
+	_, _, err = store.CreateSession("notakey")
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected forbidden for bad key, got %v\n", err)
+	}
+	token, sessionAccount, err := store.CreateSession(account.Key)
+	if err != nil {
+		t.Fatalf("Couldn't create session: %s\n", err)
+	}
+	if sessionAccount.ID != account.ID || token == account.Key {
+		t.Fatalf("Session not created properly\n")
+	}
+	found, err := store.GetSessionAccount(token)
+	if err != nil {
+		t.Fatalf("Couldn't find session: %s\n", err)
+	}
+	if found.Name != account.Name {
+		t.Fatalf("Session for wrong account: %s\n", found.Name)
+	}
+
+	// Logging out kills only that session
+	token2, _, err := store.CreateSession(account.Key)
+	if err != nil {
+		t.Fatalf("Couldn't create second session: %s\n", err)
+	}
+	err = store.DeleteSession(token)
+	if err != nil {
+		t.Fatalf("Couldn't delete session: %s\n", err)
+	}
+	_, err = store.GetSessionAccount(token)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected deleted session to be gone, got %v\n", err)
+	}
+	_, err = store.GetSessionAccount(token2)
+	if err != nil {
+		t.Fatalf("Other session should still work: %s\n", err)
+	}
+
+	// Disabling the account kills the rest
+	err = store.DisableAccount(account.Name)
+	if err != nil {
+		t.Fatalf("Couldn't disable: %s\n", err)
+	}
+	_, err = store.GetSessionAccount(token2)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Session for disabled account should be gone, got %v\n", err)
+	}
+
+	// Expired sessions stop working and get cleaned up
+	shortlived, err := store.AddAccount("shortlived", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add account: %s\n", err)
+	}
+	store.Config.SessionDuration = Duration(time.Millisecond)
+	token, _, err = store.CreateSession(shortlived.Key)
+	if err != nil {
+		t.Fatalf("Couldn't create short session: %s\n", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	_, err = store.GetSessionAccount(token)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expired session should be gone, got %v\n", err)
+	}
+	stats, err := store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	if stats.DeletedSessions != 1 {
+		t.Fatalf("Expected 1 expired session deleted, got %d\n", stats.DeletedSessions)
+	}
+}
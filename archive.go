@@ -0,0 +1,399 @@
+package quickfile
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archives are a tar with a json manifest first, then the data for every file
+// it lists. Everything needed to recreate the files on another server is in the
+// manifest; the data is under files/ with the real name so the tar is useful
+// on its own too
+
+const (
+	ArchiveManifestName = "manifest.json"
+	ArchiveFormat       = 1 // Bump when the manifest changes in a way older imports can't read
+)
+
+// How many files to look up at once when exporting
+const archiveBatchSize = 500
+
+type ArchiveManifest struct {
+	Format   int              `json:"format"`
+	Exported time.Time        `json:"exported"`
+	Buckets  []*ArchiveBucket `json:"buckets"` // Only the buckets the files are in
+	Files    []*ArchiveFile   `json:"files"`
+}
+
+type ArchiveBucket struct {
+	Account string `json:"account"`
+	Name    string `json:"name"`
+	Slug    string `json:"slug"`
+}
+
+type ArchiveFile struct {
+	Path     string    `json:"path"` // Where the data is in the tar
+	Name     string    `json:"name"`
+	Account  string    `json:"account"`
+	Mime     string    `json:"mime"`
+	Created  time.Time `json:"created"`
+	Expire   time.Time `json:"expire"`
+	Unlisted string    `json:"unlisted"` // Same as UploadFile: empty for public, or a bucket slug
+	Tags     []string  `json:"tags"`
+	Length   int       `json:"length"`
+	Digest   string    `json:"digest,omitempty"`
+
+	fid int64 // Only for exporting, ids don't mean anything anywhere else
+}
+
+// Which files to export. Empty fields match everything; unlike FileQuery,
+// unlisted files are included unless you ask for a bucket
+type ExportFilter struct {
+	Account string
+	Tags    []string // Files with all of these tags
+	Bucket  string   // Slug of the bucket the files have to be in
+}
+
+func (f *ExportFilter) where() (string, []any) {
+	clauses := []string{"(expire IS NULL OR expire > ?)"}
+	params := []any{time.Now()}
+	if f.Account != "" {
+		clauses = append(clauses, "account = ?")
+		params = append(params, f.Account)
+	}
+	if f.Bucket != "" {
+		clauses = append(clauses, "unlisted = ?")
+		params = append(params, f.Bucket)
+	}
+	tags := sliceDistinct(f.Tags)
+	if len(tags) > 0 {
+		clauses = append(clauses, fmt.Sprintf(
+			"fid IN (SELECT fid FROM tags WHERE tag IN (%s) GROUP BY fid HAVING COUNT(DISTINCT tag) = ?)",
+			sliceToPlaceholder(tags)))
+		params = append(append(params, sliceToAny(tags)...), len(tags))
+	}
+	return strings.Join(clauses, " AND "), params
+}
+
+type ExportStatistics struct {
+	Files int
+	Bytes int64
+}
+
+// Write every unexpired file matching the filter to w as a tar archive, oldest
+// first. The filter is applied once at the start, files uploaded while
+// exporting aren't included
+func (s *Store) ExportFiles(w io.Writer, filter *ExportFilter) (*ExportStatistics, error) {
+	return s.ExportFilesContext(context.Background(), w, filter)
+}
+
+func (s *Store) ExportFilesContext(ctx context.Context, w io.Writer, filter *ExportFilter) (*ExportStatistics, error) {
+	manifest, err := s.exportManifest(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{Name: ArchiveManifestName, Mode: 0644, Size: int64(len(raw)), ModTime: manifest.Exported})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tw.Write(raw)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ExportStatistics{}
+	for _, f := range manifest.Files {
+		err = s.exportFile(ctx, tw, f)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't export %s: %w", f.Path, err)
+		}
+		stats.Files++
+		stats.Bytes += int64(f.Length)
+	}
+	return stats, tw.Close()
+}
+
+// Everything about the files to export, and the buckets they're in
+func (s *Store) exportManifest(ctx context.Context, filter *ExportFilter) (*ArchiveManifest, error) {
+	where, params := filter.where()
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT fid FROM meta WHERE %s ORDER BY fid", where), params...)
+	if err != nil {
+		return nil, err
+	}
+	fids := make([]int64, 0)
+	for rows.Next() {
+		var fid int64
+		err = rows.Scan(&fid)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fids = append(fids, fid)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	manifest := &ArchiveManifest{
+		Format:   ArchiveFormat,
+		Exported: time.Now(),
+		Buckets:  make([]*ArchiveBucket, 0),
+		Files:    make([]*ArchiveFile, 0, len(fids)),
+	}
+	buckets := make(map[string]bool)
+	for start := 0; start < len(fids); start += archiveBatchSize {
+		batch := fids[start:min(start+archiveBatchSize, len(fids))]
+		files, err := s.GetFilesByIdContext(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, fid := range batch {
+			f, ok := files[fid]
+			if !ok {
+				continue // Deleted since we looked
+			}
+			manifest.Files = append(manifest.Files, &ArchiveFile{
+				Path:     archivePath(f),
+				Name:     f.Name,
+				Account:  f.Account,
+				Mime:     f.Mime,
+				Created:  f.Date,
+				Expire:   f.Expire,
+				Unlisted: f.Unlisted,
+				Tags:     f.Tags,
+				Length:   f.Length,
+				Digest:   f.Digest,
+				fid:      f.ID,
+			})
+			if f.Unlisted != "" && !buckets[f.Unlisted] {
+				buckets[f.Unlisted] = true
+				bucket, err := s.GetBucketBySlugContext(ctx, f.Unlisted)
+				if errors.Is(err, ErrNotFound) {
+					continue // Unlisted, but not in a bucket
+				} else if err != nil {
+					return nil, err
+				}
+				manifest.Buckets = append(manifest.Buckets, &ArchiveBucket{Account: bucket.Account, Name: bucket.Name, Slug: bucket.Slug})
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// Names can have anything in them, so only the last part is kept. The slug
+// keeps files with the same name apart
+func archivePath(f *UploadFile) string {
+	name := path.Base(strings.ReplaceAll(f.Name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		name = "file"
+	}
+	return path.Join("files", f.Slug, name)
+}
+
+func (s *Store) exportFile(ctx context.Context, tw *tar.Writer, f *ArchiveFile) error {
+	err := tw.WriteHeader(&tar.Header{Name: f.Path, Mode: 0644, Size: int64(f.Length), ModTime: f.Created})
+	if err != nil {
+		return err
+	}
+	reader, err := s.OpenChunkReaderContext(ctx, f.fid)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// Copying exactly the length means a file that changed underneath us fails
+	// instead of making a broken tar
+	_, err = io.CopyN(tw, reader, int64(f.Length))
+	return err
+}
+
+// Rewrite the files in an import to be somewhere else
+type ImportOptions struct {
+	Account string // Put every file under this account instead of the one it came from
+}
+
+// A file from the archive that wasn't imported, and why
+type ImportSkip struct {
+	Name string
+	Err  error
+}
+
+type ImportStatistics struct {
+	Files          int
+	Bytes          int64
+	CreatedBuckets int
+	Skipped        []*ImportSkip
+}
+
+// Errors that mean the one file can't go in (but others might), rather than
+// something being wrong with the database
+var importRejections = []error{
+	ErrForbidden, ErrQuotaExceeded, ErrFileCountExceeded, ErrForbiddenMime, ErrUnknownMime,
+	ErrBadExpire, ErrNameTooLong, ErrNoFilename, ErrTooManyTags, ErrDigestMismatch,
+}
+
+func isImportRejection(err error) bool {
+	for _, rejection := range importRejections {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load an archive made by ExportFiles. Each file is inserted like a normal
+// upload, so it has to fit in the account's quota and pass all the usual
+// checks (including the expire limits, counting from now); the ones that don't
+// are skipped and listed in the statistics. Names, tags, mimetypes, upload
+// dates, expire times and buckets are kept, but files get new ids and slugs.
+// Expired files are skipped
+func (s *Store) ImportFiles(r io.Reader, options *ImportOptions) (*ImportStatistics, error) {
+	return s.ImportFilesContext(context.Background(), r, options)
+}
+
+func (s *Store) ImportFilesContext(ctx context.Context, r io.Reader, options *ImportOptions) (*ImportStatistics, error) {
+	if options == nil {
+		options = &ImportOptions{}
+	}
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("can't read archive: %w", err)
+	}
+	if header.Name != ArchiveManifestName {
+		return nil, fmt.Errorf("archive doesn't start with %s", ArchiveManifestName)
+	}
+	var manifest ArchiveManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("bad manifest: %w", err)
+	}
+	if manifest.Format != ArchiveFormat {
+		return nil, fmt.Errorf("can't import archive format %d (only %d)", manifest.Format, ArchiveFormat)
+	}
+
+	stats := &ImportStatistics{Skipped: make([]*ImportSkip, 0)}
+	slugs, err := s.importBuckets(ctx, manifest.Buckets, options, stats)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*ArchiveFile, len(manifest.Files))
+	for _, f := range manifest.Files {
+		files[f.Path] = f
+	}
+
+	for {
+		header, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stats, fmt.Errorf("can't read archive: %w", err)
+		}
+		f, ok := files[header.Name]
+		if !ok || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		delete(files, header.Name)
+		err = s.importFile(ctx, f, tr, slugs, options, stats)
+		if isImportRejection(err) {
+			stats.Skipped = append(stats.Skipped, &ImportSkip{Name: f.Name, Err: err})
+		} else if err != nil {
+			return stats, fmt.Errorf("couldn't import %s: %w", f.Name, err)
+		}
+	}
+	for _, f := range files {
+		stats.Skipped = append(stats.Skipped, &ImportSkip{Name: f.Name, Err: fmt.Errorf("%w: data missing from archive", ErrNotFound)})
+	}
+	return stats, nil
+}
+
+// Find or make the buckets the files go in, and return what to change their
+// old slugs to. Buckets are matched by account and name
+func (s *Store) importBuckets(ctx context.Context, buckets []*ArchiveBucket, options *ImportOptions, stats *ImportStatistics) (map[string]string, error) {
+	slugs := make(map[string]string)
+	existing := make(map[string][]*Bucket)
+	for _, b := range buckets {
+		account := b.Account
+		if options.Account != "" {
+			account = options.Account
+		}
+		accountBuckets, ok := existing[account]
+		if !ok {
+			// Files for accounts that don't exist are skipped, no point making their buckets
+			_, err := s.GetAccountByNameContext(ctx, account)
+			if errors.Is(err, ErrNotFound) {
+				existing[account] = nil
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			accountBuckets, err = s.GetBucketsContext(ctx, account)
+			if err != nil {
+				return nil, err
+			}
+			existing[account] = accountBuckets
+		} else if accountBuckets == nil {
+			continue
+		}
+		var found *Bucket
+		for _, eb := range accountBuckets {
+			if eb.Name == b.Name {
+				found = eb
+				break
+			}
+		}
+		if found == nil {
+			var err error
+			found, err = s.CreateBucketContext(ctx, account, b.Name)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't make bucket %s: %w", b.Name, err)
+			}
+			existing[account] = append(existing[account], found)
+			stats.CreatedBuckets++
+		}
+		slugs[b.Slug] = found.Slug
+	}
+	return slugs, nil
+}
+
+func (s *Store) importFile(ctx context.Context, f *ArchiveFile, data io.Reader, slugs map[string]string, options *ImportOptions, stats *ImportStatistics) error {
+	expire := time.Until(f.Expire)
+	if expire <= 0 {
+		return fmt.Errorf("%w: already expired", ErrBadExpire)
+	}
+	meta := FileInsertMeta{
+		Filename: f.Name,
+		Tags:     f.Tags,
+		Expire:   expire,
+		Account:  f.Account,
+		Unlisted: f.Unlisted,
+		Mime:     f.Mime,
+		Created:  f.Created,
+		Digest:   f.Digest,
+	}
+	if options.Account != "" {
+		meta.Account = options.Account
+	}
+	if slug, ok := slugs[f.Unlisted]; ok {
+		meta.Unlisted = slug
+	}
+	// Data that doesn't match the archive never becomes a file
+	uf, err := s.InsertFileContext(ctx, &meta, data)
+	if err != nil {
+		return err
+	}
+	stats.Files++
+	stats.Bytes += int64(uf.Length)
+	return nil
+}
@@ -0,0 +1,199 @@
+package quickfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// Put a few different kinds of files in the store: tagged public ones, one in a
+// bucket, and one from another account
+func fillExportStore(t *testing.T, store *Store) (*Bucket, map[string][]byte) {
+	_, err := store.AddAccount("other", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add other account: %s\n", err)
+	}
+	bucket, err := store.CreateBucket(DefaultUser, "holiday")
+	if err != nil {
+		t.Fatalf("Couldn't make bucket: %s\n", err)
+	}
+	big := make([]byte, ChunkSize*2+5)
+	randomizeArray(big)
+	contents := map[string][]byte{
+		"big.bin":    big,
+		"notes.txt":  []byte("some notes"),
+		"beach.png":  []byte("not really a png"),
+		"theirs.txt": []byte("from someone else"),
+	}
+	for _, f := range []FileInsertMeta{
+		{Filename: "big.bin", Account: DefaultUser, Expire: time.Hour, Tags: []string{"a", "b"}},
+		{Filename: "notes.txt", Account: DefaultUser, Expire: 2 * time.Hour, Tags: []string{"a"}},
+		{Filename: "beach.png", Account: DefaultUser, Expire: time.Hour, Unlisted: bucket.Slug},
+		{Filename: "theirs.txt", Account: "other", Expire: time.Hour, Tags: []string{"a", "b"}},
+	} {
+		_, err = store.InsertFile(&f, bytes.NewReader(contents[f.Filename]))
+		if err != nil {
+			t.Fatalf("Couldn't insert %s: %s\n", f.Filename, err)
+		}
+	}
+	return bucket, contents
+}
+
+func exportBuffer(t *testing.T, store *Store, filter *ExportFilter) *bytes.Buffer {
+	var buf bytes.Buffer
+	_, err := store.ExportFiles(&buf, filter)
+	if err != nil {
+		t.Fatalf("Couldn't export: %s\n", err)
+	}
+	return &buf
+}
+
+func TestExportFilter(t *testing.T) {
+	store := createTables(t, "exportfilter")
+	bucket, contents := fillExportStore(t, store)
+	for _, c := range []struct {
+		filter ExportFilter
+		count  int
+	}{
+		{ExportFilter{}, 4},
+		{ExportFilter{Account: DefaultUser}, 3},
+		{ExportFilter{Tags: []string{"a", "b"}}, 2},
+		{ExportFilter{Account: DefaultUser, Tags: []string{"a"}}, 2},
+		{ExportFilter{Bucket: bucket.Slug}, 1},
+		{ExportFilter{Account: "nobody"}, 0},
+	} {
+		var buf bytes.Buffer
+		stats, err := store.ExportFiles(&buf, &c.filter)
+		if err != nil {
+			t.Fatalf("Couldn't export %+v: %s\n", c.filter, err)
+		}
+		if stats.Files != c.count {
+			t.Fatalf("Expected %d files for %+v, got %d\n", c.count, c.filter, stats.Files)
+		}
+		// The archive has the manifest, then every file's data
+		tr := tar.NewReader(&buf)
+		names := make([]string, 0)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Bad tar: %s\n", err)
+			}
+			names = append(names, header.Name)
+			if header.Name != ArchiveManifestName {
+				data, _ := io.ReadAll(tr)
+				if name := header.FileInfo().Name(); !bytes.Equal(data, contents[name]) {
+					t.Fatalf("Wrong data in archive for %s\n", name)
+				}
+			}
+		}
+		if len(names) != c.count+1 || names[0] != ArchiveManifestName {
+			t.Fatalf("Unexpected archive contents for %+v: %v\n", c.filter, names)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	store := createTables(t, "export")
+	_, contents := fillExportStore(t, store)
+	archive := exportBuffer(t, store, &ExportFilter{})
+	original, err := store.SearchFiles(&FileQuery{Account: DefaultUser, Tags: []string{"a"}}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't list files: %s\n", err)
+	}
+	originals, err := store.GetFilesById(original)
+	if err != nil {
+		t.Fatalf("Couldn't get files: %s\n", err)
+	}
+
+	imported := createTables(t, "import")
+	_, err = imported.AddAccount("other", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add other account: %s\n", err)
+	}
+	stats, err := imported.ImportFiles(archive, nil)
+	if err != nil {
+		t.Fatalf("Couldn't import: %s\n", err)
+	}
+	if stats.Files != 4 || len(stats.Skipped) != 0 || stats.CreatedBuckets != 1 {
+		t.Fatalf("Unexpected import: %+v\n", stats)
+	}
+
+	// Same files with the same details, but new slugs
+	fids, err := imported.SearchFiles(&FileQuery{Account: DefaultUser, Tags: []string{"a"}}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't list imported files: %s\n", err)
+	}
+	files, err := imported.GetFilesById(fids)
+	if err != nil || len(files) != len(originals) {
+		t.Fatalf("Expected %d imported files, got %d (%v)\n", len(originals), len(files), err)
+	}
+	for _, f := range files {
+		var o *UploadFile
+		for _, of := range originals {
+			if of.Name == f.Name {
+				o = of
+			}
+		}
+		if o == nil || o.Mime != f.Mime || o.Digest != f.Digest || !o.Date.Equal(f.Date) || len(o.Tags) != len(f.Tags) {
+			t.Fatalf("Imported file doesn't match: %+v vs %+v\n", f, o)
+		}
+		if f.Expire.Sub(o.Expire).Abs() > time.Minute {
+			t.Fatalf("Imported file expires at %s, original at %s\n", f.Expire, o.Expire)
+		}
+		if !bytes.Equal(readAllFile(t, imported, f.ID), contents[f.Name]) {
+			t.Fatalf("Imported data for %s is wrong\n", f.Name)
+		}
+	}
+
+	// The bucket came along, with a new slug
+	buckets, err := imported.GetBuckets(DefaultUser)
+	if err != nil || len(buckets) != 1 || buckets[0].Name != "holiday" {
+		t.Fatalf("Expected the holiday bucket, got %v (%v)\n", buckets, err)
+	}
+	count, err := imported.CountBucketFiles(buckets[0])
+	if err != nil || count != 1 {
+		t.Fatalf("Expected 1 file in imported bucket, got %d (%v)\n", count, err)
+	}
+	checkUsage(t, imported, DefaultUser, 3, int64(len(contents["big.bin"])+len(contents["notes.txt"])+len(contents["beach.png"])))
+	checkUsage(t, imported, "other", 1, int64(len(contents["theirs.txt"])))
+
+	// Again, into one account that only has room for some of them. The bucket's already there
+	setLimits(t, imported, "other", func(l *AccountConfig) { l.FileLimit = 3 })
+	archive = exportBuffer(t, store, &ExportFilter{})
+	stats, err = imported.ImportFiles(archive, &ImportOptions{Account: "other"})
+	if err != nil {
+		t.Fatalf("Couldn't import into other: %s\n", err)
+	}
+	if stats.Files != 2 || len(stats.Skipped) != 2 || stats.CreatedBuckets != 1 {
+		t.Fatalf("Expected 2 imported and 2 skipped, got %+v\n", stats)
+	}
+	for _, skip := range stats.Skipped {
+		if !errors.Is(skip.Err, ErrFileCountExceeded) {
+			t.Fatalf("Expected %s to be skipped for the file limit, got %s\n", skip.Name, skip.Err)
+		}
+	}
+	checkUsage(t, imported, "other", 3, int64(len(contents["theirs.txt"])+len(contents["big.bin"])+len(contents["notes.txt"])))
+}
+
+func TestImportBadArchive(t *testing.T) {
+	store := createTables(t, "importbad")
+	_, err := store.ImportFiles(bytes.NewReader([]byte("not a tar")), nil)
+	if err == nil {
+		t.Fatalf("Shouldn't import garbage\n")
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	manifest := []byte(`{"format": 1000, "files": []}`)
+	tw.WriteHeader(&tar.Header{Name: ArchiveManifestName, Mode: 0644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	tw.Close()
+	_, err = store.ImportFiles(&buf, nil)
+	if err == nil {
+		t.Fatalf("Shouldn't import an unknown format\n")
+	}
+}
@@ -0,0 +1,253 @@
+package quickfile
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const (
+	BackupStepPages   = 1024 // Pages copied at a time, the database is only locked while copying them
+	BackupMaxRestarts = 5    // Times the copy can start over before it just locks the database and finishes
+	BackupTimeFormat  = "20060102-150405.000000"
+)
+
+// How long to let everyone else at the database between steps
+const backupStepPause = 5 * time.Millisecond
+
+// Copy one whole database into another using sqlite's online backup api. The
+// source is only locked a few pages at a time, so a busy server keeps working;
+// if someone writes to it in the middle, sqlite starts the copy over so the
+// result is always consistent. A server that never stops writing would keep it
+// going forever, so after a few restarts the rest is copied in one go, which
+// holds off writers (up to their busy timeout) until it's done
+func copyDb(ctx context.Context, dst *sql.DB, src *sql.DB) error {
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	return srcConn.Raw(func(srcRaw any) error {
+		return dstConn.Raw(func(dstRaw any) error {
+			backup, err := dstRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			restarts := 0
+			remaining := -1
+			for {
+				step := BackupStepPages
+				if restarts >= BackupMaxRestarts {
+					step = -1
+				}
+				done, err := backup.Step(step)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				// Anything left going up means it started over
+				if remaining >= 0 && backup.Remaining() > remaining {
+					restarts++
+				}
+				remaining = backup.Remaining()
+				select {
+				case <-ctx.Done():
+					backup.Close()
+					return ctx.Err()
+				case <-time.After(backupStepPause):
+				}
+			}
+		})
+	})
+}
+
+// Write a snapshot of the database to dest. It's written next to it first and
+// renamed into place, so there's never a half finished backup at dest
+func backupDb(ctx context.Context, db *sql.DB, dest string) error {
+	temp := dest + ".tmp"
+	os.Remove(temp)
+	tempDb, err := sql.Open("sqlite3", temp)
+	if err != nil {
+		return err
+	}
+	err = copyDb(ctx, tempDb, db)
+	tempDb.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, dest)
+}
+
+// Save a consistent copy of the database to dest while it's in use. Won't
+// overwrite anything already there
+func (s *Store) Backup(dest string) error {
+	return s.BackupContext(context.Background(), dest)
+}
+
+func (s *Store) BackupContext(ctx context.Context, dest string) error {
+	_, err := os.Stat(dest)
+	if err == nil {
+		return fmt.Errorf("backup destination %s already exists", dest)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return backupDb(ctx, s.db, dest)
+}
+
+type AutoBackupStatistics struct {
+	Path    string   // The new backup
+	Size    int64    // Size of the new backup
+	Deleted []string // Old backups removed to stay within BackupKeep
+}
+
+// The directory automatic backups go in, and the pattern they're named with. A
+// relative BackupDirectory is next to the database, wherever the server was started
+func (c *Config) autoBackupPattern() (string, string) {
+	dir := filepath.Dir(c.Datapath)
+	if filepath.IsAbs(c.BackupDirectory) {
+		dir = c.BackupDirectory
+	} else if c.BackupDirectory != "" {
+		dir = filepath.Join(dir, c.BackupDirectory)
+	}
+	return dir, filepath.Base(c.Datapath) + ".auto-*.bak"
+}
+
+// Make a new timestamped backup in BackupDirectory, then delete the oldest
+// automatic backups so only BackupKeep are left. Other files there are left alone
+func (s *Store) AutoBackup() (*AutoBackupStatistics, error) {
+	return s.AutoBackupContext(context.Background())
+}
+
+func (s *Store) AutoBackupContext(ctx context.Context) (*AutoBackupStatistics, error) {
+	dir, pattern := s.Config.autoBackupPattern()
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	result := &AutoBackupStatistics{Deleted: make([]string, 0)}
+	result.Path = filepath.Join(dir, filepath.Base(s.Config.Datapath)+".auto-"+time.Now().Format(BackupTimeFormat)+".bak")
+	err = s.BackupContext(ctx, result.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(result.Path)
+	if err != nil {
+		return nil, err
+	}
+	result.Size = info.Size()
+	if s.Config.BackupKeep <= 0 {
+		return result, nil
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	// The timestamps sort in order, so the oldest come first
+	sort.Strings(backups)
+	for len(backups) > s.Config.BackupKeep {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted = append(result.Deleted, backups[0])
+		backups = backups[1:]
+	}
+	return result, nil
+}
+
+type RestoreReport struct {
+	Version  int    // Version of the restored database, it's migrated the next time it's opened
+	Previous string // Backup of the database that was replaced, if there was one
+}
+
+// Replace the database in the config with the backup at src. The backup has to
+// be an intact quickfile database no newer than this program, and the current
+// database is backed up before it's overwritten. Nothing should have the
+// database open while this runs (stop the server first)
+func RestoreDatabase(config *Config, src string) (*RestoreReport, error) {
+	return RestoreDatabaseContext(context.Background(), config, src)
+}
+
+func RestoreDatabaseContext(ctx context.Context, config *Config, src string) (*RestoreReport, error) {
+	// Opening a missing file would just make an empty database
+	_, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	srcDb, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer srcDb.Close()
+	report := &RestoreReport{}
+	report.Version, err = checkBackup(ctx, srcDb)
+	if err != nil {
+		return nil, fmt.Errorf("can't restore %s: %w", src, err)
+	}
+	db, err := config.OpenDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	current, err := readDbVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if current > 0 {
+		report.Previous = fmt.Sprintf("%s.pre-restore-%s.bak", config.Datapath, time.Now().Format(BackupTimeFormat))
+		err = backupDb(ctx, db, report.Previous)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't back up the current database: %w", err)
+		}
+		log.Printf("Backed up current database to %s\n", report.Previous)
+	}
+	err = copyDb(ctx, db, srcDb)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Make sure the database isn't damaged and is a version we can use, and return that version
+func checkBackup(ctx context.Context, db *sql.DB) (int, error) {
+	var check string
+	err := db.QueryRowContext(ctx, "PRAGMA quick_check").Scan(&check)
+	if err != nil {
+		return 0, err
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("database is damaged: %s", check)
+	}
+	version, err := readDbVersion(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	target, err := strconv.Atoi(DatabaseVersion)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("not a quickfile database")
+	}
+	if version > target {
+		return 0, fmt.Errorf("database version %d is newer than this program (%d)", version, target)
+	}
+	return version, nil
+}
@@ -0,0 +1,173 @@
+package quickfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Open a store on a copy of the config pointing at another database
+func openCopy(t *testing.T, store *Store, path string) *Store {
+	config := *store.Config
+	config.Datapath = path
+	copied, err := OpenStore(&config)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %s\n", path, err)
+	}
+	t.Cleanup(func() { copied.Close() })
+	return copied
+}
+
+func TestBackup(t *testing.T) {
+	store := createTables(t, "backup")
+	meta := workingMeta()
+	data := make([]byte, ChunkSize*3+50)
+	randomizeArray(data)
+	uf, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+
+	// Keep writing the whole time, the backup should still come out whole
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			_, err := store.InsertFile(&meta, bytes.NewReader(data[:ChunkSize+i]))
+			if err != nil {
+				t.Errorf("Couldn't insert during backup: %s\n", err)
+				return
+			}
+		}
+	}()
+	dest := uniqueFile("backup_copy", ".db")
+	err = store.Backup(dest)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Couldn't back up: %s\n", err)
+	}
+	err = store.Backup(dest)
+	if err == nil {
+		t.Fatalf("Backup shouldn't overwrite an existing file\n")
+	}
+
+	backup := openCopy(t, store, dest)
+	if !bytes.Equal(readAllFile(t, backup, uf.ID), data) {
+		t.Fatalf("Backed up file has the wrong data\n")
+	}
+	stats, err := backup.VerifyFiles()
+	if err != nil || !stats.Ok() {
+		t.Fatalf("Backup doesn't verify: %v %v\n", stats, err)
+	}
+	_, err = backup.ReconcileUsage()
+	if err != nil {
+		t.Fatalf("Couldn't reconcile backup: %s\n", err)
+	}
+}
+
+func TestAutoBackup(t *testing.T) {
+	store := createTables(t, "autobackup")
+	// Relative to the database, not wherever we're running
+	store.Config.BackupDirectory = filepath.Base(uniqueFile("autobackups", ""))
+	backupDir := filepath.Join(filepath.Dir(store.Config.Datapath), store.Config.BackupDirectory)
+	store.Config.BackupKeep = 2
+	var made []string
+	for i := 0; i < 3; i++ {
+		stats, err := store.AutoBackup()
+		if err != nil {
+			t.Fatalf("Couldn't make automatic backup: %s\n", err)
+		}
+		if stats.Size <= 0 {
+			t.Fatalf("Automatic backup is empty\n")
+		}
+		if i < 2 && len(stats.Deleted) != 0 || i == 2 && (len(stats.Deleted) != 1 || stats.Deleted[0] != made[0]) {
+			t.Fatalf("Backup %d deleted the wrong backups: %v\n", i, stats.Deleted)
+		}
+		if filepath.Dir(stats.Path) != backupDir {
+			t.Fatalf("Backup should be in %s, went to %s\n", backupDir, stats.Path)
+		}
+		made = append(made, stats.Path)
+	}
+	// Unrelated files in there aren't touched
+	other := filepath.Join(backupDir, "mine.bak")
+	err := os.WriteFile(other, []byte("hello"), 0600)
+	if err != nil {
+		t.Fatalf("Couldn't write other file: %s\n", err)
+	}
+	_, err = store.AutoBackup()
+	if err != nil {
+		t.Fatalf("Couldn't make automatic backup: %s\n", err)
+	}
+	left, err := filepath.Glob(filepath.Join(backupDir, "*"))
+	if err != nil || len(left) != 3 {
+		t.Fatalf("Expected 2 backups and the other file, got %v (%v)\n", left, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	store := createTables(t, "restore")
+	meta := workingMeta()
+	kept, err := store.InsertFile(&meta, bytes.NewReader([]byte("before the backup")))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+	dest := uniqueFile("restore_copy", ".db")
+	err = store.Backup(dest)
+	if err != nil {
+		t.Fatalf("Couldn't back up: %s\n", err)
+	}
+	lost, err := store.InsertFile(&meta, bytes.NewReader([]byte("after the backup")))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+	store.Close()
+
+	// Things that aren't usable backups are turned away before anything changes
+	garbage := uniqueFile("restore_garbage", ".db")
+	err = os.WriteFile(garbage, bytes.Repeat([]byte("not a database"), 1000), 0600)
+	if err != nil {
+		t.Fatalf("Couldn't write garbage: %s\n", err)
+	}
+	for _, bad := range []string{garbage, uniqueFile("restore_missing", ".db")} {
+		_, err = RestoreDatabase(store.Config, bad)
+		if err == nil {
+			t.Fatalf("Shouldn't be able to restore %s\n", bad)
+		}
+	}
+	newer := createVersion1(t, "restore_newer", nil)
+	db, err := newer.OpenDb()
+	if err != nil {
+		t.Fatalf("Couldn't open db: %s\n", err)
+	}
+	_, err = db.Exec("UPDATE sysvalues SET value = '1000' WHERE \"key\" = 'version'")
+	db.Close()
+	if err != nil {
+		t.Fatalf("Couldn't change version: %s\n", err)
+	}
+	_, err = RestoreDatabase(store.Config, newer.Datapath)
+	if err == nil {
+		t.Fatalf("Shouldn't be able to restore a newer database\n")
+	}
+
+	report, err := RestoreDatabase(store.Config, dest)
+	if err != nil {
+		t.Fatalf("Couldn't restore: %s\n", err)
+	}
+	if report.Previous == "" {
+		t.Fatalf("Restore should've backed up the old database\n")
+	}
+	restored := openCopy(t, store, store.Config.Datapath)
+	if string(readAllFile(t, restored, kept.ID)) != "before the backup" {
+		t.Fatalf("Restored database is missing the backed up file\n")
+	}
+	files, err := restored.GetFilesById([]int64{lost.ID})
+	if err != nil || len(files) != 0 {
+		t.Fatalf("File from after the backup shouldn't be there: %v (%v)\n", files, err)
+	}
+	checkUsage(t, restored, DefaultUser, 1, int64(len("before the backup")))
+	previous := openCopy(t, store, report.Previous)
+	checkUsage(t, previous, DefaultUser, 2, int64(len("before the backup")+len("after the backup")))
+}
@@ -0,0 +1,105 @@
+package quickfile
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A named set of unlisted files belonging to an account. Files in a bucket have
+// the bucket slug as their unlisted value, and anyone with the slug can list them
+type Bucket struct {
+	ID      int64
+	Account string
+	Name    string
+	Slug    string
+	Created time.Time
+}
+
+const bucketColumns = "bid,account,name,slug,created"
+
+func scanBucket(row interface{ Scan(...any) error }) (*Bucket, error) {
+	var bucket Bucket
+	err := row.Scan(&bucket.ID, &bucket.Account, &bucket.Name, &bucket.Slug, &bucket.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// Make a new bucket for the account. Names only need to be unique per account
+func (s *Store) CreateBucket(account string, name string) (*Bucket, error) {
+	return s.CreateBucketContext(context.Background(), account, name)
+}
+
+func (s *Store) CreateBucketContext(ctx context.Context, account string, name string) (*Bucket, error) {
+	name = strings.Trim(name, " ")
+	if name == "" {
+		return nil, fmt.Errorf("bucket name can't be empty")
+	}
+	if len(name) > s.Config.MaxFileName {
+		return nil, fmt.Errorf("%w! max: %d", ErrNameTooLong, s.Config.MaxFileName)
+	}
+	slug, err := randomHex(SlugBytes)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.db.ExecContext(ctx, "INSERT INTO buckets(account, name, slug, created) VALUES(?,?,?,?)",
+		account, name, slug, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	bid, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return scanBucket(s.db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT %s FROM buckets WHERE bid = ?", bucketColumns), bid))
+}
+
+// All buckets for the account, oldest first
+func (s *Store) GetBuckets(account string) ([]*Bucket, error) {
+	return s.GetBucketsContext(context.Background(), account)
+}
+
+func (s *Store) GetBucketsContext(ctx context.Context, account string) ([]*Bucket, error) {
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM buckets WHERE account = ? ORDER BY bid", bucketColumns), account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*Bucket, 0)
+	for rows.Next() {
+		bucket, err := scanBucket(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, bucket)
+	}
+	return result, rows.Err()
+}
+
+func (s *Store) GetBucketBySlug(slug string) (*Bucket, error) {
+	return s.GetBucketBySlugContext(context.Background(), slug)
+}
+
+func (s *Store) GetBucketBySlugContext(ctx context.Context, slug string) (*Bucket, error) {
+	bucket, err := scanBucket(s.db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT %s FROM buckets WHERE slug = ?", bucketColumns), slug))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: bucket %s", ErrNotFound, slug)
+	}
+	return bucket, err
+}
+
+// Amount of unexpired files in the bucket
+func (s *Store) CountBucketFiles(bucket *Bucket) (int64, error) {
+	return s.CountBucketFilesContext(context.Background(), bucket)
+}
+
+func (s *Store) CountBucketFilesContext(ctx context.Context, bucket *Bucket) (int64, error) {
+	return s.CountFilesContext(ctx, &FileQuery{Unlisted: bucket.Slug})
+}
@@ -0,0 +1,92 @@
+package quickfile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	store := createTables(t, "buckets")
+	bucket, err := store.CreateBucket(DefaultUser, "pictures")
+	if err != nil {
+		t.Fatalf("Couldn't create bucket: %s\n", err)
+	}
+	if len(bucket.Slug) != SlugBytes*2 || bucket.Account != DefaultUser {
+		t.Fatalf("Bucket not created properly: %v\n", bucket)
+	}
+	_, err = store.CreateBucket(DefaultUser, "pictures")
+	if err == nil {
+		t.Fatalf("Shouldn't be able to make the same bucket twice\n")
+	}
+	_, err = store.CreateBucket(DefaultUser, "  ")
+	if err == nil {
+		t.Fatalf("Shouldn't be able to make a bucket with no name\n")
+	}
+	other, err := store.CreateBucket("someoneelse", "pictures")
+	if err != nil {
+		t.Fatalf("Same name for a different account should be fine: %s\n", err)
+	}
+
+	// Files in the bucket are only listed under the bucket
+	meta := workingMeta()
+	meta.Unlisted = bucket.Slug
+	inbucket, err := store.InsertFile(&meta, bytes.NewReader([]byte("bucket file")))
+	if err != nil {
+		t.Fatalf("Couldn't insert into bucket: %s\n", err)
+	}
+	meta.Unlisted = other.Slug
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("sneaky file")))
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected forbidden inserting into someone else's bucket, got %v\n", err)
+	}
+	_, err = store.CreateUploadSession(&meta, 10)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected forbidden uploading into someone else's bucket, got %v\n", err)
+	}
+	meta.Unlisted = ""
+	_, err = store.InsertFile(&meta, bytes.NewReader([]byte("public file")))
+	if err != nil {
+		t.Fatalf("Couldn't insert public file: %s\n", err)
+	}
+	fids, err := store.GetPaginatedFiles(0, bucket.Slug, "")
+	if err != nil {
+		t.Fatalf("Couldn't list bucket: %s\n", err)
+	}
+	if len(fids) != 1 || fids[0] != inbucket.ID {
+		t.Fatalf("Expected only the bucket file, got %v\n", fids)
+	}
+	count, err := store.CountBucketFiles(bucket)
+	if err != nil {
+		t.Fatalf("Couldn't count bucket: %s\n", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 file in bucket, got %d\n", count)
+	}
+	count, err = store.CountBucketFiles(other)
+	if err != nil {
+		t.Fatalf("Couldn't count other bucket: %s\n", err)
+	}
+	if count != 0 {
+		t.Fatalf("Expected empty bucket, got %d\n", count)
+	}
+
+	buckets, err := store.GetBuckets(DefaultUser)
+	if err != nil {
+		t.Fatalf("Couldn't get buckets: %s\n", err)
+	}
+	if len(buckets) != 1 || buckets[0].ID != bucket.ID {
+		t.Fatalf("Expected just the one bucket, got %v\n", buckets)
+	}
+	found, err := store.GetBucketBySlug(bucket.Slug)
+	if err != nil {
+		t.Fatalf("Couldn't find bucket by slug: %s\n", err)
+	}
+	if found.Name != "pictures" {
+		t.Fatalf("Wrong bucket found: %s\n", found.Name)
+	}
+	_, err = store.GetBucketBySlug("nothing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found for missing bucket, got %v\n", err)
+	}
+}
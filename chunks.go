@@ -0,0 +1,206 @@
+package quickfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+)
+
+// Chunk data is stored once per unique content, keyed by its hash, and files
+// just point at the chunks they're made of. The refs count how many file
+// chunks point at each stored chunk, so it can be deleted once that hits zero.
+// The hash is of the uncompressed data along with how it's compressed, so the
+// same data is only stored once per compression no matter where it shows up
+
+func hashChunk(compression string, chunk []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(compression))
+	hash.Write([]byte{0})
+	hash.Write(chunk)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Writes chunks for files within a transaction
+type chunkWriter struct {
+	refUpdate  *sql.Stmt
+	dataInsert *sql.Stmt
+	fileInsert *sql.Stmt
+	added      int64 // Bytes of new chunk data, for the physical size
+}
+
+func newChunkWriter(ctx context.Context, tx *sql.Tx) (*chunkWriter, error) {
+	var err error
+	var cw chunkWriter
+	cw.refUpdate, err = tx.PrepareContext(ctx, "UPDATE chunkdata SET refs = refs + 1 WHERE hash = ?")
+	if err != nil {
+		return nil, err
+	}
+	cw.dataInsert, err = tx.PrepareContext(ctx,
+		"INSERT INTO chunkdata(hash, refs, length, compression, data) VALUES(?,1,?,?,?)")
+	if err != nil {
+		cw.refUpdate.Close()
+		return nil, err
+	}
+	cw.fileInsert, err = tx.PrepareContext(ctx, "INSERT INTO filechunks(fid, seq, hash) VALUES(?,?,?)")
+	if err != nil {
+		cw.refUpdate.Close()
+		cw.dataInsert.Close()
+		return nil, err
+	}
+	return &cw, nil
+}
+
+// Store the (uncompressed) chunk with one more reference, returning its hash.
+// If the same data is already stored it's only referenced again, and doesn't
+// even need compressing
+func (cw *chunkWriter) store(ctx context.Context, compression string, chunk []byte) (string, error) {
+	hash := hashChunk(compression, chunk)
+	result, err := cw.refUpdate.ExecContext(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil || updated > 0 {
+		return hash, err
+	}
+	data, err := compressChunk(compression, chunk)
+	if err != nil {
+		return "", err
+	}
+	_, err = cw.dataInsert.ExecContext(ctx, hash, len(data), compression, data)
+	if err != nil {
+		return "", err
+	}
+	cw.added += int64(len(data))
+	return hash, nil
+}
+
+// Add the chunk as the given position in the file
+func (cw *chunkWriter) write(ctx context.Context, fid int64, seq int64, compression string, chunk []byte) error {
+	hash, err := cw.store(ctx, compression, chunk)
+	if err != nil {
+		return err
+	}
+	_, err = cw.fileInsert.ExecContext(ctx, fid, seq, hash)
+	return err
+}
+
+func (cw *chunkWriter) Close() {
+	cw.refUpdate.Close()
+	cw.dataInsert.Close()
+	cw.fileInsert.Close()
+}
+
+// Drop the chunks of files that no longer exist, and delete any stored chunk
+// that isn't part of any file anymore. Returns the amount of stored chunks deleted
+func (s *Store) deleteOrphanChunks(ctx context.Context) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx,
+		`UPDATE chunkdata SET refs = refs - (SELECT COUNT(*) FROM filechunks f
+		   WHERE f.hash = chunkdata.hash AND f.fid NOT IN (SELECT fid FROM meta))
+		 WHERE hash IN (SELECT hash FROM filechunks WHERE fid NOT IN (SELECT fid FROM meta))`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM filechunks WHERE fid NOT IN (SELECT fid FROM meta)")
+	if err != nil {
+		return 0, err
+	}
+	var deleted, size int64
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*), IFNULL(SUM(length), 0) FROM chunkdata WHERE refs <= 0").Scan(&deleted, &size)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM chunkdata WHERE refs <= 0")
+	if err != nil {
+		return 0, err
+	}
+	err = addPhysicalSize(ctx, tx, -size)
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// Databases from before deduplication have each file's chunks in the old chunks
+// table, uncompressed and in the order they were inserted. Move them over,
+// then get rid of the table
+func migrateDedupChunks(ctx context.Context, tx *sql.Tx) error {
+	err := sqlMigration(
+		"ALTER TABLE meta ADD trailer BLOB",
+		`CREATE TABLE chunkdata (
+      hash TEXT PRIMARY KEY,
+      refs INTEGER NOT NULL,
+      length INTEGER NOT NULL,
+      compression TEXT NOT NULL DEFAULT '',
+      data BLOB NOT NULL
+    );`,
+		`CREATE TABLE filechunks (
+      fid INTEGER NOT NULL,
+      seq INTEGER NOT NULL,
+      hash TEXT NOT NULL,
+      PRIMARY KEY (fid, seq)
+    );`,
+	)(ctx, tx)
+	if err != nil {
+		return err
+	}
+	// Chunks of files that were already gone just go with the table
+	fids, err := queryInts(ctx, tx, "SELECT fid FROM meta WHERE fid IN (SELECT fid FROM chunks) ORDER BY fid")
+	if err != nil {
+		return err
+	}
+	cw, err := newChunkWriter(ctx, tx)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+	for _, fid := range fids {
+		cids, err := queryInts(ctx, tx, "SELECT cid FROM chunks WHERE fid = ? ORDER BY cid", fid)
+		if err != nil {
+			return err
+		}
+		for seq, cid := range cids {
+			var data []byte
+			err = tx.QueryRowContext(ctx, "SELECT data FROM chunks WHERE cid = ?", cid).Scan(&data)
+			if err != nil {
+				return err
+			}
+			err = cw.write(ctx, fid, int64(seq), "", data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DROP TABLE chunks")
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved chunks for %d files into deduplicated storage\n", len(fids))
+	return nil
+}
+
+// The single integer column from every row of the query
+func queryInts(ctx context.Context, db queryer, query string, args ...any) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]int64, 0)
+	for rows.Next() {
+		var value int64
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, rows.Err()
+}
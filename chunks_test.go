@@ -0,0 +1,198 @@
+package quickfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func readAllFile(t *testing.T, store *Store, fid int64) []byte {
+	reader, err := store.OpenChunkReader(fid)
+	if err != nil {
+		t.Fatalf("Couldn't open reader for %d: %s\n", fid, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Couldn't read %d: %s\n", fid, err)
+	}
+	return data
+}
+
+// The raw data of a gzip file has to be exactly one gzip stream
+func checkRawGzip(t *testing.T, store *Store, fid int64, expected []byte) {
+	raw, err := store.OpenRawReader(fid)
+	if err != nil {
+		t.Fatalf("Couldn't open raw reader: %s\n", err)
+	}
+	gz, err := gzip.NewReader(raw)
+	if err != nil {
+		t.Fatalf("Raw data isn't gzip: %s\n", err)
+	}
+	gz.Multistream(false)
+	result, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Couldn't read raw gzip: %s\n", err)
+	}
+	if !bytes.Equal(result, expected) {
+		t.Fatalf("Raw gzip data is wrong\n")
+	}
+	rest, _ := io.ReadAll(raw)
+	if len(rest) != 0 {
+		t.Fatalf("Extra data after the gzip stream: %d bytes\n", len(rest))
+	}
+}
+
+func TestDedup(t *testing.T) {
+	store := createTables(t, "dedup")
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.MinExpire = 0 })
+	data := make([]byte, ChunkSize*3)
+	randomizeArray(data)
+	changed := bytes.Clone(data)
+	changed[len(changed)-1] += 1
+
+	meta := workingMeta()
+	meta.Filename = "nightly.zip"
+	first, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Couldn't insert first: %s\n", err)
+	}
+	second, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Couldn't insert second: %s\n", err)
+	}
+	third, err := store.InsertFile(&meta, bytes.NewReader(changed))
+	if err != nil {
+		t.Fatalf("Couldn't insert third: %s\n", err)
+	}
+
+	// Only the changed last chunk should take any more space
+	stats, err := store.GetFileStatistics("")
+	if err != nil {
+		t.Fatalf("Couldn't get statistics: %s\n", err)
+	}
+	if stats.TotalSize != int64(len(data)*3) || stats.PhysicalSize != ChunkSize*4 {
+		t.Fatalf("Expected %d logical and %d physical, got %d and %d\n", len(data)*3, ChunkSize*4, stats.TotalSize, stats.PhysicalSize)
+	}
+	userPhysical, err := store.GetAccountPhysicalSize(DefaultUser)
+	if err != nil {
+		t.Fatalf("Couldn't get user physical size: %s\n", err)
+	}
+	if userPhysical != ChunkSize*4 {
+		t.Fatalf("Expected user physical size %d, got %d\n", ChunkSize*4, userPhysical)
+	}
+
+	// Shared chunks survive their first file going away
+	for _, id := range []int64{first.ID, third.ID} {
+		err = store.ExpireFile(id)
+		if err != nil {
+			t.Fatalf("Couldn't expire %d: %s\n", id, err)
+		}
+	}
+	cleanStats, err := store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	if cleanStats.DeletedFiles != 2 || cleanStats.DeletedChunks != 1 {
+		t.Fatalf("Expected 2 files and 1 chunk deleted, got %d and %d\n", cleanStats.DeletedFiles, cleanStats.DeletedChunks)
+	}
+	if !bytes.Equal(readAllFile(t, store, second.ID), data) {
+		t.Fatalf("Remaining file data is wrong\n")
+	}
+	stats, err = store.GetFileStatistics("")
+	if err != nil || stats.PhysicalSize != ChunkSize*3 {
+		t.Fatalf("Expected physical size %d after cleanup, got %v (%v)\n", ChunkSize*3, stats, err)
+	}
+
+	err = store.ExpireFile(second.ID)
+	if err != nil {
+		t.Fatalf("Couldn't expire last: %s\n", err)
+	}
+	cleanStats, err = store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	if cleanStats.DeletedChunks != 3 {
+		t.Fatalf("Expected the last 3 chunks deleted, got %d\n", cleanStats.DeletedChunks)
+	}
+	stats, err = store.GetFileStatistics("")
+	if err != nil {
+		t.Fatalf("Couldn't get statistics: %s\n", err)
+	}
+	if stats.PhysicalSize != 0 {
+		t.Fatalf("Expected nothing stored, got %d\n", stats.PhysicalSize)
+	}
+}
+
+// The same data dedups no matter where it is in a file, even with gzip
+func TestDedupCompressed(t *testing.T) {
+	store := createTables(t, "dedupcompressed")
+	store.Config.Compression = map[string]string{"text/": CompressionGzip}
+	data := textData(ChunkSize * 3)
+	meta := workingMeta()
+	meta.Filename = "log.txt"
+	_, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Couldn't insert first: %s\n", err)
+	}
+	// Shifted along by a chunk, so the old first chunk is in the middle
+	shifted := append(textData(ChunkSize), data...)
+	uf, err := store.InsertFile(&meta, bytes.NewReader(shifted))
+	if err != nil {
+		t.Fatalf("Couldn't insert second: %s\n", err)
+	}
+	var stored int
+	err = store.Db().QueryRow("SELECT COUNT(*) FROM chunkdata").Scan(&stored)
+	if err != nil || stored != 4 {
+		t.Fatalf("Expected 4 stored chunks, got %d (%v)\n", stored, err)
+	}
+	if !bytes.Equal(readAllFile(t, store, uf.ID), shifted) {
+		t.Fatalf("Shifted file data is wrong\n")
+	}
+}
+
+// Old databases had every file's chunks in the chunks table, the same data
+// stored again for every file it was in
+func TestUpgradeChunks(t *testing.T) {
+	data := textData(ChunkSize*2 + 100)
+	config := createVersion1(t, "upgradechunks", map[string][]byte{"one.txt": data, "two.txt": data})
+	db, err := config.OpenDb()
+	if err != nil {
+		t.Fatalf("Couldn't open db: %s\n", err)
+	}
+	_, err = db.Exec("INSERT INTO chunks(fid, length, data) VALUES(999, 3, 'old')")
+	db.Close()
+	if err != nil {
+		t.Fatalf("Couldn't insert orphan chunk: %s\n", err)
+	}
+	store, err := OpenStore(config)
+	if err != nil {
+		t.Fatalf("Couldn't open old database: %s\n", err)
+	}
+	defer store.Close()
+	fids, err := store.GetPaginatedFiles(0, "", DefaultUser)
+	if err != nil || len(fids) != 2 {
+		t.Fatalf("Expected 2 upgraded files, got %v (%v)\n", fids, err)
+	}
+	for _, fid := range fids {
+		if !bytes.Equal(readAllFile(t, store, fid), data) {
+			t.Fatalf("Data wrong after upgrade\n")
+		}
+	}
+	// Both files share the same chunks, and the orphan didn't come along
+	var stored, refs int
+	err = store.Db().QueryRow("SELECT COUNT(*), SUM(refs) FROM chunkdata").Scan(&stored, &refs)
+	if err != nil || stored != 3 || refs != 6 {
+		t.Fatalf("Expected 3 chunks with 6 refs, got %d and %d (%v)\n", stored, refs, err)
+	}
+	stats, err := store.GetFileStatistics("")
+	if err != nil || stats.PhysicalSize != int64(len(data)) {
+		t.Fatalf("Expected physical size %d, got %v (%v)\n", len(data), stats, err)
+	}
+	var tables int
+	err = store.Db().QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'chunks'").Scan(&tables)
+	if err != nil || tables != 0 {
+		t.Fatalf("Old chunks table should be gone (%d): %v\n", tables, err)
+	}
+}
@@ -0,0 +1,285 @@
+// Package client talks to a quickfile server over its json api (/api/v1), so
+// scripts and other programs can upload, list, download and delete files from
+// anywhere. It doesn't need anything from the server package (or cgo).
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ApiPrefix = "/api/v1"
+
+type File struct {
+	ID      int64     `json:"id"`
+	Slug    string    `json:"slug"`
+	Name    string    `json:"name"`
+	Account string    `json:"account"`
+	Mime    string    `json:"mime"`
+	Date    time.Time `json:"date"`
+	Expire  time.Time `json:"expire"`
+	Tags    []string  `json:"tags"`
+	Length  int       `json:"length"`
+	Digest  string    `json:"digest,omitempty"` // Hex sha256 of the data, empty for some old files
+	Link    string    `json:"link"`             // Path to the raw file on the server
+	Url     string    `json:"url"`              // Full url to the raw file, as the server sees itself
+	Thumb   string    `json:"thumb,omitempty"`
+	Page    string    `json:"page"` // Path to the file's page, with a preview
+	Yours   bool      `json:"yours"`
+}
+
+type FileList struct {
+	Files     []*File `json:"files"`
+	Page      int     `json:"page"`
+	PageCount int     `json:"pagecount"`
+	PerPage   int     `json:"perpage"`
+}
+
+type Statistics struct {
+	Count        int64 `json:"count"`
+	TotalSize    int64 `json:"totalsize"`
+	PhysicalSize int64 `json:"physicalsize"`
+}
+
+type Limits struct {
+	UploadLimit int64  `json:"uploadlimit"`
+	FileLimit   int    `json:"filelimit"`
+	MinExpire   string `json:"minexpire"`
+	MaxExpire   string `json:"maxexpire"`
+}
+
+type Account struct {
+	Limits     Limits     `json:"limits"`
+	Statistics Statistics `json:"statistics"`
+}
+
+// Whatever the server said went wrong. Status is the http status (404, 413 for
+// quota, 415 for mimetypes, etc)
+type ApiError struct {
+	Status  int
+	Message string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Status, e.Message)
+}
+
+type Client struct {
+	BaseUrl string // Where the server is, like https://files.example.com (without /api/v1)
+	Key     string // Account key, sent as a bearer token. Only needed for your own things
+	Http    *http.Client
+}
+
+func New(baseUrl string, key string) *Client {
+	return &Client{BaseUrl: strings.TrimRight(baseUrl, "/"), Key: key, Http: http.DefaultClient}
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseUrl+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+	return req, nil
+}
+
+// Run the request and decode the json response into result (if not nil).
+// Error statuses come back as an *ApiError
+func (c *Client) do(req *http.Request, result any) error {
+	resp, err := c.Http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return readApiError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func readApiError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 65536))
+	if json.Unmarshal(raw, &body) != nil || body.Error == "" {
+		// Not from the api, like the rate limiter or a proxy in front
+		body.Error = strings.TrimSpace(string(raw))
+	}
+	return &ApiError{Status: resp.StatusCode, Message: body.Error}
+}
+
+func (c *Client) get(ctx context.Context, path string, result any) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, result)
+}
+
+type UploadOptions struct {
+	Expire   string // Like "24h" or "1h30m". Has to be within the account's limits
+	Tags     []string
+	Unlisted string // "default" for unlisted, or a bucket slug. Empty is public
+}
+
+// Upload the data as a file with the given name. The data is streamed, so it
+// can be as big as the server allows
+func (c *Client) Upload(ctx context.Context, name string, data io.Reader, options *UploadOptions) (*File, error) {
+	if options == nil {
+		options = &UploadOptions{}
+	}
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		writer.CloseWithError(writeUploadForm(form, name, data, options))
+	}()
+	defer body.Close()
+	req, err := c.newRequest(ctx, http.MethodPost, ApiPrefix+"/files", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	var files []*File
+	err = c.do(req, &files)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("expected 1 uploaded file, got %d", len(files))
+	}
+	return files[0], nil
+}
+
+// The server streams uploads straight in, so the fields have to come before the file
+func writeUploadForm(form *multipart.Writer, name string, data io.Reader, options *UploadOptions) error {
+	for field, value := range map[string]string{
+		"expire":   options.Expire,
+		"tags":     strings.Join(options.Tags, " "),
+		"unlisted": options.Unlisted,
+	} {
+		err := form.WriteField(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	part, err := form.CreateFormFile("files", name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, data)
+	if err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// What to list. Empty fields match everything
+type Query struct {
+	Text     string // Words in the name or tags
+	Tags     []string
+	AnyTag   bool // Files with any of the tags instead of all of them
+	Account  string
+	Mime     string // Prefix, like "image/"
+	Unlisted bool   // Your own unlisted files instead of public ones
+	Bucket   string // Only files in the bucket with this slug
+}
+
+func (q *Query) values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"q":       q.Text,
+		"tags":    strings.Join(q.Tags, ","),
+		"account": q.Account,
+		"mime":    q.Mime,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if q.AnyTag {
+		values.Set("anytag", "1")
+	}
+	if q.Unlisted {
+		values.Set("unlisted", "1")
+	}
+	return values
+}
+
+// One page of files matching the query, newest first. Pages start at 1
+func (c *Client) ListFiles(ctx context.Context, query *Query, page int) (*FileList, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	values := query.values()
+	values.Set("page", strconv.Itoa(page))
+	path := ApiPrefix + "/files"
+	if query.Bucket != "" {
+		path = ApiPrefix + "/buckets/" + url.PathEscape(query.Bucket)
+	}
+	var result FileList
+	err := c.get(ctx, path+"?"+values.Encode(), &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Details for a file, by slug or numeric id
+func (c *Client) GetFile(ctx context.Context, id string) (*File, error) {
+	var result File
+	err := c.get(ctx, ApiPrefix+"/files/"+url.PathEscape(id), &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Start downloading the file's data. Close it when you're done
+func (c *Client) Download(ctx context.Context, f *File) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, f.Link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, readApiError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Delete one of your files, by slug or numeric id
+func (c *Client) DeleteFile(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, ApiPrefix+"/files/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+// Your account's limits and how much of them you've used
+func (c *Client) GetAccount(ctx context.Context) (*Account, error) {
+	var result Account
+	err := c.get(ctx, ApiPrefix+"/account", &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testKey = "secretkey"
+
+// Just enough of the api to check what the client sends
+func testServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ApiPrefix+"/files", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(&FileList{
+				Files: []*File{{ID: 1, Name: r.URL.Query().Encode()}}, Page: 1, PageCount: 1,
+			})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+testKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "Invalid account"}`))
+			return
+		}
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("Upload isn't multipart: %s\n", err)
+			return
+		}
+		fields := make([]string, 0)
+		var uploaded File
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("Bad multipart: %s\n", err)
+				return
+			}
+			value, _ := io.ReadAll(part)
+			fields = append(fields, part.FormName())
+			if part.FormName() == "files" {
+				uploaded.Name, uploaded.Length = part.FileName(), len(value)
+			} else if part.FormName() == "tags" {
+				uploaded.Tags = strings.Fields(string(value))
+			}
+		}
+		if len(fields) != 4 || fields[3] != "files" {
+			t.Errorf("The file has to come after the other fields: %v\n", fields)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode([]*File{&uploaded})
+	})
+	mux.HandleFunc(ApiPrefix+"/buckets/abc", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&FileList{Files: []*File{{ID: 2}}, Page: 1, PageCount: 1})
+	})
+	mux.HandleFunc(ApiPrefix+"/files/5", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(&File{ID: 5, Name: "five.txt", Link: "/file/five/five.txt"})
+	})
+	mux.HandleFunc("/file/five/five.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("five"))
+	})
+	mux.HandleFunc(ApiPrefix+"/files/toobig", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too Many Requests\n"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestUpload(t *testing.T) {
+	server := testServer(t)
+	c := New(server.URL+"/", testKey)
+	f, err := c.Upload(context.Background(), "hello.txt", bytes.NewReader([]byte("hello")),
+		&UploadOptions{Expire: "1h", Tags: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("Couldn't upload: %s\n", err)
+	}
+	if f.Name != "hello.txt" || f.Length != 5 || len(f.Tags) != 2 {
+		t.Fatalf("Server got the wrong upload: %+v\n", f)
+	}
+
+	c.Key = "wrong"
+	_, err = c.Upload(context.Background(), "hello.txt", bytes.NewReader([]byte("hello")), nil)
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Message != "Invalid account" {
+		t.Fatalf("Expected an unauthorized ApiError, got %v\n", err)
+	}
+}
+
+func TestListAndFiles(t *testing.T) {
+	server := testServer(t)
+	c := New(server.URL, testKey)
+	ctx := context.Background()
+	list, err := c.ListFiles(ctx, &Query{Text: "holiday", Tags: []string{"a", "b"}, Unlisted: true}, 2)
+	if err != nil {
+		t.Fatalf("Couldn't list: %s\n", err)
+	}
+	// The test server echoes the query back as the name
+	if list.Files[0].Name != "page=2&q=holiday&tags=a%2Cb&unlisted=1" {
+		t.Fatalf("Wrong query sent: %s\n", list.Files[0].Name)
+	}
+	list, err = c.ListFiles(ctx, &Query{Bucket: "abc"}, 1)
+	if err != nil || list.Files[0].ID != 2 {
+		t.Fatalf("Bucket listing went to the wrong place: %v (%v)\n", list, err)
+	}
+
+	f, err := c.GetFile(ctx, "5")
+	if err != nil {
+		t.Fatalf("Couldn't get file: %s\n", err)
+	}
+	data, err := c.Download(ctx, f)
+	if err != nil {
+		t.Fatalf("Couldn't download: %s\n", err)
+	}
+	raw, _ := io.ReadAll(data)
+	data.Close()
+	if string(raw) != "five" {
+		t.Fatalf("Downloaded the wrong data: %s\n", raw)
+	}
+	err = c.DeleteFile(ctx, "5")
+	if err != nil {
+		t.Fatalf("Couldn't delete: %s\n", err)
+	}
+
+	// Errors that aren't json still come back as an ApiError
+	_, err = c.GetFile(ctx, "toobig")
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusTooManyRequests || apiErr.Message != "Too Many Requests" {
+		t.Fatalf("Expected a rate limit ApiError, got %v\n", err)
+	}
+	_, err = c.GetFile(ctx, "missing")
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		t.Fatalf("Expected not found, got %v\n", err)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/randomouscrap98/quickfile"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const ApiPrefix = "/api/v1"
+
+// What the api hands out for a file
+type apiFile struct {
+	ID      int64     `json:"id"`
+	Slug    string    `json:"slug"`
+	Name    string    `json:"name"`
+	Account string    `json:"account"`
+	Mime    string    `json:"mime"`
+	Date    time.Time `json:"date"`
+	Expire  time.Time `json:"expire"`
+	Tags    []string  `json:"tags"`
+	Length  int       `json:"length"`
+	Digest  string    `json:"digest,omitempty"` // Hex sha256 of the data
+	Link    string    `json:"link"`             // Path to the raw file on this server
+	Url     string    `json:"url"`              // Full url to the raw file
+	Thumb   string    `json:"thumb,omitempty"`  // Path to the thumbnail, if it has one
+	Page    string    `json:"page"`             // Path to the file's page, with a preview
+	Yours   bool      `json:"yours"`
+}
+
+type apiFileList struct {
+	Files     []*apiFile `json:"files"`
+	Page      int        `json:"page"`
+	PageCount int        `json:"pagecount"`
+	PerPage   int        `json:"perpage"`
+}
+
+type apiBucket struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Account string    `json:"account"`
+	Slug    string    `json:"slug"`
+	Created time.Time `json:"created"`
+	Link    string    `json:"link"` // Path to the bucket listing page
+	Url     string    `json:"url"`
+}
+
+type apiTagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+type apiStatistics struct {
+	Count        int64 `json:"count"`
+	TotalSize    int64 `json:"totalsize"`
+	PhysicalSize int64 `json:"physicalsize"` // After compression and deduplication
+}
+
+type apiLimits struct {
+	UploadLimit int64  `json:"uploadlimit"`
+	FileLimit   int    `json:"filelimit"`
+	MinExpire   string `json:"minexpire"`
+	MaxExpire   string `json:"maxexpire"`
+}
+
+type apiAccount struct {
+	Limits     apiLimits     `json:"limits"`
+	Statistics apiStatistics `json:"statistics"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// The start of full links to the site. PublicUrl knows best, since behind a
+// proxy the request only knows how it got from the proxy
+func getRequestRoot(config *quickfile.Config, r *http.Request) string {
+	if config.PublicUrl != "" {
+		return strings.TrimRight(config.PublicUrl, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if r.URL.Scheme != "" {
+		scheme = r.URL.Scheme
+	}
+	return scheme + "://" + r.Host
+}
+
+func toApiFile(config *quickfile.Config, f *quickfile.UploadFile, account string, r *http.Request) *apiFile {
+	link := "/" + getFileLink(f)
+	thumb := ""
+	if f.Thumbnail {
+		thumb = "/" + getThumbLink(f)
+	}
+	return &apiFile{
+		ID:      f.ID,
+		Slug:    f.Slug,
+		Name:    f.Name,
+		Account: f.Account,
+		Mime:    f.Mime,
+		Date:    f.Date,
+		Expire:  f.Expire,
+		Tags:    f.Tags,
+		Length:  f.Length,
+		Digest:  f.Digest,
+		Link:    link,
+		Url:     getRequestRoot(config, r) + link,
+		Thumb:   thumb,
+		Page:    "/" + getPageLink(f),
+		Yours:   account != "" && f.Account == account,
+	}
+}
+
+func toApiBucket(config *quickfile.Config, b *quickfile.Bucket, r *http.Request) *apiBucket {
+	link := "/bucket/" + b.Slug
+	return &apiBucket{
+		ID:      b.ID,
+		Name:    b.Name,
+		Account: b.Account,
+		Slug:    b.Slug,
+		Created: b.Created,
+		Link:    link,
+		Url:     getRequestRoot(config, r) + link,
+	}
+}
+
+// Run the query for the page asked for and write the results as an apiFileList
+func writeApiQuery(store *quickfile.Store, w http.ResponseWriter, r *http.Request, query *quickfile.FileQuery) {
+	page := parseApiPage(r)
+	fids, err := store.SearchFilesContext(r.Context(), query, page-1)
+	if err != nil {
+		log.Printf("WARN: api couldn't load paginated ids: %s\n", err)
+		writeJsonError(w, errorStatus(err), err.Error())
+		return
+	}
+	count, err := store.CountFilesContext(r.Context(), query)
+	if err != nil {
+		writeJsonError(w, errorStatus(err), err.Error())
+		return
+	}
+	files, err := store.GetFilesByIdContext(r.Context(), fids)
+	if err != nil {
+		log.Printf("WARN: api couldn't load results from ids: %s\n", err)
+		writeJsonError(w, errorStatus(err), err.Error())
+		return
+	}
+	account, _, _ := getAccount(store, r)
+	result := apiFileList{
+		Files:     make([]*apiFile, 0, len(fids)),
+		Page:      page,
+		PageCount: int(math.Ceil(float64(count) / float64(store.Config.ResultsPerPage))),
+		PerPage:   store.Config.ResultsPerPage,
+	}
+	for _, id := range fids {
+		result.Files = append(result.Files, toApiFile(store.Config, files[id], account, r))
+	}
+	writeJson(w, http.StatusOK, &result)
+}
+
+func parseApiPage(r *http.Request) int {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	return page
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("WARN: couldn't write json response: %s\n", err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, &apiError{Error: message})
+}
+
+// Same as getAccount, but writes the error response for you if there's no account
+func requireApiAccount(store *quickfile.Store, w http.ResponseWriter, r *http.Request) (string, *quickfile.AccountConfig, bool) {
+	account, acconf, ok := getAccount(store, r)
+	if !ok {
+		writeJsonError(w, http.StatusUnauthorized, "Invalid account")
+	}
+	return account, acconf, ok
+}
+
+// Same as requireApiAccount, but the account also has to be one of the AdminAccounts
+func requireApiAdmin(store *quickfile.Store, w http.ResponseWriter, r *http.Request) bool {
+	account, _, ok := requireApiAccount(store, w, r)
+	if ok && !slices.Contains(store.Config.AdminAccounts, account) {
+		writeJsonError(w, http.StatusForbidden, "Not an admin account")
+		return false
+	}
+	return ok
+}
+
+// Add all the json api endpoints. These mirror what the html page can do
+func setupApi(r chi.Router, store *quickfile.Store) {
+	config := store.Config
+
+	r.Route(ApiPrefix, func(r chi.Router) {
+		// List files newest first. Logged in users can pass unlisted=1 to list their
+		// own unlisted files instead of the public ones. Takes all the search
+		// filters from setQueryParams, so it's also the search endpoint
+		listFiles := func(w http.ResponseWriter, r *http.Request) {
+			params := r.URL.Query()
+			var query quickfile.FileQuery
+			err := setQueryParams(&query, params)
+			if err != nil {
+				writeJsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if params.Get("unlisted") != "" {
+				account, _, loggedin := getAccount(store, r)
+				if !loggedin {
+					writeJsonError(w, http.StatusUnauthorized, "Must have an account to list unlisted files")
+					return
+				}
+				query.Unlisted, query.Account = DefaultUnlisted, account
+			}
+			writeApiQuery(store, w, r, &query)
+		}
+		r.Get("/files", listFiles)
+		r.Get("/search", listFiles)
+
+		// Takes either the slug or the numeric id, same as file links
+		r.Get("/files/{id}", func(w http.ResponseWriter, r *http.Request) {
+			file, err := lookupFile(r.Context(), store, chi.URLParam(r, "id"))
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			account, _, _ := getAccount(store, r)
+			writeJson(w, http.StatusOK, toApiFile(store.Config, file, account, r))
+		})
+
+		// Same multipart form as the html upload. Returns every file created, even
+		// when a later file in the same upload fails
+		r.Post("/files", func(w http.ResponseWriter, r *http.Request) {
+			account, _, ok := requireApiAccount(store, w, r)
+			if !ok {
+				return
+			}
+			uploads, err := uploadFiles(store, w, r, account)
+			result := make([]*apiFile, 0, len(uploads))
+			for _, upload := range uploads {
+				result = append(result, toApiFile(store.Config, upload, account, r))
+			}
+			if err != nil {
+				writeJson(w, errorStatus(err), &struct {
+					apiError
+					Files []*apiFile `json:"files"`
+				}{apiError{err.Error()}, result})
+				return
+			}
+			writeJson(w, http.StatusCreated, result)
+		})
+
+		r.Delete("/files/{id}", func(w http.ResponseWriter, r *http.Request) {
+			account, _, ok := requireApiAccount(store, w, r)
+			if !ok {
+				return
+			}
+			err := deleteFile(r.Context(), store, chi.URLParam(r, "id"), account)
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		// Your own buckets
+		r.Get("/buckets", func(w http.ResponseWriter, r *http.Request) {
+			account, _, ok := requireApiAccount(store, w, r)
+			if !ok {
+				return
+			}
+			buckets, err := store.GetBucketsContext(r.Context(), account)
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			result := make([]*apiBucket, 0, len(buckets))
+			for _, bucket := range buckets {
+				result = append(result, toApiBucket(store.Config, bucket, r))
+			}
+			writeJson(w, http.StatusOK, result)
+		})
+
+		// Takes a form with the bucket name. Upload into it by passing the slug as unlisted
+		r.Post("/buckets", func(w http.ResponseWriter, r *http.Request) {
+			account, _, ok := requireApiAccount(store, w, r)
+			if !ok {
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(config.SimpleFormLimit))
+			if err := r.ParseForm(); err != nil {
+				writeJsonError(w, http.StatusBadRequest, "Failed to parse form")
+				return
+			}
+			bucket, err := store.CreateBucketContext(r.Context(), account, r.Form.Get("name"))
+			if err != nil {
+				writeJsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJson(w, http.StatusCreated, toApiBucket(store.Config, bucket, r))
+		})
+
+		// The files in a bucket. Like the bucket page, this only needs the slug
+		r.Get("/buckets/{slug}", func(w http.ResponseWriter, r *http.Request) {
+			bucket, err := store.GetBucketBySlugContext(r.Context(), chi.URLParam(r, "slug"))
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			query := quickfile.FileQuery{Unlisted: bucket.Slug}
+			err = setQueryParams(&query, r.URL.Query())
+			if err != nil {
+				writeJsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeApiQuery(store, w, r, &query)
+		})
+
+		// The most used tags on public files, with how many files have them
+		r.Get("/tags", func(w http.ResponseWriter, r *http.Request) {
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit < 1 || limit > config.ResultsPerPage {
+				limit = config.ResultsPerPage
+			}
+			tags, err := store.GetTagCountsContext(r.Context(), limit)
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			result := make([]*apiTagCount, 0, len(tags))
+			for _, tag := range tags {
+				result = append(result, &apiTagCount{Tag: tag.Tag, Count: tag.Count})
+			}
+			writeJson(w, http.StatusOK, result)
+		})
+
+		// Your own limits and usage
+		r.Get("/account", func(w http.ResponseWriter, r *http.Request) {
+			account, acconf, ok := requireApiAccount(store, w, r)
+			if !ok {
+				return
+			}
+			statistics, err := store.GetFileStatisticsContext(r.Context(), account)
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			statistics.PhysicalSize, err = store.GetAccountPhysicalSizeContext(r.Context(), account)
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJson(w, http.StatusOK, &apiAccount{
+				Limits: apiLimits{
+					UploadLimit: acconf.UploadLimit,
+					FileLimit:   acconf.FileLimit,
+					MinExpire:   time.Duration(acconf.MinExpire).String(),
+					MaxExpire:   time.Duration(acconf.MaxExpire).String(),
+				},
+				Statistics: apiStatistics{Count: statistics.Count, TotalSize: statistics.TotalSize, PhysicalSize: statistics.PhysicalSize},
+			})
+		})
+
+		resumableRoutes(r, store)
+
+		// Usage for the whole server
+		r.Get("/statistics", func(w http.ResponseWriter, r *http.Request) {
+			statistics, err := store.GetFileStatisticsContext(r.Context(), "")
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			writeJson(w, http.StatusOK, &apiStatistics{Count: statistics.Count, TotalSize: statistics.TotalSize, PhysicalSize: statistics.PhysicalSize})
+		})
+
+		// A consistent copy of the whole database, made while the server keeps running
+		r.Get("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+			if !requireApiAdmin(store, w, r) {
+				return
+			}
+			// Made on disk first so errors can still be reported, and next to the
+			// database since /tmp might not have room
+			dir, err := os.MkdirTemp(filepath.Dir(store.Config.Datapath), "backup-")
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "backup.db")
+			err = store.BackupContext(r.Context(), path)
+			if err != nil {
+				log.Printf("ERROR: admin backup failed: %s\n", err)
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				writeJsonError(w, errorStatus(err), err.Error())
+				return
+			}
+			defer file.Close()
+			name := fmt.Sprintf("%s.%s.bak", filepath.Base(store.Config.Datapath), time.Now().Format(quickfile.BackupTimeFormat))
+			w.Header().Set("Content-Type", "application/vnd.sqlite3")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+			w.Header().Set("Cache-Control", "no-store")
+			http.ServeContent(w, r, name, time.Now(), file)
+		})
+	})
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/randomouscrap98/quickfile"
+
+	"github.com/dustin/go-humanize"
+)
+
+const commandUsage = `Usage: quickfile [command]
+
+With no command, runs the server (which also migrates the database). Commands:
+  account add [flags] <name>        Create an account and print its key
+  account list                      Show all accounts and their limits
+  account disable <name>            Stop an account from logging in or uploading
+  account set-limit [flags] <name>  Change the limits on an account
+  verify                            Re-hash all file data and report mismatches.
+                                    Also fills in digests for files that don't have one
+  reconcile                         Rebuild the file count and size totals from the files
+  migrate [-dry-run]                Back up the database and bring it up to the current
+                                    version. -dry-run only shows what would be done
+  backup <file>                     Save a copy of the database. Safe while the server runs
+  export [flags] <file>             Write files and their details to a tar archive ("-" for
+                                    stdout). Flags: -account <name>, -tags <a,b> (files with
+                                    all of them), -bucket <slug>
+  import [-account <name>] <file>   Load an archive made by export ("-" for stdin), as normal
+                                    uploads. -account puts everything under that account
+  import-dir [flags] <dir>          Upload every file in a directory tree, skipping ones
+                                    already uploaded. See "import-dir -h" for the flags
+  restore <file>                    Replace the database with a backup (stop the server
+                                    first). The current database is backed up beforehand
+
+Limit flags (for add and set-limit):
+  -upload <bytes>    Total upload size limit
+  -files <count>     Max number of files
+  -minexpire <dur>   Shortest allowed expire (like 1h5m)
+  -maxexpire <dur>   Longest allowed expire ("never" allowed)
+`
+
+// An admin command with its arguments already checked, ready to run on the store
+type storeCommand func(store *quickfile.Store) error
+
+// Run one of the admin commands against the database (no server) and exit
+func runCommand(args []string) {
+	// Nothing needs the config (let alone the database) for this
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Print(commandUsage)
+		return
+	}
+	config := initConfig(false)
+	// Opening the store would migrate on its own, which isn't what a dry run wants,
+	// and restoring shouldn't touch the database it's about to replace
+	if args[0] == "migrate" || args[0] == "restore" {
+		var err error
+		if args[0] == "migrate" {
+			err = migrateCommand(config, args[1:])
+		} else {
+			err = restoreCommand(config, args[1:])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// Opening the store can create, migrate and back up the database, so bad
+	// arguments are caught before that
+	command, err := parseCommand(config, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n\n%s", err, commandUsage)
+		os.Exit(1)
+	}
+	store, err := quickfile.OpenStore(config)
+	must(err)
+	err = command(store)
+	store.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Check the arguments for one of the commands that need the store
+func parseCommand(config *quickfile.Config, args []string) (storeCommand, error) {
+	switch args[0] {
+	case "account":
+		return accountCommand(args[1:])
+	case "verify":
+		return verifyCommand, nil
+	case "reconcile":
+		return reconcileCommand, nil
+	case "backup":
+		return backupCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "import-dir":
+		return importDirCommand(config, args[1:])
+	}
+	return nil, fmt.Errorf("unknown command: %s", args[0])
+}
+
+// Add the limit flags onto the given flagset, which write directly into limits
+func limitFlags(fs *flag.FlagSet, limits *quickfile.AccountConfig) {
+	fs.Int64Var(&limits.UploadLimit, "upload", limits.UploadLimit, "Total upload size limit")
+	fs.IntVar(&limits.FileLimit, "files", limits.FileLimit, "Max number of files")
+	fs.Var(&limits.MinExpire, "minexpire", "Shortest allowed expire")
+	fs.Var(&limits.MaxExpire, "maxexpire", "Longest allowed expire")
+}
+
+// Parse flags and make sure there's exactly one argument left: the account name
+func parseNameArgs(fs *flag.FlagSet, args []string) (string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s needs exactly one account name", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+func accountCommand(args []string) (storeCommand, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("account needs a subcommand")
+	}
+	switch args[0] {
+	case "add":
+		var limits quickfile.AccountConfig
+		fs := flag.NewFlagSet("add", flag.ContinueOnError)
+		limitFlags(fs, &limits)
+		name, err := parseNameArgs(fs, args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(store *quickfile.Store) error {
+			account, err := store.AddAccount(name, &limits)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created account %s (ID: %d)\nKey: %s\n", account.Name, account.ID, account.Key)
+			return nil
+		}, nil
+	case "list":
+		return accountListCommand, nil
+	case "disable":
+		fs := flag.NewFlagSet("disable", flag.ContinueOnError)
+		name, err := parseNameArgs(fs, args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(store *quickfile.Store) error {
+			err := store.DisableAccount(name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Disabled account %s\n", name)
+			return nil
+		}, nil
+	case "set-limit":
+		// Checked against throwaway limits now. Limits we don't get flags for stay
+		// as they are, so the flags are parsed again onto the account's own
+		var limits quickfile.AccountConfig
+		fs := flag.NewFlagSet("set-limit", flag.ContinueOnError)
+		limitFlags(fs, &limits)
+		name, err := parseNameArgs(fs, args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(store *quickfile.Store) error {
+			account, err := store.GetAccountByName(name)
+			if err != nil {
+				return err
+			}
+			fs := flag.NewFlagSet("set-limit", flag.ContinueOnError)
+			limitFlags(fs, &account.Limits)
+			err = fs.Parse(args[1:])
+			if err != nil {
+				return err
+			}
+			err = store.SetAccountLimits(name, &account.Limits)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Updated limits for %s\n", name)
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown account command: %s", args[0])
+}
+
+func accountListCommand(store *quickfile.Store) error {
+	accounts, err := store.GetAccounts()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tUPLOAD\tFILES\tMINEXPIRE\tMAXEXPIRE\tCREATED\tDISABLED")
+	for _, a := range accounts {
+		disabled := ""
+		if a.IsDisabled() {
+			disabled = a.Disabled.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", a.ID, a.Name,
+			humanize.Bytes(uint64(a.Limits.UploadLimit)), a.Limits.FileLimit, a.Limits.MinExpire,
+			a.Limits.MaxExpire, a.Created.Format("2006-01-02 15:04"), disabled)
+	}
+	return tw.Flush()
+}
+
+func verifyCommand(store *quickfile.Store) error {
+	stats, err := store.VerifyFiles()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checked %d files and %d chunks, filled in %d missing digests\n", stats.Files, stats.Chunks, stats.Filled)
+	for _, hash := range stats.BadChunks {
+		fmt.Printf("BAD CHUNK: %s\n", hash)
+	}
+	for _, fid := range stats.BadFiles {
+		fmt.Printf("BAD FILE: %d\n", fid)
+	}
+	if !stats.Ok() {
+		return fmt.Errorf("%d files and %d chunks failed verification", len(stats.BadFiles), len(stats.BadChunks))
+	}
+	return nil
+}
+
+func reconcileCommand(store *quickfile.Store) error {
+	changed, err := store.ReconcileUsage()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rebuilt usage totals, %d were out of date\n", changed)
+	return nil
+}
+
+func migrateCommand(config *quickfile.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only show what would be done")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	report, err := quickfile.MigrateDatabase(config, *dryRun)
+	if err != nil {
+		return err
+	}
+	if len(report.Pending) == 0 {
+		fmt.Printf("Database is at version %d, nothing to do\n", report.From)
+		return nil
+	}
+	action := "Migrated"
+	if report.DryRun {
+		action = "Would migrate"
+	}
+	fmt.Printf("%s database from version %d to %d:\n", action, report.From, report.To)
+	for _, m := range report.Pending {
+		fmt.Printf("  %d: %s\n", m.Version, m.Description)
+	}
+	if report.Backup != "" {
+		fmt.Printf("Backup of the old database: %s\n", report.Backup)
+	}
+	return nil
+}
+
+func backupCommand(args []string) (storeCommand, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("backup needs exactly one destination file")
+	}
+	return func(store *quickfile.Store) error {
+		err := store.Backup(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up database to %s\n", args[0])
+		return nil
+	}, nil
+}
+
+func restoreCommand(config *quickfile.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("restore needs exactly one backup file")
+	}
+	report, err := quickfile.RestoreDatabase(config, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored version %d database from %s\n", report.Version, args[0])
+	if report.Previous != "" {
+		fmt.Printf("Backup of the replaced database: %s\n", report.Previous)
+	}
+	if strconv.Itoa(report.Version) != quickfile.DatabaseVersion {
+		fmt.Printf("It will be migrated to version %s the next time it's opened\n", quickfile.DatabaseVersion)
+	}
+	return nil
+}
+
+// Parse flags and make sure there's exactly one argument left: the archive file
+func parseFileArgs(fs *flag.FlagSet, args []string) (string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s needs exactly one archive file", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+func exportCommand(args []string) (storeCommand, error) {
+	var filter quickfile.ExportFilter
+	var tags string
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.StringVar(&filter.Account, "account", "", "Only files from this account")
+	fs.StringVar(&tags, "tags", "", "Only files with all these tags (comma separated)")
+	fs.StringVar(&filter.Bucket, "bucket", "", "Only files in the bucket with this slug")
+	dest, err := parseFileArgs(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if tags != "" {
+		filter.Tags = strings.Split(tags, ",")
+	}
+	return func(store *quickfile.Store) error {
+		return exportFiles(store, &filter, dest)
+	}, nil
+}
+
+func exportFiles(store *quickfile.Store, filter *quickfile.ExportFilter, dest string) error {
+	var err error
+	out := os.Stdout
+	if dest != "-" {
+		out, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	stats, err := store.ExportFiles(out, filter)
+	if err != nil {
+		return err
+	}
+	if dest != "-" {
+		err = out.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Stdout might be the archive
+	fmt.Fprintf(os.Stderr, "Exported %d files (%s)\n", stats.Files, humanize.Bytes(uint64(stats.Bytes)))
+	return nil
+}
+
+func importCommand(args []string) (storeCommand, error) {
+	var options quickfile.ImportOptions
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.StringVar(&options.Account, "account", "", "Put every file under this account")
+	src, err := parseFileArgs(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	return func(store *quickfile.Store) error {
+		return importFiles(store, &options, src)
+	}, nil
+}
+
+func importFiles(store *quickfile.Store, options *quickfile.ImportOptions, src string) error {
+	var err error
+	in := os.Stdin
+	if src != "-" {
+		in, err = os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	stats, err := store.ImportFiles(in, options)
+	if stats != nil {
+		fmt.Printf("Imported %d files (%s), made %d buckets\n", stats.Files, humanize.Bytes(uint64(stats.Bytes)), stats.CreatedBuckets)
+		for _, skip := range stats.Skipped {
+			fmt.Printf("SKIPPED %s: %s\n", skip.Name, skip.Err)
+		}
+	}
+	return err
+}
+
+func importDirCommand(config *quickfile.Config, args []string) (storeCommand, error) {
+	var options quickfile.DirImportOptions
+	var tags, bucketName string
+	var unlisted, verbose bool
+	expire := config.DefaultExpire
+	fs := flag.NewFlagSet("import-dir", flag.ContinueOnError)
+	fs.StringVar(&options.Meta.Account, "account", "", "Account to upload as (required)")
+	fs.Var(&expire, "expire", "How long until the files expire (\"never\" allowed)")
+	fs.StringVar(&tags, "tags", "", "Tags for every file (comma separated)")
+	fs.BoolVar(&options.DirTags, "dirtags", false, "Also tag files with the names of the directories they're in")
+	fs.BoolVar(&unlisted, "unlisted", false, "Make the files unlisted")
+	fs.StringVar(&bucketName, "bucket", "", "Put the files in the account's bucket with this name, made if needed")
+	fs.BoolVar(&verbose, "v", false, "List the files that were already uploaded")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("import-dir needs exactly one directory")
+	}
+	if options.Meta.Account == "" {
+		return nil, fmt.Errorf("import-dir needs an -account")
+	}
+	options.Meta.Expire = time.Duration(expire)
+	options.Meta.Tags = parseTags(tags)
+	if unlisted {
+		options.Meta.Unlisted = DefaultUnlisted
+	}
+	return func(store *quickfile.Store) error {
+		return importDirectory(store, &options, fs.Arg(0), bucketName, verbose)
+	}, nil
+}
+
+func importDirectory(store *quickfile.Store, options *quickfile.DirImportOptions, dir string, bucketName string, verbose bool) error {
+	if bucketName != "" {
+		_, err := store.GetAccountByName(options.Meta.Account)
+		if err != nil {
+			return err
+		}
+		bucket, err := findOrCreateBucket(store, options.Meta.Account, bucketName)
+		if err != nil {
+			return err
+		}
+		options.Meta.Unlisted = bucket.Slug
+	}
+	stats, err := store.ImportDirectory(dir, options)
+	if stats != nil {
+		if verbose {
+			for _, dup := range stats.Duplicates {
+				fmt.Printf("ALREADY UPLOADED: %s\n", dup)
+			}
+		}
+		for _, skip := range stats.Skipped {
+			fmt.Printf("SKIPPED %s: %s\n", skip.Name, skip.Err)
+		}
+		fmt.Printf("Uploaded %d files (%s), %d were already uploaded, %d skipped\n", stats.Files,
+			humanize.Bytes(uint64(stats.Bytes)), len(stats.Duplicates), len(stats.Skipped))
+	}
+	return err
+}
+
+func findOrCreateBucket(store *quickfile.Store, account string, name string) (*quickfile.Bucket, error) {
+	buckets, err := store.GetBuckets(account)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		if bucket.Name == name {
+			return bucket, nil
+		}
+	}
+	bucket, err := store.CreateBucket(account, name)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Made bucket %s (%s)\n", bucket.Name, bucket.Slug)
+	return bucket, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/randomouscrap98/quickfile"
+
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
+)
+
+// Every file also gets a page at /f/{id} with its details and a preview, plus
+// the OpenGraph/Twitter tags and oEmbed link that chat apps use to show a
+// preview of their own. The raw file link stays exactly as it was
+
+const (
+	SiteName         = "Quick File Uploader"
+	PreviewTextLimit = 16384 // Amount of a text file to show on its page
+)
+
+type oembedResponse struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"` // photo for images we know the size of, link for everything else
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name"`
+	ProviderName    string `json:"provider_name"`
+	ProviderUrl     string `json:"provider_url"`
+	Url             string `json:"url,omitempty"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	ThumbnailUrl    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+func getPageLink(f *quickfile.UploadFile) string {
+	return "f/" + f.Slug
+}
+
+// What kind of inline preview the file gets on its page, if any
+func previewKind(mimeType string) string {
+	for _, kind := range []string{"image", "audio", "video", "text"} {
+		if strings.HasPrefix(mimeType, kind+"/") {
+			return kind
+		}
+	}
+	return ""
+}
+
+// A short description for previews: size, who and when
+func describeFile(f *quickfile.UploadFile) string {
+	description := fmt.Sprintf("%s, uploaded by %s on %s", humanize.Bytes(uint64(f.Length)), f.Account,
+		f.Date.UTC().Format(time.DateOnly))
+	if len(f.Tags) > 0 {
+		description += " #" + strings.Join(f.Tags, " #")
+	}
+	return description
+}
+
+// The start of a text file, and whether there was more
+func readTextPreview(ctx context.Context, store *quickfile.Store, f *quickfile.UploadFile) (string, bool, error) {
+	reader, err := store.OpenChunkReaderContext(ctx, f.ID)
+	if err != nil {
+		return "", false, err
+	}
+	defer reader.Close()
+	text, err := io.ReadAll(io.LimitReader(reader, PreviewTextLimit))
+	if err != nil {
+		return "", false, err
+	}
+	// Cutting it off might have split a character
+	return strings.ToValidUTF8(string(text), ""), f.Length > PreviewTextLimit, nil
+}
+
+// Size of an image from just its header, for image types go understands
+func readImageSize(ctx context.Context, store *quickfile.Store, f *quickfile.UploadFile) (int, int, error) {
+	reader, err := store.OpenChunkReaderContext(ctx, f.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// Pull the file id out of one of our page or raw file urls (/f/{id} or
+// /file/{id}/{name}), wherever the server happens to be mounted
+func fileIdFromUrl(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	if len(parts) >= 2 && parts[len(parts)-2] == "f" {
+		return parts[len(parts)-1], true
+	}
+	if len(parts) >= 3 && parts[len(parts)-3] == "file" {
+		return parts[len(parts)-2], true
+	}
+	return "", false
+}
+
+func landingRoutes(r chi.Router, store *quickfile.Store) {
+	config := store.Config
+
+	r.Get("/f/{id}", func(w http.ResponseWriter, r *http.Request) {
+		idraw := chi.URLParam(r, "id")
+		file, err := lookupFile(r.Context(), store, idraw)
+		if err != nil {
+			if !errors.Is(err, quickfile.ErrNotFound) {
+				log.Printf("File page lookup error for %s: %s\n", idraw, err)
+			}
+			http.Error(w, fmt.Sprintf("Can't find file %s", idraw), errorStatus(err))
+			return
+		}
+		root := getRequestRoot(config, r)
+		account, _, _ := getAccount(store, r)
+		data := map[string]any{
+			"appversion":  AppVersion,
+			"root":        "../",
+			"sitename":    SiteName,
+			"account":     account,
+			"file":        file,
+			"preview":     previewKind(file.Mime),
+			"description": describeFile(file),
+			"pageurl":     root + "/" + getPageLink(file),
+			"fileurl":     root + "/" + getFileLink(file),
+			"oembedurl":   root + "/oembed?format=json&url=" + url.QueryEscape(root+"/"+getPageLink(file)),
+		}
+		if file.Thumbnail {
+			data["thumburl"] = root + "/" + getThumbLink(file)
+		}
+		if data["preview"] == "text" {
+			data["text"], data["truncated"], err = readTextPreview(r.Context(), store, file)
+			if err != nil {
+				log.Printf("WARN: couldn't read text preview for %d: %s\n", file.ID, err)
+				data["preview"] = ""
+			}
+		}
+		renderTemplate(w, config, "filepage", data)
+	})
+
+	// https://oembed.com, only json
+	r.Get("/oembed", func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if format := params.Get("format"); format != "" && format != "json" {
+			http.Error(w, "Only json is supported", http.StatusNotImplemented)
+			return
+		}
+		idraw, ok := fileIdFromUrl(params.Get("url"))
+		if !ok {
+			http.Error(w, "Not a file url", http.StatusNotFound)
+			return
+		}
+		file, err := lookupFile(r.Context(), store, idraw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Can't find file %s", idraw), errorStatus(err))
+			return
+		}
+		root := getRequestRoot(config, r)
+		result := &oembedResponse{
+			Version:      "1.0",
+			Type:         "link",
+			Title:        file.Name,
+			AuthorName:   file.Account,
+			ProviderName: SiteName,
+			ProviderUrl:  root + "/",
+		}
+		if previewKind(file.Mime) == "image" {
+			width, height, err := readImageSize(r.Context(), store, file)
+			if err == nil {
+				result.Type = "photo"
+				result.Url = root + "/" + getFileLink(file)
+				result.Width, result.Height = width, height
+			}
+		}
+		if file.Thumbnail {
+			thumb, err := store.GetThumbnailContext(r.Context(), file.ID)
+			if err == nil {
+				result.ThumbnailUrl = root + "/" + getThumbLink(file)
+				result.ThumbnailWidth, result.ThumbnailHeight = thumb.Width, thumb.Height
+			}
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(time.Duration(config.CacheTime).Seconds())))
+		writeJson(w, http.StatusOK, result)
+	})
+}
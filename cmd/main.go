@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"math"
 	"net/http"
@@ -12,6 +17,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/randomouscrap98/quickfile"
@@ -31,8 +37,12 @@ const (
 	ConfigFile      = "config.toml"
 	AppVersion      = "0.2.6"
 	DefaultUnlisted = "default"
+	MaxFormFields   = 100 // Plain fields allowed in an upload form, on top of the files
 )
 
+// Upload forms we can't make sense of
+var errBadForm = errors.New("bad upload form")
+
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -63,21 +73,50 @@ func initConfig(allowRecreate bool) *quickfile.Config {
 	}
 	// Get all the defaults propogated
 	config.ApplyDefaults()
-	must(quickfile.CreateTables(&config))
-	must(quickfile.VerifyDatabase(&config))
+	must(config.Validate())
 	return &config
 }
 
-// Retrieve the user account. Returns the name, the config, and whether it's valid
-func getAccount(config *quickfile.Config, r *http.Request) (string, *quickfile.AccountConfig, bool) {
-	account, err := r.Cookie(config.CookieName)
-	if err == nil {
-		acconf, ok := config.Accounts[account.Value]
-		if ok {
-			return account.Value, acconf, true
+// Retrieve the user account. Returns the name, the config, and whether it's valid.
+// Browsers send a session cookie, scripts can send the account key as a bearer token
+func getAccount(store *quickfile.Store, r *http.Request) (string, *quickfile.AccountConfig, bool) {
+	var account *quickfile.Account
+	err := fmt.Errorf("%w: no login", quickfile.ErrNotFound)
+	if cookie, cerr := r.Cookie(store.Config.CookieName); cerr == nil {
+		account, err = store.GetSessionAccountContext(r.Context(), cookie.Value)
+	}
+	// An old cookie lying around shouldn't stop a key that was sent on purpose
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && errors.Is(err, quickfile.ErrNotFound) {
+		account, err = store.GetAccountByKeyContext(r.Context(), strings.Trim(bearer, " "))
+		if err == nil && account.IsDisabled() {
+			err = quickfile.ErrForbidden
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, quickfile.ErrNotFound) && !errors.Is(err, quickfile.ErrForbidden) {
+			log.Printf("WARN: couldn't look up account: %s\n", err)
 		}
+		return "", nil, false
 	}
-	return "", nil, false
+	return account.Name, &account.Limits, true
+}
+
+// Only send the session over https if that's how we're being accessed. Behind a
+// proxy the request can't tell, but PublicUrl can
+func isSecureRequest(config *quickfile.Config, r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https" || strings.HasPrefix(config.PublicUrl, "https://")
+}
+
+func setSessionCookie(config *quickfile.Config, w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.CookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   isSecureRequest(config, r),
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
 // Initialize the baseline router and server, but don't actually set up any routes.
@@ -99,7 +138,8 @@ func initServer(config *quickfile.Config) (chi.Router, *http.Server) {
 }
 
 // Generate the data used for base template data
-func getBaseTemplateData(config *quickfile.Config, r *http.Request) map[string]any {
+func getBaseTemplateData(store *quickfile.Store, r *http.Request) map[string]any {
+	config := store.Config
 	params := r.URL.Query()
 	errors := make([]string, 0)
 	data := make(map[string]any)
@@ -113,13 +153,33 @@ func getBaseTemplateData(config *quickfile.Config, r *http.Request) map[string]a
 	data["page"] = page
 	data["time"] = time.Now()
 	data["defaultexpire"] = time.Duration(config.DefaultExpire)
-	account, acconf, ok := getAccount(config, r)
+	// Relative path back to the root, and to the current page, for pages below the root
+	data["root"] = "./"
+	data["pagelink"] = "./?page="
+	// The gallery shows thumbnails instead of the plain list. The link flips it,
+	// staying on the same page with the same search
+	data["gallery"] = params.Get("view") == "gallery"
+	viewparams := r.URL.Query()
+	if data["gallery"].(bool) {
+		viewparams.Del("view")
+	} else {
+		viewparams.Set("view", "gallery")
+	}
+	data["viewlink"] = strings.TrimPrefix(r.URL.EscapedPath(), "/") + "?" + viewparams.Encode()
+	account, acconf, ok := getAccount(store, r)
 	if ok {
 		data["account"] = account
 		data["loggedin"] = true
 		data["acconf"] = acconf
-		data["userfiles"] = getPaginated(page, config, account, errors)
-		userstatistics, err := quickfile.GetFileStatistics(account, config)
+		data["userfiles"] = getPaginated(r.Context(), page, store,
+			&quickfile.FileQuery{Unlisted: DefaultUnlisted, Account: account}, errors)
+		buckets, err := store.GetBucketsContext(r.Context(), account)
+		if err != nil {
+			log.Printf("WARN: couldn't get buckets: %s\n", err)
+			buckets = make([]*quickfile.Bucket, 0)
+		}
+		data["buckets"] = buckets
+		userstatistics, err := store.GetFileStatisticsContext(r.Context(), account)
 		if err != nil {
 			log.Printf("WARN: couldn't get user statistics: %s\n", err)
 			data["userstatistics"] = &quickfile.FileStatistics{}
@@ -127,13 +187,20 @@ func getBaseTemplateData(config *quickfile.Config, r *http.Request) map[string]a
 			data["userstatistics"] = userstatistics
 		}
 	}
-	statistics, err := quickfile.GetFileStatistics("", config)
+	statistics, err := store.GetFileStatisticsContext(r.Context(), "")
 	if err != nil {
 		log.Printf("WARN: couldn't get statistics: %s\n", err)
 		data["statistics"] = &quickfile.FileStatistics{}
 	} else {
 		data["statistics"] = statistics
 	}
+	if config.TagCloudSize > 0 {
+		tagcloud, err := store.GetTagCountsContext(r.Context(), config.TagCloudSize)
+		if err != nil {
+			log.Printf("WARN: couldn't get tag cloud: %s\n", err)
+		}
+		data["tagcloud"] = tagcloud
+	}
 	dbsize, err := config.DbSize()
 	if err != nil {
 		log.Printf("WARN: couldn't get db size: %s", err)
@@ -141,30 +208,76 @@ func getBaseTemplateData(config *quickfile.Config, r *http.Request) map[string]a
 	} else {
 		data["dbsize"] = dbsize
 	}
-	pagecount := int(math.Ceil(float64(statistics.Count) / float64(config.ResultsPerPage)))
+	data["errors"] = errors
+	return data
+}
+
+// Set the main file list on the page to the current page of the query, along
+// with the page links for however many files match in total
+func setFileList(ctx context.Context, store *quickfile.Store, data map[string]any, query *quickfile.FileQuery) {
+	config := store.Config
+	count, err := store.CountFilesContext(ctx, query)
+	if err != nil {
+		log.Printf("WARN: couldn't count files: %s\n", err)
+	}
+	pagecount := int(math.Ceil(float64(count) / float64(config.ResultsPerPage)))
 	pagelist := make([]int, pagecount)
 	for i := 0; i < pagecount; i++ {
 		pagelist[i] = i + 1
 	}
 	data["pagecount"] = pagecount
 	data["pagelist"] = pagelist
-	data["files"] = getPaginated(page, config, "", errors)
-	data["errors"] = errors
-	return data
+	data["files"] = getPaginated(ctx, data["page"].(int), store, query, data["errors"].([]string))
 }
 
-func getPaginated(page int, config *quickfile.Config, account string, errors []string) []*quickfile.UploadFile {
-	unlisted := ""
-	if account != "" {
-		unlisted = DefaultUnlisted
+// Fill in the search filters on the query from the page parameters: q (text),
+// tags (all of them unless anytag is set), account, mime (prefix), minsize,
+// maxsize, after and before (dates). Bad numbers or dates are an error
+func setQueryParams(query *quickfile.FileQuery, params url.Values) error {
+	var err error
+	query.Text = params.Get("q")
+	query.Tags = parseTags(params.Get("tags"))
+	query.AnyTag = params.Get("anytag") != ""
+	if account := params.Get("account"); account != "" {
+		query.Account = account
+	}
+	query.MimePrefix = params.Get("mime")
+	for name, size := range map[string]*int64{"minsize": &query.MinSize, "maxsize": &query.MaxSize} {
+		if raw := params.Get(name); raw != "" {
+			*size, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s: %s", name, raw)
+			}
+		}
+	}
+	for name, date := range map[string]*time.Time{"after": &query.After, "before": &query.Before} {
+		if raw := params.Get(name); raw != "" {
+			*date, err = parseSearchDate(raw)
+			if err != nil {
+				return fmt.Errorf("bad %s: %s", name, raw)
+			}
+		}
 	}
-	fids, err := quickfile.GetPaginatedFiles(page-1, config, unlisted, account)
+	return nil
+}
+
+// Search dates can be a plain day or a full timestamp
+func parseSearchDate(raw string) (time.Time, error) {
+	date, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return time.Parse(time.RFC3339, raw)
+	}
+	return date, nil
+}
+
+func getPaginated(ctx context.Context, page int, store *quickfile.Store, query *quickfile.FileQuery, errors []string) []*quickfile.UploadFile {
+	fids, err := store.SearchFilesContext(ctx, query, page-1)
 	if err != nil {
 		log.Printf("WARN: couldn't load paginated ids: %s\n", err)
 		errors = append(errors, "Couldn't load results, pagination error")
 	} else {
 		files := make([]*quickfile.UploadFile, 0, len(fids)) // just in case
-		results, err := quickfile.GetFilesById(fids, config)
+		results, err := store.GetFilesByIdContext(ctx, fids)
 		if err != nil {
 			log.Printf("WARN: couldn't load results from ids: %s\n", err)
 			errors = append(errors, "Couldn't load results, lookup error")
@@ -178,6 +291,166 @@ func getPaginated(page int, config *quickfile.Config, account string, errors []s
 	return nil
 }
 
+// Map library errors onto the http status that best describes them. Anything
+// we don't recognize is the server's fault
+func errorStatus(err error) int {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.Is(err, quickfile.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, quickfile.ErrQuotaExceeded), errors.Is(err, quickfile.ErrFileCountExceeded),
+		errors.Is(err, quickfile.ErrUploadLength), errors.As(err, &maxBytesError):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, quickfile.ErrForbiddenMime), errors.Is(err, quickfile.ErrUnknownMime):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, quickfile.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, quickfile.ErrUploadOffset):
+		return http.StatusConflict
+	case errors.Is(err, errBadForm), errors.Is(err, quickfile.ErrBadExpire), errors.Is(err, quickfile.ErrNameTooLong),
+		errors.Is(err, quickfile.ErrNoFilename), errors.Is(err, quickfile.ErrTooManyTags):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Stream every file in the multipart upload form straight into the database under
+// the given account, without spooling anything to disk. The expire, tags and
+// unlisted fields apply to every file, so they have to come before the files.
+// Used by both the html form and the api, so errors are meant to go through errorStatus
+func uploadFiles(store *quickfile.Store, w http.ResponseWriter, r *http.Request, account string) ([]*quickfile.UploadFile, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("Can't read multipart form: %s\n", err)
+		return nil, fmt.Errorf("%w: %s", errBadForm, err)
+	}
+	fields := make(map[string]string)
+	var meta *quickfile.FileInsertMeta
+	uploads := make([]*quickfile.UploadFile, 0)
+	// Everything that isn't one of the files shares the simple form limit, so a
+	// form can't go on forever without ever sending a file
+	formLeft := int64(store.Config.SimpleFormLimit)
+	fieldCount := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Can't read next part of multipart form: %s\n", err)
+			return uploads, fmt.Errorf("%w: %s", errBadForm, err)
+		}
+		if part.FileName() == "" || part.FormName() != "files" {
+			fieldCount++
+			if fieldCount > MaxFormFields {
+				return uploads, fmt.Errorf("%w: more than %d fields", errBadForm, MaxFormFields)
+			}
+			name := part.FormName()
+			if part.FileName() == "" && meta != nil && (name == "expire" || name == "tags" || name == "unlisted") {
+				return uploads, fmt.Errorf("%w: %s must come before the files", errBadForm, name)
+			}
+			value, err := io.ReadAll(io.LimitReader(part, formLeft+1))
+			if err != nil {
+				return uploads, err
+			}
+			formLeft -= int64(len(value))
+			if formLeft < 0 {
+				return uploads, &http.MaxBytesError{Limit: int64(store.Config.SimpleFormLimit)}
+			}
+			// Plain fields are small, keep them around for the files. Anything else is ignored
+			if part.FileName() == "" {
+				fields[name] = string(value)
+			}
+			continue
+		}
+		// We support multi-file upload, but every file gets the same expire and tags
+		if meta == nil {
+			meta, err = uploadMeta(r.Context(), store, fields, account)
+			if err != nil {
+				return uploads, err
+			}
+		}
+		fileMeta := *meta
+		fileMeta.Filename = part.FileName()
+		// The size limit is per file, and it's enforced as it streams in
+		file := http.MaxBytesReader(w, io.NopCloser(part), int64(store.Config.UploadSizeLimit))
+		upload, err := store.InsertFileContext(r.Context(), &fileMeta, file)
+		if err != nil {
+			log.Printf("Can't insert file %s: %s\n", fileMeta.Filename, err)
+			return uploads, err
+		}
+		log.Printf("User %s uploaded file %s (ID: %d, %s)\n", upload.Account, upload.Name, upload.ID, humanize.Bytes(uint64(upload.Length)))
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// Everything about the uploaded files except their names, from the form fields
+func uploadMeta(ctx context.Context, store *quickfile.Store, fields map[string]string, account string) (*quickfile.FileInsertMeta, error) {
+	expire, err := parseExpire(fields["expire"])
+	if err != nil {
+		return nil, err
+	}
+	unlisted, err := checkUnlisted(ctx, store, fields["unlisted"])
+	if err != nil {
+		return nil, err
+	}
+	return &quickfile.FileInsertMeta{
+		Account:  account,
+		Tags:     parseTags(fields["tags"]),
+		Expire:   expire,
+		Unlisted: unlisted,
+	}, nil
+}
+
+// Empty expire means forever, which the account limits will probably reject
+func parseExpire(raw string) (time.Duration, error) {
+	raw = strings.Trim(raw, " ")
+	if raw == "" {
+		raw = quickfile.ForeverDuration
+	}
+	expire, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%w: couldn't parse expire: %s", quickfile.ErrBadExpire, err)
+	}
+	return expire, nil
+}
+
+// Uploads can be public, the account's default unlisted, or go into one of the
+// account's buckets (by slug). The store makes sure it's the account's bucket
+func checkUnlisted(ctx context.Context, store *quickfile.Store, unlisted string) (string, error) {
+	if unlisted == "" || unlisted == DefaultUnlisted {
+		return unlisted, nil
+	}
+	bucket, err := store.GetBucketBySlugContext(ctx, unlisted)
+	if err != nil {
+		return "", err
+	}
+	return bucket.Slug, nil
+}
+
+// Expire the file with the given slug or id, but only if it belongs to the given
+// account. Owners can always use the id, even for unlisted files
+func deleteFile(ctx context.Context, store *quickfile.Store, idraw string, account string) error {
+	file, _, err := findFile(ctx, store, idraw)
+	if err != nil {
+		log.Printf("Delete file lookup error: %s\n", err)
+		return err
+	}
+	if file.Account != account {
+		log.Printf("Delete attempt account mismatch: %s deleting %s\n", account, file.Account)
+		return fmt.Errorf("%w: not your file", quickfile.ErrForbidden)
+	}
+	// Yes, it is known that you can repeatedly "delete" a file while it still
+	// exists on the server. I don't think it's an issue
+	err = store.ExpireFileContext(ctx, file.ID)
+	if err != nil {
+		log.Printf("Delete error on %d: %s\n", file.ID, err)
+		return err
+	}
+	return nil
+}
+
 func parseTags(tags string) []string {
 	cleaned := strings.ReplaceAll(tags, ",", " ")
 	splittags := strings.Split(cleaned, " ")
@@ -192,7 +465,74 @@ func parseTags(tags string) []string {
 
 func getFileLink(f *quickfile.UploadFile) string {
 	name := url.PathEscape(f.Name) // getFileLinkName(f)
-	return fmt.Sprintf("file/%d/%s", f.ID, name)
+	return fmt.Sprintf("file/%s/%s", f.Slug, name)
+}
+
+// Only meant for files that have a thumbnail
+func getThumbLink(f *quickfile.UploadFile) string {
+	return "thumb/" + f.Slug
+}
+
+func getTagLink(tag string) string {
+	return "tag/" + url.PathEscape(tag)
+}
+
+// Whether the client said it can take gzip (and didn't say q=0). An explicit
+// gzip entry wins over *, wherever it is in the list
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, starQ := -1.0, -1.0
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params), "q="), 64)
+		if err != nil {
+			q = 1
+		}
+		if name == "gzip" {
+			gzipQ = q
+		} else {
+			starQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return starQ > 0
+}
+
+// Find a file from the id in a link, which is the slug or (for old links) the
+// numeric id. Expired files and unlisted files asked for by number (when the
+// config forbids it) are not found
+func lookupFile(ctx context.Context, store *quickfile.Store, idraw string) (*quickfile.UploadFile, error) {
+	file, bySlug, err := findFile(ctx, store, idraw)
+	if err != nil {
+		return nil, err
+	}
+	if !bySlug && file.Unlisted != "" && store.Config.IsUnlistedSlugOnly() {
+		return nil, fmt.Errorf("%w: %s", quickfile.ErrNotFound, idraw)
+	}
+	if file.IsExpired() {
+		return nil, fmt.Errorf("%w: %s", quickfile.ErrNotFound, idraw)
+	}
+	return file, nil
+}
+
+// The file with the given slug, or the numeric id if it isn't one, and whether
+// it was found by slug. Nothing is hidden, that's up to the caller
+func findFile(ctx context.Context, store *quickfile.Store, idraw string) (*quickfile.UploadFile, bool, error) {
+	file, err := store.GetFileBySlugContext(ctx, idraw)
+	if err == nil || !errors.Is(err, quickfile.ErrNotFound) {
+		return file, true, err
+	}
+	id, perr := strconv.ParseInt(idraw, 10, 64)
+	if perr != nil {
+		return nil, false, err
+	}
+	file, err = store.GetFileByIdContext(ctx, id)
+	return file, false, err
 }
 
 func getIndexTemplate(_ *quickfile.Config) (*template.Template, error) {
@@ -205,204 +545,337 @@ func getIndexTemplate(_ *quickfile.Config) (*template.Template, error) {
 		"NotTooLong": func(t time.Time) bool { return t.Before(time.Now().AddDate(50, 0, 0)) },
 		"arr":        func(els ...any) []any { return els },
 		"FileLink":   getFileLink,
+		"ThumbLink":  getThumbLink,
+		"PageLink":   getPageLink,
+		"TagLink":    getTagLink,
 	}).ParseFiles("index.html")
 }
 
-func maintenanceFunc(config *quickfile.Config) {
-	ticker := time.NewTicker(time.Duration(config.MaintenanceInterval))
+func renderIndex(w http.ResponseWriter, config *quickfile.Config, data map[string]any) {
+	renderTemplate(w, config, "index.html", data)
+}
+
+// Run one of the templates defined in index.html (or the page itself)
+func renderTemplate(w http.ResponseWriter, config *quickfile.Config, name string, data map[string]any) {
+	tmpl, err := getIndexTemplate(config)
+	if err != nil {
+		log.Printf("ERROR: can't load template: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = tmpl.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Printf("ERROR: can't execute template: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func maintenanceFunc(store *quickfile.Store) {
+	ticker := time.NewTicker(time.Duration(store.Config.MaintenanceInterval))
 	defer ticker.Stop()
+	lastVerify := time.Now()
+	lastBackup := time.Now()
+	var verifying atomic.Bool
 
 	for {
 		select {
 		case <-ticker.C:
-			cleanstats, err := quickfile.CleanupExpired(config)
+			cleanstats, err := store.CleanupExpired()
 			if err != nil {
 				log.Printf("MAINTENANCE CLEANUP ERROR: %s\n", err)
 			} else if cleanstats.Any() {
-				log.Printf("Maintenance deleted: %d files, %d tags, %d chunks",
-					cleanstats.DeletedFiles, cleanstats.DeletedTags, cleanstats.DeletedChunks)
+				log.Printf("Maintenance deleted: %d files, %d tags, %d chunks, %d uploads, %d thumbnails",
+					cleanstats.DeletedFiles, cleanstats.DeletedTags, cleanstats.DeletedChunks, cleanstats.DeletedUploads,
+					cleanstats.DeletedThumbnails)
 			}
-			vacuumstats, err := quickfile.TryVacuum(config)
+			vacuumstats, err := store.TryVacuum()
 			if err != nil {
 				log.Printf("MAINTENANCE VACUUM ERROR: %s\n", err)
 			} else if vacuumstats.Vacuumed {
 				log.Printf("Vacuum saved %d bytes\n", vacuumstats.OldSize-vacuumstats.NewSize)
 			}
+			verifyInterval := time.Duration(store.Config.VerifyInterval)
+			// Verifying reads the whole database, so it runs on the side and
+			// the cleanup keeps going. A slow one just delays the next
+			if verifyInterval > 0 && time.Since(lastVerify) >= verifyInterval && verifying.CompareAndSwap(false, true) {
+				lastVerify = time.Now()
+				go func() {
+					defer verifying.Store(false)
+					verifystats, err := store.VerifyFiles()
+					if err != nil {
+						log.Printf("MAINTENANCE VERIFY ERROR: %s\n", err)
+					} else if !verifystats.Ok() {
+						log.Printf("MAINTENANCE VERIFY MISMATCH: bad files %v, bad chunks %v\n",
+							verifystats.BadFiles, verifystats.BadChunks)
+					}
+				}()
+			}
+			backupInterval := time.Duration(store.Config.BackupInterval)
+			if backupInterval > 0 && time.Since(lastBackup) >= backupInterval {
+				lastBackup = time.Now()
+				backupstats, err := store.AutoBackup()
+				if err != nil {
+					log.Printf("MAINTENANCE BACKUP ERROR: %s\n", err)
+				} else {
+					log.Printf("Backed up database to %s (%d bytes), removed %d old backups\n",
+						backupstats.Path, backupstats.Size, len(backupstats.Deleted))
+				}
+			}
 		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	log.Printf("Quickfile server version %s\n", AppVersion)
 	config := initConfig(true)
+	store, err := quickfile.OpenStore(config)
+	must(err)
+	defer store.Close()
 	r, s := initServer(config)
 
-	go maintenanceFunc(config)
+	go maintenanceFunc(store)
+	setupApi(r, store)
+	landingRoutes(r, store)
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		data := getBaseTemplateData(config, r)
-		tmpl, err := getIndexTemplate(config)
+		data := getBaseTemplateData(store, r)
+		var query quickfile.FileQuery
+		search := r.URL.Query()
+		err := setQueryParams(&query, search)
+		if err != nil {
+			data["errors"] = append(data["errors"].([]string), err.Error())
+		}
+		search.Del("page")
+		search.Del("view")
+		if len(search) > 0 {
+			// Keep the search going between pages
+			data["search"] = search
+			data["pagelink"] = "./?" + search.Encode() + "&page="
+		}
+		setFileList(r.Context(), store, data, &query)
+		renderIndex(w, config, data)
+	})
+
+	// Public files with the given tag
+	r.Get("/tag/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		tag, err := url.PathUnescape(chi.URLParam(r, "tag"))
 		if err != nil {
-			log.Printf("ERROR: can't load template: %s\n", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			http.Error(w, "Bad tag", http.StatusBadRequest)
 			return
 		}
-		err = tmpl.Execute(w, data)
+		data := getBaseTemplateData(store, r)
+		data["root"] = "../"
+		data["pagelink"] = getTagLink(tag) + "?page="
+		data["tag"] = tag
+		setFileList(r.Context(), store, data, &quickfile.FileQuery{Tags: []string{tag}})
+		renderIndex(w, config, data)
+	})
+
+	// Anyone with the bucket link can see what's in it, but nothing else
+	r.Get("/bucket/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		slug := chi.URLParam(r, "slug")
+		bucket, err := store.GetBucketBySlugContext(r.Context(), slug)
 		if err != nil {
-			log.Printf("ERROR: can't execute template: %s\n", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			if !errors.Is(err, quickfile.ErrNotFound) {
+				log.Printf("Bucket lookup error for %s: %s\n", slug, err)
+			}
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
+		data := getBaseTemplateData(store, r)
+		data["root"] = "../"
+		data["pagelink"] = "bucket/" + bucket.Slug + "?page="
+		data["bucket"] = bucket
+		setFileList(r.Context(), store, data, &quickfile.FileQuery{Unlisted: bucket.Slug})
+		renderIndex(w, config, data)
 	})
 
 	r.Get("/file/{id}/{name}", func(w http.ResponseWriter, r *http.Request) {
 		idraw := chi.URLParam(r, "id")
-		id, err := strconv.ParseInt(idraw, 10, 64)
-		if err != nil {
-			http.Error(w, "Bad file ID format", http.StatusBadRequest)
+		name := chi.URLParam(r, "name")
+		fileinfo, err := lookupFile(r.Context(), store, idraw)
+		if err != nil && !errors.Is(err, quickfile.ErrNotFound) {
+			log.Printf("File lookup error for %s: %s\n", idraw, err)
+			http.Error(w, "File lookup error", http.StatusInternalServerError)
 			return
 		}
-		name := chi.URLParam(r, "name")
-		fileinfo, err := quickfile.GetFileById(id, config)
-		if err != nil || fileinfo.IsExpired() {
-			http.Error(w, fmt.Sprintf("Can't find file %d", id), http.StatusNotFound)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Can't find file %s", idraw), http.StatusNotFound)
 			return
 		}
+		id := fileinfo.ID
 		requestedName, err := url.PathUnescape(name)
 		if err != nil {
 			log.Printf("Path unescape failed for file lookup: %s\n", err)
 		}
 		//linkname := getFileLinkName(fileinfo)
 		if err != nil || requestedName != fileinfo.Name {
-			log.Printf("File lookup for %d bad name: '%s' vs '%s'", id, requestedName, fileinfo.Name)
-			http.Error(w, fmt.Sprintf("Can't find file %d (bad name?)", id), http.StatusNotFound)
+			log.Printf("File lookup for %s bad name: '%s' vs '%s'", idraw, requestedName, fileinfo.Name)
+			http.Error(w, fmt.Sprintf("Can't find file %s (bad name?)", idraw), http.StatusNotFound)
 			return
 		}
-		reader, err := quickfile.OpenChunkReader(id, config)
+		// The digest is the best etag, older files that haven't been verified yet
+		// fall back to one made from the id and name
+		etag := fileinfo.Digest
+		if etag == "" {
+			filenameHash := md5.Sum([]byte(fileinfo.Name))
+			filenameHex := hex.EncodeToString(filenameHash[:])
+			etag = fmt.Sprintf("quickfile%s_%d_%s", AppVersion, fileinfo.ID, filenameHex)
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(time.Duration(config.CacheTime).Seconds())))
+		w.Header().Set("Content-Type", fileinfo.Mime)
+		if fileinfo.Compression == quickfile.CompressionGzip {
+			w.Header().Set("Vary", "Accept-Encoding")
+			// Gzip files are stored as one gzip stream, so whole file requests from
+			// clients that can take gzip get the stored bytes without any work
+			if fileinfo.Length > 0 && r.Header.Get("Range") == "" && acceptsGzip(r) {
+				etag = fmt.Sprintf("\"%s_gzip\"", etag)
+				w.Header().Set("Etag", etag)
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				raw, err := store.OpenRawReaderContext(r.Context(), id)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Can't find file data %d (this is weird)", id), http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Last-Modified", fileinfo.Date.UTC().Format(http.TimeFormat))
+				_, err = io.Copy(w, raw)
+				if err != nil {
+					log.Printf("WARN: gzip passthrough for %d failed: %s\n", id, err)
+				}
+				return
+			}
+		}
+		reader, err := store.OpenChunkReaderContext(r.Context(), id)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Can't find file data %d (this is weird)", id), http.StatusNotFound)
 			return
 		}
-		filenameHash := md5.Sum([]byte(fileinfo.Name))
-		filenameHex := hex.EncodeToString(filenameHash[:])
-		w.Header().Set("Etag", fmt.Sprintf("\"quickfile%s_%d_%s\"", AppVersion, fileinfo.ID, filenameHex))
-		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(time.Duration(config.CacheTime).Seconds())))
-		w.Header().Set("Content-Type", fileinfo.Mime)
+		defer reader.Close()
+		w.Header().Set("Etag", fmt.Sprintf("\"%s\"", etag))
+		if fileinfo.Digest != "" {
+			// Both the new and old header, the digest is of the whole file even for ranges.
+			// Only sent here: with gzip passthrough they'd have to cover the gzip stream
+			digest, err := hex.DecodeString(fileinfo.Digest)
+			if err == nil {
+				digest64 := base64.StdEncoding.EncodeToString(digest)
+				w.Header().Set("Repr-Digest", fmt.Sprintf("sha-256=:%s:", digest64))
+				w.Header().Set("Digest", "sha-256="+digest64)
+			}
+		}
 		http.ServeContent(w, r, fileinfo.Name, fileinfo.Date, reader)
 	})
 
+	r.Get("/thumb/{id}", func(w http.ResponseWriter, r *http.Request) {
+		idraw := chi.URLParam(r, "id")
+		fileinfo, err := lookupFile(r.Context(), store, idraw)
+		var thumb *quickfile.Thumbnail
+		if err == nil {
+			thumb, err = store.GetThumbnailContext(r.Context(), fileinfo.ID)
+		}
+		if err != nil {
+			if !errors.Is(err, quickfile.ErrNotFound) {
+				log.Printf("Thumbnail lookup error for %s: %s\n", idraw, err)
+			}
+			http.Error(w, fmt.Sprintf("Can't find thumbnail %s", idraw), errorStatus(err))
+			return
+		}
+		// Thumbnails never change, so they can be cached as long as the files
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(time.Duration(config.CacheTime).Seconds())))
+		w.Header().Set("Content-Type", thumb.Mime)
+		w.Header().Set("Etag", fmt.Sprintf("\"thumb_%s\"", fileinfo.Slug))
+		http.ServeContent(w, r, "", fileinfo.Date, bytes.NewReader(thumb.Data))
+	})
+
 	r.Post("/setuser", func(w http.ResponseWriter, r *http.Request) {
 		r.Body = http.MaxBytesReader(w, r.Body, int64(config.SimpleFormLimit))
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Failed to parse form", http.StatusBadRequest)
 			return
 		}
-		// Get form field value
-		account := r.Form.Get("account")
-		_, ok := config.Accounts[account]
-		if ok {
-			http.SetCookie(w, &http.Cookie{
-				Name:   config.CookieName,
-				Value:  account,
-				MaxAge: 365 * 24 * 60 * 60,
-			})
+		// Get form field value. The key never goes into the cookie, only the session
+		token, account, err := store.CreateSessionContext(r.Context(), r.Form.Get("account"))
+		if err == nil {
+			log.Printf("User %s logged in\n", account.Name)
+			setSessionCookie(config, w, r, token, int(store.SessionDuration().Seconds()))
 		} else {
-			log.Printf("Bad user account attempt: %s", account)
+			log.Printf("Bad user account attempt from %s: %s", r.RemoteAddr, err)
 		}
 		// Redirect to the root of the application
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 
+	r.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(config.CookieName)
+		if err == nil {
+			err = store.DeleteSessionContext(r.Context(), cookie.Value)
+			if err != nil {
+				log.Printf("WARN: couldn't delete session: %s\n", err)
+			}
+		}
+		setSessionCookie(config, w, r, "", -1)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
 	r.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
 		// First, get the user, need to be logged in!
-		account, _, ok := getAccount(config, r)
+		account, _, ok := getAccount(store, r)
 		if !ok {
 			log.Printf("Upload attempt without an account\n")
 			http.Error(w, "Invalid account", http.StatusUnauthorized)
 			return
 		}
-		// Set limits on the body
-		r.Body = http.MaxBytesReader(w, r.Body, int64(config.UploadSizeLimit))
-		// Parse the multipart form. Allow small forms to go into memory (larger ones
-		// go onto the filesystem, which is fine considering what we're doing with them)
-		err := r.ParseMultipartForm(quickfile.ChunkSize)
+		_, err := uploadFiles(store, w, r, account)
 		if err != nil {
-			log.Printf("Can't parse multipart form: %s\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
-		expireRaw := strings.Trim(r.FormValue("expire"), " ")
-		if expireRaw == "" {
-			expireRaw = quickfile.ForeverDuration
-		}
-		expire, err := time.ParseDuration(expireRaw)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Couldn't parse expire: %s", err), http.StatusBadRequest)
-			return
-		}
-		tags := parseTags(r.FormValue("tags"))
-		unlisted := r.FormValue("unlisted")
-		// We support multi-file upload, but every file gets the same expire and tags
-		files := r.MultipartForm.File["files"]
-		// Iterate over each file
-		for _, fileHeader := range files {
-			file, err := fileHeader.Open()
-			if err != nil {
-				log.Printf("Can't open one of the files in multipart form: %s\n", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer file.Close()
-			meta := quickfile.FileInsertMeta{
-				Filename: fileHeader.Filename,
-				Account:  account,
-				Tags:     tags,
-				Expire:   expire,
-				Unlisted: unlisted,
-			}
-			upload, err := quickfile.InsertFile(&meta, file, config)
-			if err != nil {
-				log.Printf("Can't insert file %s: %s\n", meta.Filename, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			} else {
-				log.Printf("User %s uploaded file %s (ID: %d, %s)\n", upload.Account, upload.Name, upload.ID, humanize.Bytes(uint64(upload.Length)))
-			}
-		}
 		// Now that we're done, redirect back to the main page
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 
-	r.Post("/delete/{id}", func(w http.ResponseWriter, r *http.Request) {
-		idraw := chi.URLParam(r, "id")
-		id, err := strconv.ParseInt(idraw, 10, 64)
-		if err != nil {
-			http.Error(w, "Bad file ID format", http.StatusBadRequest)
+	r.Post("/bucket", func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(config.SimpleFormLimit))
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
 			return
 		}
-		user, _, exists := getAccount(config, r)
-		if !exists {
-			log.Printf("Delete attempt without an account\n")
+		account, _, ok := getAccount(store, r)
+		if !ok {
+			log.Printf("Bucket create attempt without an account\n")
 			http.Error(w, "Invalid account", http.StatusUnauthorized)
 			return
 		}
-		file, err := quickfile.GetFileById(id, config)
+		bucket, err := store.CreateBucketContext(r.Context(), account, r.Form.Get("name"))
 		if err != nil {
-			log.Printf("Delete file lookup error: %s\n", err)
-			http.Error(w, "File lookup error", http.StatusNotFound)
+			log.Printf("Can't create bucket for %s: %s\n", account, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if file.Account != user {
-			log.Printf("Delete attempt account mismatch: %s deleting %s\n", user, file.Account)
+		log.Printf("User %s created bucket %s\n", account, bucket.Name)
+		http.Redirect(w, r, "/bucket/"+bucket.Slug, http.StatusSeeOther)
+	})
+
+	r.Post("/delete/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user, _, exists := getAccount(store, r)
+		if !exists {
+			log.Printf("Delete attempt without an account\n")
 			http.Error(w, "Invalid account", http.StatusUnauthorized)
 			return
 		}
-		// Yes, it is known that you can repeatedly "delete" a file while it still
-		// exists on the server. I don't think it's an issue
-		err = quickfile.ExpireFile(id, config)
+		err := deleteFile(r.Context(), store, chi.URLParam(r, "id"), user)
 		if err != nil {
-			log.Printf("Delete error on %d: %s\n", id, err)
-			http.Error(w, "Error on delete", http.StatusBadRequest)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
 		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
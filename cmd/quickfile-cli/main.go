@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/randomouscrap98/quickfile/client"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	ConfigFileName = ".quickfile-cli.toml" // In your home directory
+	DefaultExpire  = "24h"
+)
+
+const usage = `Usage: quickfile-cli [global flags] <command> [flags] [args]
+
+Talks to a quickfile server over its api. The server and your account key come
+from ~/.quickfile-cli.toml (Url="...", Key="...", Expire="..."), then the
+QUICKFILE_URL and QUICKFILE_KEY environment variables, then the flags.
+
+Global flags:
+  -config <file>   Use this config file instead
+  -url <url>       Server to talk to, like https://files.example.com
+  -key <key>       Your account key
+  -json            Print results as json instead of text
+  -quiet           No progress bars
+
+Commands:
+  upload [-expire 24h] [-tags a,b] [-unlisted] [-bucket <slug>] [-name <name>] <file>...
+                   Upload files ("-" for stdin, named with -name) and print their links
+  ls [-page n] [-all] [-q text] [-tags a,b] [-anytag] [-account name] [-mime type]
+     [-unlisted] [-bucket <slug>]
+                   List files, newest first. -unlisted lists your own unlisted files
+  get [-o file] [-f] <id|slug>...
+                   Download files, named as they were uploaded. -o picks the name
+                   (only one file, "-" for stdout), -f overwrites
+  rm <id|slug>...  Delete your files
+  info <id|slug>   Show everything about a file
+  quota            Show your account's limits and usage
+`
+
+type Config struct {
+	Url    string
+	Key    string
+	Expire string // Default for uploads
+}
+
+var (
+	jsonOutput bool
+	quiet      bool
+)
+
+// The dotfile, then the environment. Flags go on top of this
+func loadConfig(path string) (*Config, error) {
+	config := &Config{Expire: DefaultExpire}
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		err = toml.Unmarshal(raw, config)
+		if err != nil {
+			return nil, fmt.Errorf("bad config %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if url := os.Getenv("QUICKFILE_URL"); url != "" {
+		config.Url = url
+	}
+	if key := os.Getenv("QUICKFILE_KEY"); key != "" {
+		config.Key = key
+	}
+	return config, nil
+}
+
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ConfigFileName
+	}
+	return filepath.Join(home, ConfigFileName)
+}
+
+func printJson(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func main() {
+	global := flag.NewFlagSet("quickfile-cli", flag.ContinueOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configPath := global.String("config", defaultConfigPath(), "Config file")
+	url := global.String("url", "", "Server url")
+	key := global.String("key", "", "Account key")
+	global.BoolVar(&jsonOutput, "json", false, "Print json")
+	global.BoolVar(&quiet, "quiet", false, "No progress bars")
+	err := global.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		os.Exit(2)
+	}
+	if global.NArg() == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err == nil {
+		if *url != "" {
+			config.Url = *url
+		}
+		if *key != "" {
+			config.Key = *key
+		}
+		if config.Url == "" {
+			err = fmt.Errorf("no server url, set Url in %s or use -url", *configPath)
+		} else {
+			err = runCommand(client.New(config.Url, config.Key), config, global.Args())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runCommand(c *client.Client, config *Config, args []string) error {
+	ctx := context.Background()
+	switch args[0] {
+	case "upload":
+		return uploadCommand(ctx, c, config, args[1:])
+	case "ls":
+		return lsCommand(ctx, c, args[1:])
+	case "get":
+		return getCommand(ctx, c, args[1:])
+	case "rm":
+		return rmCommand(ctx, c, args[1:])
+	case "info":
+		return infoCommand(ctx, c, args[1:])
+	case "quota":
+		return quotaCommand(ctx, c)
+	case "help":
+		fmt.Print(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+func uploadCommand(ctx context.Context, c *client.Client, config *Config, args []string) error {
+	var options client.UploadOptions
+	var tags, name string
+	var unlisted bool
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	fs.StringVar(&options.Expire, "expire", config.Expire, "How long until the files expire")
+	fs.StringVar(&tags, "tags", "", "Tags for every file (comma separated)")
+	fs.BoolVar(&unlisted, "unlisted", false, "Don't show the files in the public list")
+	fs.StringVar(&options.Unlisted, "bucket", "", "Put the files in the bucket with this slug")
+	fs.StringVar(&name, "name", "", "Name for the file read from stdin")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("upload needs at least one file")
+	}
+	options.Tags = splitTags(tags)
+	if unlisted && options.Unlisted == "" {
+		options.Unlisted = "default"
+	}
+	uploaded := make([]*client.File, 0, fs.NArg())
+	for _, path := range fs.Args() {
+		f, err := uploadFile(ctx, c, path, name, &options)
+		if err != nil {
+			return fmt.Errorf("couldn't upload %s: %w", path, err)
+		}
+		uploaded = append(uploaded, f)
+		if !jsonOutput {
+			fmt.Println(f.Url)
+		}
+	}
+	if jsonOutput {
+		return printJson(uploaded)
+	}
+	return nil
+}
+
+func uploadFile(ctx context.Context, c *client.Client, path string, name string, options *client.UploadOptions) (*client.File, error) {
+	if path == "-" {
+		if name == "" {
+			return nil, fmt.Errorf("uploading stdin needs a -name")
+		}
+		return c.Upload(ctx, name, newProgressReader(os.Stdin, name, 0), options)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	return c.Upload(ctx, name, newProgressReader(file, name, info.Size()), options)
+}
+
+func lsCommand(ctx context.Context, c *client.Client, args []string) error {
+	var query client.Query
+	var tags string
+	var page int
+	var all bool
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	fs.IntVar(&page, "page", 1, "Page to show")
+	fs.BoolVar(&all, "all", false, "Show every page")
+	fs.StringVar(&query.Text, "q", "", "Search the names and tags")
+	fs.StringVar(&tags, "tags", "", "Only files with all these tags (comma separated)")
+	fs.BoolVar(&query.AnyTag, "anytag", false, "Files with any of the tags instead")
+	fs.StringVar(&query.Account, "account", "", "Only files from this account")
+	fs.StringVar(&query.Mime, "mime", "", "Only files whose mimetype starts with this")
+	fs.BoolVar(&query.Unlisted, "unlisted", false, "Your own unlisted files")
+	fs.StringVar(&query.Bucket, "bucket", "", "Files in the bucket with this slug")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	query.Tags = splitTags(tags)
+	list, err := c.ListFiles(ctx, &query, page)
+	if err != nil {
+		return err
+	}
+	for all && list.Page < list.PageCount {
+		next, err := c.ListFiles(ctx, &query, list.Page+1)
+		if err != nil {
+			return err
+		}
+		list.Files = append(list.Files, next.Files...)
+		list.Page, list.PageCount = next.Page, next.PageCount
+	}
+	if jsonOutput {
+		return printJson(list)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSLUG\tSIZE\tACCOUNT\tUPLOADED\tEXPIRES\tNAME")
+	for _, f := range list.Files {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", f.ID, f.Slug, humanize.Bytes(uint64(f.Length)), f.Account,
+			f.Date.Local().Format("2006-01-02 15:04"), humanize.Time(f.Expire), f.Name)
+	}
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+	if !all && list.PageCount > 1 {
+		fmt.Fprintf(os.Stderr, "Page %d of %d\n", list.Page, list.PageCount)
+	}
+	return nil
+}
+
+// Where get saved a file, for json output
+type savedFile struct {
+	Path string       `json:"path"`
+	File *client.File `json:"file"`
+}
+
+func getCommand(ctx context.Context, c *client.Client, args []string) error {
+	var output string
+	var force bool
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	fs.StringVar(&output, "o", "", "Save to this file instead (\"-\" for stdout)")
+	fs.BoolVar(&force, "f", false, "Overwrite files that are already there")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("get needs at least one file")
+	}
+	if output != "" && fs.NArg() > 1 {
+		return fmt.Errorf("-o only works with one file")
+	}
+	saved := make([]*savedFile, 0, fs.NArg())
+	for _, id := range fs.Args() {
+		f, err := c.GetFile(ctx, id)
+		if err != nil {
+			return fmt.Errorf("couldn't find %s: %w", id, err)
+		}
+		path := output
+		if path == "" {
+			path = filepath.Base(f.Name)
+		}
+		err = downloadFile(ctx, c, f, path, force)
+		if err != nil {
+			return fmt.Errorf("couldn't download %s: %w", f.Name, err)
+		}
+		saved = append(saved, &savedFile{Path: path, File: f})
+		if !jsonOutput && path != "-" {
+			fmt.Println(path)
+		}
+	}
+	if jsonOutput && output != "-" {
+		return printJson(saved)
+	}
+	return nil
+}
+
+// Save the file, checking it against its digest. Files are written next to
+// where they're going and only moved there once they check out
+func downloadFile(ctx context.Context, c *client.Client, f *client.File, path string, force bool) error {
+	data, err := c.Download(ctx, f)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	hash := sha256.New()
+	reader := io.TeeReader(newProgressReader(data, f.Name, int64(f.Length)), hash)
+	if path == "-" {
+		_, err = io.Copy(os.Stdout, reader)
+		if err != nil {
+			return err
+		}
+		return checkDigest(f, hash.Sum(nil))
+	}
+	if !force {
+		_, err = os.Stat(path)
+		if err == nil {
+			return fmt.Errorf("%s already exists (use -f to overwrite)", path)
+		}
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = io.Copy(temp, reader)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = checkDigest(f, hash.Sum(nil))
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func checkDigest(f *client.File, sum []byte) error {
+	if f.Digest != "" && hex.EncodeToString(sum) != f.Digest {
+		return fmt.Errorf("downloaded data doesn't match the digest %s", f.Digest)
+	}
+	return nil
+}
+
+func rmCommand(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("rm needs at least one file")
+	}
+	deleted := make([]*client.File, 0, len(args))
+	for _, id := range args {
+		f, err := c.GetFile(ctx, id)
+		if err != nil {
+			return fmt.Errorf("couldn't find %s: %w", id, err)
+		}
+		err = c.DeleteFile(ctx, f.Slug)
+		if err != nil {
+			return fmt.Errorf("couldn't delete %s: %w", f.Name, err)
+		}
+		deleted = append(deleted, f)
+		if !jsonOutput {
+			fmt.Printf("Deleted %s (%s)\n", f.Name, f.Slug)
+		}
+	}
+	if jsonOutput {
+		return printJson(deleted)
+	}
+	return nil
+}
+
+func infoCommand(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("info needs exactly one file")
+	}
+	f, err := c.GetFile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJson(f)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, field := range [][2]string{
+		{"Name", f.Name},
+		{"ID", fmt.Sprint(f.ID)},
+		{"Slug", f.Slug},
+		{"Account", f.Account},
+		{"Mime", f.Mime},
+		{"Size", fmt.Sprintf("%s (%d bytes)", humanize.Bytes(uint64(f.Length)), f.Length)},
+		{"Uploaded", f.Date.Local().Format(time.RFC3339)},
+		{"Expires", fmt.Sprintf("%s (%s)", f.Expire.Local().Format(time.RFC3339), humanize.Time(f.Expire))},
+		{"Tags", strings.Join(f.Tags, " ")},
+		{"Digest", f.Digest},
+		{"Url", f.Url},
+		{"Page", c.BaseUrl + f.Page},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", field[0], field[1])
+	}
+	return tw.Flush()
+}
+
+func quotaCommand(ctx context.Context, c *client.Client) error {
+	account, err := c.GetAccount(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJson(account)
+	}
+	limits, stats := account.Limits, account.Statistics
+	fmt.Printf("Files:   %d of %d\n", stats.Count, limits.FileLimit)
+	fmt.Printf("Storage: %s of %s (%s left)\n", humanize.Bytes(uint64(stats.TotalSize)),
+		humanize.Bytes(uint64(limits.UploadLimit)), humanize.Bytes(uint64(max(limits.UploadLimit-stats.TotalSize, 0))))
+	fmt.Printf("Expire:  %s to %s\n", limits.MinExpire, limits.MaxExpire)
+	return nil
+}
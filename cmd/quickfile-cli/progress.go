@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	ProgressWidth    = 30 // Characters in the bar itself
+	ProgressInterval = 100 * time.Millisecond
+)
+
+// Draws a progress bar on stderr as data is read through it. Only bother with
+// one when stderr is a terminal, otherwise it's just noise in logs
+type progressReader struct {
+	reader io.Reader
+	name   string
+	total  int64 // 0 if unknown, then it just counts
+	done   int64
+	drawn  time.Time
+	ended  bool
+}
+
+func showProgress() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressReader(reader io.Reader, name string, total int64) io.Reader {
+	if quiet || !showProgress() {
+		return reader
+	}
+	return &progressReader{reader: reader, name: name, total: total}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.done += int64(n)
+	if !p.ended && (err != nil || time.Since(p.drawn) >= ProgressInterval) {
+		p.ended = err != nil
+		p.draw(p.ended)
+	}
+	return n, err
+}
+
+func (p *progressReader) draw(finished bool) {
+	p.drawn = time.Now()
+	line := fmt.Sprintf("%s %s", p.name, humanize.Bytes(uint64(p.done)))
+	if p.total > 0 {
+		filled := int(min(p.done*ProgressWidth/p.total, ProgressWidth))
+		line = fmt.Sprintf("%s [%s%s] %3d%% %s / %s", p.name, strings.Repeat("=", filled),
+			strings.Repeat(" ", ProgressWidth-filled), min(p.done*100/p.total, 100),
+			humanize.Bytes(uint64(p.done)), humanize.Bytes(uint64(p.total)))
+	}
+	// Clear whatever was there from last time
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+	if finished {
+		fmt.Fprintln(os.Stderr)
+	}
+}
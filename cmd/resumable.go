@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/randomouscrap98/quickfile"
+
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads follow the tus protocol closely enough that simple tus
+// clients work: POST to make one, PATCH the data, HEAD to find out where to
+// pick up after a disconnect. The file is made as soon as the last byte arrives
+
+const (
+	TusVersion        = "1.0.0"
+	UploadContentType = "application/offset+octet-stream"
+)
+
+type apiUpload struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Length int64    `json:"length"`
+	Offset int64    `json:"offset"`
+	Link   string   `json:"link"`           // Where to send the data
+	File   *apiFile `json:"file,omitempty"` // The finished file, once all the data is in
+}
+
+func getUploadLink(us *quickfile.UploadSession) string {
+	return ApiPrefix + "/uploads/" + us.ID
+}
+
+func toApiUpload(store *quickfile.Store, us *quickfile.UploadSession, r *http.Request) *apiUpload {
+	result := &apiUpload{
+		ID:     us.ID,
+		Name:   us.Meta.Filename,
+		Length: us.Length,
+		Offset: us.Offset,
+		Link:   getUploadLink(us),
+	}
+	if us.Done() {
+		// The file might have already expired, then there's just nothing to show
+		file, err := store.GetFileByIdContext(r.Context(), us.Fid)
+		if err == nil {
+			result.File = toApiFile(store.Config, file, us.Meta.Account, r)
+		}
+	}
+	return result
+}
+
+// Metadata comes as comma separated "key base64value" pairs
+func parseUploadMetadata(raw string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(strings.Trim(pair, " "), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad upload metadata for %s: %s", key, err)
+		}
+		result[key] = string(decoded)
+	}
+	return result, nil
+}
+
+func setUploadHeaders(w http.ResponseWriter, us *quickfile.UploadSession) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(us.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(us.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func logFinishedUpload(us *quickfile.UploadSession) {
+	if us.Done() {
+		log.Printf("User %s uploaded file %s (ID: %d, %s) in a resumable upload\n", us.Meta.Account,
+			us.Meta.Filename, us.Fid, humanize.Bytes(uint64(us.Length)))
+	}
+}
+
+func resumableRoutes(r chi.Router, store *quickfile.Store) {
+	// Takes the total size in Upload-Length and the file info in Upload-Metadata:
+	// filename, plus optionally expire, tags and unlisted (same as the form fields)
+	r.Post("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		account, _, ok := requireApiAccount(store, w, r)
+		if !ok {
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Missing or bad Upload-Length")
+			return
+		}
+		metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		expire, err := parseExpire(metadata["expire"])
+		if err != nil {
+			writeJsonError(w, errorStatus(err), err.Error())
+			return
+		}
+		unlisted, err := checkUnlisted(r.Context(), store, metadata["unlisted"])
+		if err != nil {
+			writeJsonError(w, errorStatus(err), err.Error())
+			return
+		}
+		meta := quickfile.FileInsertMeta{
+			Filename: metadata["filename"],
+			Account:  account,
+			Tags:     parseTags(metadata["tags"]),
+			Expire:   expire,
+			Unlisted: unlisted,
+		}
+		us, err := store.CreateUploadSessionContext(r.Context(), &meta, length)
+		if err != nil {
+			log.Printf("Can't start upload %s for %s: %s\n", meta.Filename, account, err)
+			writeJsonError(w, errorStatus(err), err.Error())
+			return
+		}
+		logFinishedUpload(us)
+		setUploadHeaders(w, us)
+		w.Header().Set("Location", getUploadLink(us))
+		writeJson(w, http.StatusCreated, toApiUpload(store, us, r))
+	})
+
+	// Where to carry on from
+	r.Head("/uploads/{upload}", func(w http.ResponseWriter, r *http.Request) {
+		account, _, ok := getAccount(store, r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		us, err := store.GetUploadSessionContext(r.Context(), chi.URLParam(r, "upload"), account)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			return
+		}
+		setUploadHeaders(w, us)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r.Get("/uploads/{upload}", func(w http.ResponseWriter, r *http.Request) {
+		account, _, ok := requireApiAccount(store, w, r)
+		if !ok {
+			return
+		}
+		us, err := store.GetUploadSessionContext(r.Context(), chi.URLParam(r, "upload"), account)
+		if err != nil {
+			writeJsonError(w, errorStatus(err), err.Error())
+			return
+		}
+		setUploadHeaders(w, us)
+		writeJson(w, http.StatusOK, toApiUpload(store, us, r))
+	})
+
+	// The body is the data starting at Upload-Offset, which has to be where the
+	// upload is up to. Whatever arrives is kept, even if the connection drops
+	r.Patch("/uploads/{upload}", func(w http.ResponseWriter, r *http.Request) {
+		account, _, ok := requireApiAccount(store, w, r)
+		if !ok {
+			return
+		}
+		if r.Header.Get("Content-Type") != UploadContentType {
+			writeJsonError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+UploadContentType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, "Missing or bad Upload-Offset")
+			return
+		}
+		us, err := store.WriteUploadSessionContext(r.Context(), chi.URLParam(r, "upload"), account, offset, r.Body)
+		if us != nil {
+			setUploadHeaders(w, us)
+		}
+		if err != nil {
+			log.Printf("Upload write failed for %s: %s\n", account, err)
+			writeJsonError(w, errorStatus(err), err.Error())
+			return
+		}
+		logFinishedUpload(us)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Give up on an upload. Doesn't delete the file if it was already finished
+	r.Delete("/uploads/{upload}", func(w http.ResponseWriter, r *http.Request) {
+		account, _, ok := requireApiAccount(store, w, r)
+		if !ok {
+			return
+		}
+		err := store.DeleteUploadSessionContext(r.Context(), chi.URLParam(r, "upload"), account)
+		if err != nil {
+			writeJsonError(w, errorStatus(err), err.Error())
+			return
+		}
+		w.Header().Set("Tus-Resumable", TusVersion)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,233 @@
+package quickfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Mimetypes which are already compressed, so compressing them again is a waste
+// of time no matter what the config says
+var CompressedMimeTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic",
+	"video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-xz", "application/x-bzip2", "application/x-7z-compressed",
+	"application/vnd.rar", "application/x-rar-compressed",
+}
+
+// Minimal gzip header: deflate, no flags, no mtime, unknown OS
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+
+// Pick the compression for a file from the config, using the longest mimetype
+// prefix that matches. Already compressed types never get compressed
+func (c *Config) CompressionFor(mimeType string) string {
+	if anyStartsWith(mimeType, CompressedMimeTypes) {
+		return CompressionNone
+	}
+	result, longest := CompressionNone, -1
+	for prefix, compression := range c.Compression {
+		if strings.HasPrefix(mimeType, prefix) && len(prefix) > longest {
+			result, longest = compression, len(prefix)
+		}
+	}
+	return result
+}
+
+// The zstd encoder and decoder are safe to share when only using the *All
+// functions, and they're expensive to make
+var zstdCodec = sync.OnceValues(func() (*zstd.Encoder, *zstd.Decoder) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		panic(err)
+	}
+	return encoder, decoder
+})
+
+// Flate writers are big, so they're reused between chunks
+var flateWriters = sync.Pool{New: func() any {
+	fw, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		panic(err)
+	}
+	return fw
+}}
+
+// Compress a single chunk. Every chunk is compressed on its own, so reading any
+// chunk never needs any other chunk, and the same data always comes out the
+// same wherever it is in a file.
+//
+// Gzip chunks are each a run of deflate blocks with a fresh dictionary, ending
+// on a flush so they're byte aligned. Put gzipHeader in front of all of a
+// file's chunks and its trailer after them and that's one normal gzip stream,
+// which can be sent to browsers as-is
+func compressChunk(compression string, chunk []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return chunk, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		fw := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(fw)
+		fw.Reset(&buf)
+		_, err := fw.Write(chunk)
+		if err != nil {
+			return nil, err
+		}
+		err = fw.Flush()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, _ := zstdCodec()
+		return encoder.EncodeAll(chunk, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", compression)
+	}
+}
+
+// Running totals over a file's (uncompressed) data as it's stored: the digest
+// everyone sees, plus the crc and size that end a gzip stream
+type fileHasher struct {
+	sha    hash.Hash
+	crc    hash.Hash32
+	length int64
+}
+
+func newFileHasher() *fileHasher {
+	return &fileHasher{sha: sha256.New(), crc: crc32.NewIEEE()}
+}
+
+func (h *fileHasher) write(chunk []byte) {
+	h.sha.Write(chunk)
+	h.crc.Write(chunk)
+	h.length += int64(len(chunk))
+}
+
+type fileHasherState struct {
+	Sha, Crc []byte
+	Length   int64
+}
+
+// The hashes as they are so far, so they can be picked up again later
+func (h *fileHasher) marshal() ([]byte, error) {
+	var state fileHasherState
+	var err error
+	state.Sha, err = h.sha.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	state.Crc, err = h.crc.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	state.Length = h.length
+	return json.Marshal(&state)
+}
+
+// Pick the hashes back up from marshal. Nothing at all is a brand new one
+func unmarshalFileHasher(data []byte) (*fileHasher, error) {
+	h := newFileHasher()
+	if len(data) == 0 {
+		return h, nil
+	}
+	var state fileHasherState
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	err = h.sha.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Sha)
+	if err != nil {
+		return nil, err
+	}
+	err = h.crc.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Crc)
+	if err != nil {
+		return nil, err
+	}
+	h.length = state.Length
+	return h, nil
+}
+
+// Hex sha256 of everything written
+func (h *fileHasher) digest() string {
+	return hex.EncodeToString(h.sha.Sum(nil))
+}
+
+// What goes after the last chunk of a file stored with the given compression,
+// so the chunks add up to a complete stream. Only gzip has one: the final
+// (empty) deflate block, then the crc and size
+func (h *fileHasher) trailer(compression string) ([]byte, error) {
+	if compression != CompressionGzip {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	fw := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(fw)
+	fw.Reset(&buf)
+	err := fw.Close()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, h.crc.Sum32()))
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(h.length)))
+	return buf.Bytes(), nil
+}
+
+// Get the original data back out of a stored chunk. The length is the size of
+// the chunk before compression
+func decompressChunk(compression string, data []byte, length int) ([]byte, error) {
+	result, err := decompressChunkData(compression, data, length)
+	if err != nil {
+		return nil, err
+	}
+	// Readers slice into the chunk by offset, so a short one can't be trusted
+	if len(result) != length {
+		return nil, fmt.Errorf("chunk is %d bytes, expected %d", len(result), length)
+	}
+	return result, nil
+}
+
+// Same as decompressChunk, but the result may be shorter than the length. Good
+// for when the real length isn't known, only the most it could be
+func decompressChunkData(compression string, data []byte, length int) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		// Chunks don't end the deflate stream, so running out of data is as good as
+		// it gets. Whether that was soon enough is up to the length check
+		result, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), int64(length)))
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return result, nil
+	case CompressionZstd:
+		_, decoder := zstdCodec()
+		return decoder.DecodeAll(data, make([]byte, 0, length))
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", compression)
+	}
+}
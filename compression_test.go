@@ -0,0 +1,130 @@
+package quickfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// Compressible but not trivially so
+func textData(length int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < length; i++ {
+		fmt.Fprintf(&buf, "log line %d: value=%d\n", i, rand.Intn(1000))
+	}
+	return buf.Bytes()[:length]
+}
+
+func TestCompressionFor(t *testing.T) {
+	config := Config{Compression: map[string]string{"text/": "gzip", "text/csv": "zstd", "application/": "zstd"}}
+	for mime, expected := range map[string]string{
+		"text/plain; charset=utf-8": CompressionGzip,
+		"text/csv":                  CompressionZstd,
+		"application/json":          CompressionZstd,
+		"application/zip":           CompressionNone,
+		"image/png":                 CompressionNone,
+		"video/mp4":                 CompressionNone,
+	} {
+		if config.CompressionFor(mime) != expected {
+			t.Fatalf("Expected %s to use '%s', got '%s'\n", mime, expected, config.CompressionFor(mime))
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	store := createTables(t, "compression")
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.UploadLimit = 100_000_000 })
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		store.Config.Compression = map[string]string{"text/": compression}
+		// Exact chunk multiples put the end of the gzip stream on a full chunk
+		for _, length := range []int{0, 100, ChunkSize, ChunkSize*3 + 1234} {
+			data := textData(length)
+			meta := workingMeta()
+			meta.Filename = "log.txt"
+			uf, err := store.InsertFile(&meta, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Couldn't insert %s/%d: %s\n", compression, length, err)
+			}
+			if uf.Compression != compression || uf.Length != length {
+				t.Fatalf("File stored wrong: '%s' %d\n", uf.Compression, uf.Length)
+			}
+			reader, err := store.OpenChunkReader(uf.ID)
+			if err != nil {
+				t.Fatalf("Couldn't open reader: %s\n", err)
+			}
+			result, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Couldn't read %s/%d: %s\n", compression, length, err)
+			}
+			if !bytes.Equal(result, data) {
+				t.Fatalf("Data mismatch for %s/%d\n", compression, length)
+			}
+			if length > ChunkSize {
+				// Seek into the middle of a later chunk
+				offset := int64(ChunkSize*2 + 77)
+				_, err = reader.Seek(offset, io.SeekStart)
+				if err != nil {
+					t.Fatalf("Couldn't seek: %s\n", err)
+				}
+				part := make([]byte, 5000)
+				_, err = io.ReadFull(reader, part)
+				if err != nil {
+					t.Fatalf("Couldn't read after seek: %s\n", err)
+				}
+				if !bytes.Equal(part, data[offset:offset+5000]) {
+					t.Fatalf("Data mismatch after seek for %s\n", compression)
+				}
+				_, err = reader.Seek(-10, io.SeekEnd)
+				if err != nil {
+					t.Fatalf("Couldn't seek from end: %s\n", err)
+				}
+				part, err = io.ReadAll(reader)
+				if err != nil || !bytes.Equal(part, data[length-10:]) {
+					t.Fatalf("Data mismatch at end for %s: %v\n", compression, err)
+				}
+				var stored int64
+				err = store.Db().QueryRow("SELECT SUM(d.length) FROM filechunks f JOIN chunkdata d ON d.hash = f.hash WHERE f.fid = ?", uf.ID).Scan(&stored)
+				if err != nil {
+					t.Fatalf("Couldn't get stored size: %s\n", err)
+				}
+				if (compression == CompressionNone) != (stored == int64(length)) {
+					t.Fatalf("Stored size %d for %d bytes with '%s'\n", stored, length, compression)
+				}
+			}
+			reader.Close()
+
+			// Gzip files come out as a single normal gzip stream, even empty ones
+			if compression == CompressionGzip {
+				checkRawGzip(t, store, uf.ID, data)
+			}
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := Config{Compression: map[string]string{"text/": "gzip", "image/": ""}, PublicUrl: "https://files.example.com/"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Valid config rejected: %s\n", err)
+	}
+	config.Compression["application/"] = "brotli"
+	if err := config.Validate(); err == nil {
+		t.Fatalf("Unknown compression should be rejected\n")
+	}
+	delete(config.Compression, "application/")
+	for _, bad := range []string{"files.example.com", "ftp://files.example.com", "https://"} {
+		config.PublicUrl = bad
+		if err := config.Validate(); err == nil {
+			t.Fatalf("PublicUrl %s should be rejected\n", bad)
+		}
+	}
+}
+
+func TestShortChunk(t *testing.T) {
+	// A chunk that comes out shorter than the file says is an error, not a panic later
+	_, err := decompressChunk(CompressionNone, []byte("abc"), 10)
+	if err == nil {
+		t.Fatalf("Expected an error for a short chunk\n")
+	}
+}
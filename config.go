@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"time"
 
@@ -32,6 +33,15 @@ func (d *Duration) UnmarshalText(b []byte) error {
 	return nil
 }
 
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// So durations can be used directly as command line flags
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
 type AccountConfig struct {
 	UploadLimit int64
 	FileLimit   int
@@ -44,6 +54,7 @@ type Config struct {
 	Datapath            string                    // Place to put the files
 	CookieName          string                    // Name of authentication cookie
 	Port                int                       // The port obviously
+	PublicUrl           string                    // Where people reach the site (like behind a proxy), for full links. Defaults to the request's host
 	MemProfileFile      string                    // If set, determines where to store mem profile when endpoint called. Endpoint disabled if empty
 	TotalUploadLimit    int64                     // Max size for the totality of file uploads (not size of db!!)
 	DefaultUploadLimit  int64                     // Size in bytes of account upload
@@ -54,18 +65,29 @@ type Config struct {
 	MaxFileTags         int                       // Maximum amount of tags on a single file
 	MaxFileName         int                       // Max length of filename. Files will be rejected if larger than this
 	ResultsPerPage      int                       // Amount of files to show per page
+	TagCloudSize        int                       // Amount of tags to show in the tag cloud. 0 hides it
+	ThumbnailSize       int                       // Max width and height of image thumbnails, made on upload. 0 disables them
 	VacuumThreshold     int64                     // Amount of bytes required before vacuum. Set to 0 to disable
 	MaintenanceInterval Duration                  // Interval between maintenance cycles (should be less than the min expire)
+	VerifyInterval      Duration                  // Interval between re-hashing all the file data. 0 disables
+	BackupInterval      Duration                  // Interval between automatic backups. 0 disables
+	BackupDirectory     string                    // Where automatic backups go, relative to the database's directory. Defaults to next to it
+	BackupKeep          int                       // How many automatic backups to keep. 0 keeps them all
 	RateLimitInterval   Duration                  // span of time for rate limiting
 	RateLimitCount      int                       // Amount of times a user from a single IP can access per interval
 	DefaultMinExpire    Duration                  // Min expire measured in minutes
 	DefaultExpire       Duration                  // Default expiration value if none is set
 	DefaultMaxExpire    Duration                  // Maximum allowed expiration
 	CacheTime           Duration                  // How long to cache
-	Accounts            map[string]*AccountConfig // The accounts usable
+	SessionDuration     Duration                  // How long a login lasts
+	UploadSessionExpire Duration                  // How long a resumable upload is kept after its last write
+	Accounts            map[string]*AccountConfig // Accounts to import the first time the database starts
 	MimeTypeRedirect    map[string]string         // Make certain mime types other mime types
+	Compression         map[string]string         // Compress files whose mime starts with the key, with "gzip" or "zstd"
 	AllowedMimeTypes    []string                  // If set, only allow mimetypes from this list
 	ForbiddenMimeTypes  []string                  // All mimes in this list are blocked
+	UnlistedSlugOnly    *bool                     // Unlisted files can only be downloaded with their slug link, not the numeric id. On if not set
+	AdminAccounts       []string                  // Accounts allowed to use the admin api (like downloading backups)
 }
 
 func GetDefaultConfig_Toml() string {
@@ -79,10 +101,16 @@ func GetDefaultConfig_Toml() string {
 Datapath="uploads.db"   # Where to store the upload database (one file)
 Timeout="2m"            # Timeout for requests (upload/download). Format is like 1h2m3s etc
 Port=5007               # Which port to run the server on
+# The address people use to get to the site, like "https://files.example.com". Set
+# it if the server is behind a proxy (especially one doing https), so full links
+# and secure cookies come out right. Empty uses whatever host the request asked for
+PublicUrl=""
 RateLimitCount=100      # Requests allowed per interval
 RateLimitInterval="1m"  # Requests limiting interval (rate limiting with RateLimitCount)
 CacheTime="8760h"       # The max-age cache time (how long you want the browser to cache files)
 CookieName="quickile_account"   # The name of the cookie
+SessionDuration="720h"          # How long a login lasts before you have to enter your key again
+UploadSessionExpire="24h"       # Resumable uploads nobody has written to in this long are thrown away
 TotalUploadLimit=1_000_000_000  # 1GB, total file database max
 DefaultUploadLimit=100_000_000  # The default upload limit for accounts
 DefaultFileLimit=100            # The default limit of files per user
@@ -93,6 +121,8 @@ UploadSizeLimit=100_000_000     # Maximum individual file size
 MaxFileTags=10                  # Maximum tags per file
 MaxFileName=128                 # Max length of filename
 ResultsPerPage=100              # Amount of files to list per page
+TagCloudSize=50                 # Amount of most used tags to show on the page (0 to hide)
+ThumbnailSize=200               # Max width/height of thumbnails made for png, jpeg and gif uploads (0 to not make them)
 SimpleFormLimit=100_000         # Size limit for simple forms (you usually don't need to change this)
 HeaderLimit=100_000             # Size limit for http header (you usually don't need to change this)
 # How much "empty space" to leave before vacuuming. 0 means no vacuuming. This is a delicate
@@ -106,6 +136,22 @@ HeaderLimit=100_000             # Size limit for http header (you usually don't
 # might be something like 100_000_000
 VacuumThreshold=0
 MaintenanceInterval="10m"
+# Every so often, re-hash all the file data and log anything that doesn't match
+# its stored digest. This reads the entire database, so don't do it too often.
+# "0s" turns it off; you can always run "quickfile verify" yourself
+VerifyInterval="0s"
+# Save a copy of the database to BackupDirectory (relative to the database's
+# folder) this often, keeping only the newest BackupKeep of them. It's safe to do while the server is running, and
+# "quickfile backup <file>" does the same thing by hand. "0s" turns it off
+BackupInterval="0s"
+BackupDirectory="backups"
+BackupKeep=7
+# Files are linked using a random slug, but old links using the numeric file id
+# still work. Set this to stop unlisted files being found by their numeric id
+UnlistedSlugOnly=true
+# Names of accounts (see "quickfile account list") that can use the admin api,
+# which for now is downloading a backup of the database from /api/v1/admin/backup
+AdminAccounts=[]
 
 # Some mime types are either dangerous (html) and some are like... unknown (empty string).
 # If you want other mime redirects, add them
@@ -113,8 +159,18 @@ MaintenanceInterval="10m"
 ""="application/octet-stream"
 "text/html"="text/plain"
 
-# This is how you define an account. The fields are optional:
-# if not defined, it will use the defaults defined above
+# Files can be compressed inside the database, picked by the start of the mime type
+# (longest match wins). Options are "gzip" and "zstd". gzip can be sent to browsers
+# without decompressing it, zstd is smaller and faster. Types that are already
+# compressed (zip, jpeg, video, etc) are never compressed again
+[Compression]
+"text/"="gzip"
+"application/json"="gzip"
+
+# Accounts live in the database and are managed with "quickfile account ...".
+# Any accounts defined here are imported into the database the first time it
+# starts (and never again) and given a generated name; the key here is the
+# login. The fields are optional: if not defined, it will use the defaults defined above
 [Accounts.%s]
 # MinExpire="1m"
 # MaxExpire="never"
@@ -123,6 +179,35 @@ MaintenanceInterval="10m"
 `, time.Now().Format(time.RFC3339), randomHex)
 }
 
+// Check the parts of the config that would otherwise only fail later, so a typo
+// shows up when the config loads instead of failing every upload of that type
+// (or every link)
+func (c *Config) Validate() error {
+	for prefix, compression := range c.Compression {
+		switch compression {
+		case CompressionNone, CompressionGzip, CompressionZstd:
+		default:
+			return fmt.Errorf("unknown compression '%s' for '%s'", compression, prefix)
+		}
+	}
+	if c.PublicUrl != "" {
+		u, err := url.Parse(c.PublicUrl)
+		if err != nil {
+			return fmt.Errorf("bad PublicUrl: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("PublicUrl should look like https://files.example.com, got '%s'", c.PublicUrl)
+		}
+	}
+	return nil
+}
+
+// Whether unlisted files need their slug. Configs from before the setting
+// existed don't have it, and they should get the safe choice
+func (c *Config) IsUnlistedSlugOnly() bool {
+	return c.UnlistedSlugOnly == nil || *c.UnlistedSlugOnly
+}
+
 // Apply the defaults to all the accounts so you can directly use the values
 func (c *Config) ApplyDefaults() {
 	for k, v := range c.Accounts {
@@ -137,8 +222,11 @@ func (c *Config) ApplyDefaults() {
 	}
 }
 
+// Open a raw connection pool to the database. Transactions take the write lock
+// immediately, otherwise two pooled connections reading then writing in the same
+// transaction will deadlock each other. You probably want OpenStore instead
 func (c *Config) OpenDb() (*sql.DB, error) {
-	return sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d", c.Datapath, BusyTimeout))
+	return sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate", c.Datapath, BusyTimeout))
 }
 
 func (c *Config) DbSize() (int64, error) {
@@ -0,0 +1,123 @@
+package quickfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type DirImportOptions struct {
+	Meta    FileInsertMeta // Account, expire, tags and unlisted for every file. The filename is ignored
+	DirTags bool           // Also tag files with the names of the directories they're in, below the root
+}
+
+type DirImportStatistics struct {
+	Files      int
+	Bytes      int64
+	Duplicates []string // Files skipped because the account already uploaded the same data
+	Skipped    []*ImportSkip
+}
+
+// Upload every file in the directory tree as if it came through the page, one
+// at a time, so quotas and the other checks apply to each. Files whose data
+// the account already uploaded are left out (another account having it doesn't
+// count), as are hidden files and directories. Paths in the statistics are
+// relative to root
+func (s *Store) ImportDirectory(root string, options *DirImportOptions) (*DirImportStatistics, error) {
+	return s.ImportDirectoryContext(context.Background(), root, options)
+}
+
+func (s *Store) ImportDirectoryContext(ctx context.Context, root string, options *DirImportOptions) (*DirImportStatistics, error) {
+	// Otherwise every file would be skipped for it
+	_, err := s.GetAccountByNameContext(ctx, options.Meta.Account)
+	if err != nil {
+		return nil, err
+	}
+	stats := &DirImportStatistics{Duplicates: make([]string, 0), Skipped: make([]*ImportSkip, 0)}
+	err = filepath.WalkDir(root, func(fullpath string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		relpath, _ := filepath.Rel(root, fullpath)
+		if err != nil {
+			if relpath == "." {
+				return err
+			}
+			stats.Skipped = append(stats.Skipped, &ImportSkip{Name: relpath, Err: err})
+			return nil
+		}
+		if relpath != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		err = s.importDirFile(ctx, fullpath, relpath, options, stats)
+		if isImportRejection(err) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			stats.Skipped = append(stats.Skipped, &ImportSkip{Name: relpath, Err: err})
+			return nil
+		}
+		return err
+	})
+	return stats, err
+}
+
+// Directory names as tags. Tags can't have spaces or commas in them
+func dirTags(relpath string) []string {
+	dirs := strings.Split(filepath.ToSlash(filepath.Dir(relpath)), "/")
+	tags := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		tag := strings.Join(strings.Fields(strings.ReplaceAll(dir, ",", " ")), "_")
+		if tag != "" && tag != "." {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (s *Store) importDirFile(ctx context.Context, fullpath string, relpath string, options *DirImportOptions, stats *DirImportStatistics) error {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Reading it twice is cheaper than uploading something we already have
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	// Someone else having the same file doesn't mean this account does
+	_, err = s.GetFileByDigestContext(ctx, hex.EncodeToString(hash.Sum(nil)), options.Meta.Account)
+	if err == nil {
+		stats.Duplicates = append(stats.Duplicates, relpath)
+		return nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	meta := options.Meta
+	meta.Filename = filepath.Base(fullpath)
+	if options.DirTags {
+		meta.Tags = sliceDistinct(append(append(make([]string, 0), meta.Tags...), dirTags(relpath)...))
+	}
+	uf, err := s.InsertFileContext(ctx, &meta, file)
+	if err != nil {
+		return err
+	}
+	stats.Files++
+	stats.Bytes += int64(uf.Length)
+	return nil
+}
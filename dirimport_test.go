@@ -0,0 +1,113 @@
+package quickfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDirTags(t *testing.T) {
+	for path, expected := range map[string][]string{
+		"file.txt":                        {},
+		"photos/file.png":                 {"photos"},
+		"photos/Summer 2024, beach/a.png": {"photos", "Summer_2024_beach"},
+	} {
+		tags := dirTags(filepath.FromSlash(path))
+		if !slices.Equal(tags, expected) {
+			t.Fatalf("Expected tags %v for %s, got %v\n", expected, path, tags)
+		}
+	}
+}
+
+func TestImportDirectory(t *testing.T) {
+	store := createTables(t, "importdir")
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.FileLimit = 3 })
+	root := uniqueFile("importdir", "")
+	for path, data := range map[string]string{
+		"top.txt":             "top",
+		"photos/one.png":      "one",
+		"photos/again.png":    "top", // Same data as top.txt
+		"photos/trip/two.png": "two",
+		"more/a.pdf":          "pdf",
+		".hidden/secret.txt":  "secret",
+		"photos/.dotfile":     "dot",
+		"more/four.txt":       "four",
+	} {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(full), 0700)
+		if err != nil {
+			t.Fatalf("Couldn't make directory: %s\n", err)
+		}
+		err = os.WriteFile(full, []byte(data), 0600)
+		if err != nil {
+			t.Fatalf("Couldn't write %s: %s\n", path, err)
+		}
+	}
+	store.Config.ForbiddenMimeTypes = []string{"application/pdf"}
+
+	options := &DirImportOptions{
+		Meta:    FileInsertMeta{Account: DefaultUser, Expire: time.Hour, Tags: []string{"seed"}},
+		DirTags: true,
+	}
+	stats, err := store.ImportDirectory(root, options)
+	if err != nil {
+		t.Fatalf("Couldn't import directory: %s\n", err)
+	}
+	// Walked in lexical order: a.pdf is forbidden, then more/four, photos/again
+	// and photos/one fill up the file limit so two.png is stopped. By the time we
+	// get to top.txt, its data was already uploaded as again.png
+	if stats.Files != 3 || len(stats.Duplicates) != 1 || stats.Duplicates[0] != "top.txt" {
+		t.Fatalf("Unexpected import: %+v\n", stats)
+	}
+	if len(stats.Skipped) != 2 {
+		t.Fatalf("Expected 2 skipped, got %v\n", stats.Skipped)
+	}
+	for _, skip := range stats.Skipped {
+		if skip.Name == filepath.Join("more", "a.pdf") && !errors.Is(skip.Err, ErrForbiddenMime) ||
+			skip.Name == filepath.Join("photos", "trip", "two.png") && !errors.Is(skip.Err, ErrFileCountExceeded) {
+			t.Fatalf("%s skipped for the wrong reason: %s\n", skip.Name, skip.Err)
+		}
+	}
+
+	fids, err := store.SearchFiles(&FileQuery{Tags: []string{"seed", "photos"}}, 0)
+	if err != nil || len(fids) != 2 {
+		t.Fatalf("Expected 2 files tagged seed and photos, got %v (%v)\n", fids, err)
+	}
+	uf, err := store.GetFileById(fids[0])
+	if err != nil {
+		t.Fatalf("Couldn't get file: %s\n", err)
+	}
+	if uf.Name != "one.png" || string(readAllFile(t, store, uf.ID)) != "one" {
+		t.Fatalf("Newest file should be one.png, got %s\n", uf.Name)
+	}
+
+	// Everything left is a duplicate now, or still over the limit
+	stats, err = store.ImportDirectory(root, options)
+	if err != nil {
+		t.Fatalf("Couldn't import directory again: %s\n", err)
+	}
+	if stats.Files != 0 || len(stats.Duplicates) != 4 {
+		t.Fatalf("Expected only duplicates the second time, got %+v\n", stats)
+	}
+
+	// Another account doesn't have any of them yet
+	_, err = store.AddAccount("other", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add other account: %s\n", err)
+	}
+	stats, err = store.ImportDirectory(root, &DirImportOptions{Meta: FileInsertMeta{Account: "other", Expire: time.Hour}})
+	if err != nil {
+		t.Fatalf("Couldn't import directory into other: %s\n", err)
+	}
+	if stats.Files != 4 || len(stats.Duplicates) != 1 {
+		t.Fatalf("Expected other to get its own copies, got %+v\n", stats)
+	}
+
+	_, err = store.ImportDirectory(root, &DirImportOptions{Meta: FileInsertMeta{Account: "nobody", Expire: time.Hour}})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected unknown account to fail, got %v\n", err)
+	}
+}
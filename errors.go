@@ -0,0 +1,45 @@
+package quickfile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the store which callers may want to react to. Most are
+// wrapped with extra detail, so test for them with errors.Is
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrForbidden         = errors.New("not allowed")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrFileCountExceeded = errors.New("too many files")
+	ErrForbiddenMime     = errors.New("mimetype not allowed")
+	ErrUnknownMime       = errors.New("unknown mimetype")
+	ErrBadExpire         = errors.New("invalid expire duration")
+	ErrNameTooLong       = errors.New("filename too long")
+	ErrNoFilename        = errors.New("must provide filename")
+	ErrTooManyTags       = errors.New("too many file tags")
+	ErrUploadOffset      = errors.New("wrong upload offset")
+	ErrUploadLength      = errors.New("upload is the wrong length")
+	ErrDigestMismatch    = errors.New("data doesn't match its digest")
+)
+
+// Which storage limit was hit in a QuotaError
+const (
+	QuotaScopeUser   = "user"
+	QuotaScopeSystem = "system"
+)
+
+// Returned when an upload would go past a storage limit. Matches ErrQuotaExceeded
+// with errors.Is, or use errors.As to find out which limit it was
+type QuotaError struct {
+	Scope     string // Either QuotaScopeUser or QuotaScopeSystem
+	Remaining int64  // How many bytes were available before the upload started
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("out of %s storage (%d bytes remaining)", e.Scope, max(e.Remaining, 0))
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
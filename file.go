@@ -1,20 +1,23 @@
 package quickfile
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"path"
 	"strings"
-	"sync"
 	"time"
 )
 
 const (
 	ChunkSize       = 65536
-	DatabaseVersion = "2"
+	DatabaseVersion = "6"
+	SlugBytes       = 12
 )
 
 type FileInsertMeta struct {
@@ -23,17 +26,25 @@ type FileInsertMeta struct {
 	Expire   time.Duration
 	Account  string
 	Unlisted string
+	Mime     string    // Use this instead of guessing from the extension. Still has to be allowed
+	Created  time.Time // When it was uploaded, if not now (like when importing)
+	Digest   string    // If set, InsertFile fails (leaving nothing behind) unless the data has this sha256
 }
 
 type UploadFile struct {
-	ID      int64
-	Name    string
-	Mime    string
-	Account string
-	Date    time.Time
-	Expire  time.Time
-	Tags    []string
-	Length  int
+	ID          int64
+	Slug        string // Random id for share links, so files can't be found by counting
+	Unlisted    string
+	Name        string
+	Mime        string
+	Account     string
+	Date        time.Time
+	Expire      time.Time
+	Tags        []string
+	Length      int
+	Compression string // How the chunks are stored, nobody reading through a ChunkReader needs to care
+	Digest      string // Hex sha256 of the file data, empty for old files that were never verified
+	Thumbnail   bool   // Whether there's a thumbnail to get with GetThumbnail
 }
 
 func (uf *UploadFile) IsExpired() bool {
@@ -42,52 +53,69 @@ func (uf *UploadFile) IsExpired() bool {
 
 // WARN: This reader assumes each chunk is the same size, up until the last!!
 type ChunkReader struct {
-	Db     *sql.DB
-	Stmt   *sql.Stmt
+	Stmt   *sql.Stmt // Shared with the store, don't close this yourself
 	Buffer []byte
 	Length int64 // Need the length for whence end
 	Offset int64 // This is a read seeker now
 	Fid    int64
+	Ctx    context.Context // Every chunk lookup is bound to this; reads fail once it's done
+	// Chunks are compressed separately and are all ChunkSize uncompressed, so
+	// seeking is no different with compression
+	Compression string
+	closed      bool
 }
 
 // Open a special reader which reads data from the sqlite database
-func openChunkReaderRaw(id int64, config *Config) (*ChunkReader, error) {
-	var err error
-	cr := &ChunkReader{Fid: id}
-	cr.Db, err = config.OpenDb()
-	if err != nil {
-		return nil, err
-	}
-	err = cr.Db.QueryRow("SELECT length FROM meta WHERE fid = ?", id).Scan(&cr.Length)
-	if err != nil {
-		cr.Db.Close()
-		return nil, err
-	}
-	cr.Stmt, err = cr.Db.Prepare("SELECT data FROM chunks WHERE fid = ? ORDER BY cid LIMIT 1 OFFSET ?")
-	if err != nil {
-		cr.Db.Close()
+func (s *Store) openChunkReaderRaw(ctx context.Context, id int64) (*ChunkReader, error) {
+	cr := &ChunkReader{Fid: id, Stmt: s.chunkReadStmt, Ctx: ctx}
+	err := s.fileLengthStmt.QueryRowContext(ctx, id).Scan(&cr.Length, &cr.Compression)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	} else if err != nil {
 		return nil, err
 	}
 	return cr, nil
 }
 
-func OpenChunkReader(id int64, config *Config) (io.ReadSeekCloser, error) {
-	return openChunkReaderRaw(id, config)
+func (s *Store) OpenChunkReader(id int64) (io.ReadSeekCloser, error) {
+	return s.OpenChunkReaderContext(context.Background(), id)
+}
+
+// Same as OpenChunkReader, but the reader stops producing data once the context is done
+func (s *Store) OpenChunkReaderContext(ctx context.Context, id int64) (io.ReadSeekCloser, error) {
+	return s.openChunkReaderRaw(ctx, id)
 }
 
 func (cr *ChunkReader) Read(out []byte) (int, error) {
+	if cr.closed {
+		return 0, fmt.Errorf("reader closed")
+	}
+	// Don't bother continuing a download nobody is listening to
+	if err := cr.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	// The last chunk is usually short, so there's no missing chunk to tell us we're done
+	if cr.Offset >= cr.Length {
+		return 0, io.EOF
+	}
 	// If our buffer is empty, read the next chunk into it from the database
 	if len(cr.Buffer) == 0 {
-		err := cr.Stmt.QueryRow(cr.Fid, cr.Offset/ChunkSize).Scan(&cr.Buffer)
+		// Chunks are numbered, so any offset is a direct index lookup
+		seq := cr.Offset / ChunkSize
+		err := cr.Stmt.QueryRowContext(cr.Ctx, cr.Fid, seq).Scan(&cr.Buffer)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				// Something normal happened. Nothing in the buffer and nothing in the DB
-				return 0, io.EOF
+				// The end was already caught above, so this is a hole in the file
+				return 0, fmt.Errorf("missing chunk %d of file %d", seq, cr.Fid)
 			} else {
 				// Something really unexpected happened
 				return 0, err
 			}
 		}
+		cr.Buffer, err = decompressChunk(cr.Compression, cr.Buffer, int(min(ChunkSize, cr.Length-seq*ChunkSize)))
+		if err != nil {
+			return 0, err
+		}
 		// Need to skip an amount of bytes from the chunk
 		cr.Buffer = cr.Buffer[cr.Offset%ChunkSize:]
 	}
@@ -124,32 +152,70 @@ func (cr *ChunkReader) Seek(offset int64, whence int) (int64, error) {
 	return cr.Offset, nil
 }
 
+// The statement belongs to the store, so there's nothing to actually release
 func (cr *ChunkReader) Close() error {
-	var err1, err2 error
-	if cr.Stmt != nil {
-		err1 = cr.Stmt.Close()
-	} else {
-		err1 = fmt.Errorf("statement not open")
+	if cr.closed {
+		return fmt.Errorf("reader already closed")
 	}
-	if cr.Db != nil {
-		err2 = cr.Db.Close()
-	} else {
-		err2 = fmt.Errorf("dbcon not open")
+	cr.closed = true
+	cr.Buffer = nil
+	return nil
+}
+
+// Reads the chunks exactly as they're stored, one after another
+type rawChunkReader struct {
+	stmt   *sql.Stmt
+	fid    int64
+	seq    int64
+	buffer []byte
+	ctx    context.Context
+}
+
+func (rr *rawChunkReader) Read(out []byte) (int, error) {
+	if err := rr.ctx.Err(); err != nil {
+		return 0, err
 	}
-	if err1 != nil {
-		return err1
+	if len(rr.buffer) == 0 {
+		err := rr.stmt.QueryRowContext(rr.ctx, rr.fid, rr.seq).Scan(&rr.buffer)
+		if err == sql.ErrNoRows {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		rr.seq += 1
 	}
-	return err2
+	copyLen := copy(out, rr.buffer)
+	rr.buffer = rr.buffer[copyLen:]
+	return copyLen, nil
 }
 
-// Create the entire db structure from the given config. Safe to call repeatedly
-func CreateTables(config *Config) error {
-	db, err := config.OpenDb()
-	if err != nil {
-		return err
+// Read the file data as it's stored in the database, without decompressing it.
+// For gzip files this is one complete gzip stream, so it can be sent straight
+// to anything that understands gzip. Uncompressed files come out as normal
+func (s *Store) OpenRawReader(id int64) (io.Reader, error) {
+	return s.OpenRawReaderContext(context.Background(), id)
+}
+
+func (s *Store) OpenRawReaderContext(ctx context.Context, id int64) (io.Reader, error) {
+	var compression string
+	var trailer []byte
+	err := s.db.QueryRowContext(ctx, "SELECT IFNULL(compression, ''), trailer FROM meta WHERE fid = ?", id).Scan(&compression, &trailer)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	chunks := &rawChunkReader{stmt: s.chunkReadStmt, fid: id, ctx: ctx}
+	if compression != CompressionGzip {
+		return chunks, nil
 	}
-	defer db.Close()
+	// The chunks are only the middle of the stream, so they can be shared
+	return io.MultiReader(bytes.NewReader(gzipHeader), chunks, bytes.NewReader(trailer)), nil
+}
 
+// Create the entire db structure. Safe to call repeatedly
+func (s *Store) CreateTables() error {
+	var err error
 	allSql := []string{
 		`CREATE TABLE IF NOT EXISTS meta (
       fid INTEGER PRIMARY KEY,
@@ -160,37 +226,115 @@ func CreateTables(config *Config) error {
       expire DATETIME,
       unlisted TEXT NOT NULL DEFAULT "",
       length INT NOT NULL,
-	  compression TEXT
+	  compression TEXT,
+      slug TEXT,
+      digest TEXT,
+      counted INTEGER NOT NULL DEFAULT 0,
+      trailer BLOB
     );`,
 		`CREATE TABLE IF NOT EXISTS tags (
       tid INTEGER PRIMARY KEY,
       fid INTEGER NOT NULL,
       tag TEXT NOT NULL
     );`,
-		`CREATE TABLE IF NOT EXISTS chunks (
-      cid INTEGER PRIMARY KEY,
-      fid INTEGER NOT NULL,
+		`CREATE TABLE IF NOT EXISTS chunkdata (
+      hash TEXT PRIMARY KEY,
+      refs INTEGER NOT NULL,
       length INTEGER NOT NULL,
+      compression TEXT NOT NULL DEFAULT '',
+      data BLOB NOT NULL
+    );`,
+		`CREATE TABLE IF NOT EXISTS filechunks (
+      fid INTEGER NOT NULL,
+      seq INTEGER NOT NULL,
+      hash TEXT NOT NULL,
+      PRIMARY KEY (fid, seq)
+    );`,
+		`CREATE TABLE IF NOT EXISTS accounts (
+      aid INTEGER PRIMARY KEY,
+      name TEXT NOT NULL UNIQUE,
+      key TEXT NOT NULL UNIQUE,
+      keyid TEXT NOT NULL,
+      uploadlimit INTEGER NOT NULL,
+      filelimit INTEGER NOT NULL,
+      minexpire INTEGER NOT NULL,
+      maxexpire INTEGER NOT NULL,
+      created DATETIME NOT NULL,
+      disabled DATETIME
+    );`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+      token TEXT PRIMARY KEY,
+      aid INTEGER NOT NULL,
+      created DATETIME NOT NULL,
+      expire DATETIME NOT NULL
+    );`,
+		`CREATE TABLE IF NOT EXISTS uploadsessions (
+      usid INTEGER PRIMARY KEY,
+      token TEXT NOT NULL UNIQUE,
+      account TEXT NOT NULL,
+      name TEXT NOT NULL,
+      tags TEXT NOT NULL,
+      expire INT NOT NULL,
+      unlisted TEXT NOT NULL,
+      length INT NOT NULL,
+      received INT NOT NULL DEFAULT 0,
+      created DATETIME NOT NULL,
+      updated DATETIME NOT NULL,
+      fid INT,
+      compression TEXT NOT NULL DEFAULT '',
+      partial BLOB,
+      hashstate BLOB
+    );`,
+		`CREATE TABLE IF NOT EXISTS uploadchunks (
+      usid INTEGER NOT NULL,
+      seq INTEGER NOT NULL,
+      hash TEXT NOT NULL,
+      PRIMARY KEY (usid, seq)
+    );`,
+		`CREATE TABLE IF NOT EXISTS buckets (
+      bid INTEGER PRIMARY KEY,
+      account TEXT NOT NULL,
+      name TEXT NOT NULL,
+      slug TEXT NOT NULL UNIQUE,
+      created DATETIME NOT NULL,
+      UNIQUE (account, name)
+    );`,
+		`CREATE TABLE IF NOT EXISTS thumbnails (
+      fid INTEGER PRIMARY KEY,
+      mime TEXT NOT NULL,
+      width INTEGER NOT NULL,
+      height INTEGER NOT NULL,
       data BLOB NOT NULL
+    );`,
+		`CREATE TABLE IF NOT EXISTS usage (
+      account TEXT PRIMARY KEY,
+      count INTEGER NOT NULL,
+      size INTEGER NOT NULL,
+      physical INTEGER NOT NULL DEFAULT 0
     );`,
 		`CREATE TABLE IF NOT EXISTS sysvalues (
 	  "key" TEXT PRIMARY KEY,
 	  value TEXT
 	);`,
 		`CREATE INDEX IF NOT EXISTS idx_meta_expire_unlisted_account ON meta (expire,unlisted,account)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_meta_slug ON meta (slug)`,
+		`CREATE INDEX IF NOT EXISTS idx_meta_digest ON meta (digest)`,
 		`CREATE INDEX IF NOT EXISTS idx_tags_fid ON tags (fid)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_expire ON sessions (expire)`,
+		`CREATE INDEX IF NOT EXISTS idx_accounts_keyid ON accounts (keyid)`,
 		`CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags (tag)`,
-		`CREATE INDEX IF NOT EXISTS idx_chunks_fid ON chunks (fid)`,
+		`CREATE INDEX IF NOT EXISTS idx_filechunks_hash ON filechunks (hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_uploadsessions_updated ON uploadsessions (updated)`,
 	}
 
 	for _, sql := range allSql {
-		_, err = db.Exec(sql)
+		_, err = s.db.Exec(sql)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err = db.Exec("INSERT OR IGNORE INTO sysvalues VALUES(?,?)", "version", DatabaseVersion)
+	_, err = s.db.Exec("INSERT OR IGNORE INTO sysvalues VALUES(?,?)", "version", DatabaseVersion)
 	if err != nil {
 		return err
 	}
@@ -198,14 +342,9 @@ func CreateTables(config *Config) error {
 	return nil
 }
 
-func VerifyDatabase(config *Config) error {
-	db, err := config.OpenDb()
-	if err != nil {
-		return err
-	}
-	defer db.Close()
+func (s *Store) VerifyDatabase() error {
 	var dbVersion string
-	err = db.QueryRow("SELECT value FROM sysvalues WHERE \"key\" = ?", "version").Scan(&dbVersion)
+	err := s.db.QueryRow("SELECT value FROM sysvalues WHERE \"key\" = ?", "version").Scan(&dbVersion)
 	if err != nil {
 		return err
 	}
@@ -217,64 +356,118 @@ func VerifyDatabase(config *Config) error {
 
 // Statistics on the cleanup
 type CleanupStatistics struct {
-	DeletedFiles  int64
-	DeletedChunks int64
-	DeletedTags   int64
+	DeletedFiles      int64
+	DeletedChunks     int64
+	DeletedTags       int64
+	DeletedSessions   int64
+	DeletedUploads    int64
+	DeletedThumbnails int64
 }
 
 func (cs *CleanupStatistics) Any() bool {
-	return cs.DeletedFiles > 0 || cs.DeletedChunks > 0 || cs.DeletedTags > 0
+	return cs.DeletedFiles > 0 || cs.DeletedChunks > 0 || cs.DeletedTags > 0 || cs.DeletedSessions > 0 ||
+		cs.DeletedUploads > 0 || cs.DeletedThumbnails > 0
 }
 
-var cleanupMutex sync.Mutex
-
 // Remove expired images
-func CleanupExpired(config *Config) (*CleanupStatistics, error) {
-	cleanupMutex.Lock()
-	defer cleanupMutex.Unlock()
+func (s *Store) CleanupExpired() (*CleanupStatistics, error) {
+	return s.CleanupExpiredContext(context.Background())
+}
+
+func (s *Store) CleanupExpiredContext(ctx context.Context) (*CleanupStatistics, error) {
+	s.cleanupMutex.Lock()
+	defer s.cleanupMutex.Unlock()
 
 	var cleanStats CleanupStatistics
+	var err error
+
+	// Delete metadata immediately, this will make images inaccessible on the website
+	// even if the chunks are left
+	cleanStats.DeletedFiles, err = s.deleteExpiredMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := config.OpenDb()
+	// Resumable uploads that were abandoned (or finished a while ago). Their
+	// chunks go along with the rest
+	cleanStats.DeletedUploads, err = s.deleteUploadSessions(ctx, "updated <= ?",
+		time.Now().Add(-s.Config.uploadSessionExpire()))
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
 
-	// Delete metadata immediately, this will make images inaccessible on the website
-	// even if the chunks are left
-	result, err := db.Exec("DELETE FROM meta WHERE expire IS NOT NULL and expire <= ?", time.Now())
+	// Chunks go next, they're big. They can be shared, so only the ones no file
+	// or upload uses anymore actually go away
+	cleanStats.DeletedChunks, err = s.deleteOrphanChunks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// who cares about tags
+	result, err := s.db.ExecContext(ctx, "DELETE FROM tags WHERE fid NOT IN (select fid from meta)")
 	if err != nil {
 		return nil, err
 	}
-	cleanStats.DeletedFiles, err = result.RowsAffected()
+	cleanStats.DeletedTags, err = result.RowsAffected()
 	if err != nil {
-		log.Printf("WARN: Couldn't get number of deleted files: %s\n", err)
+		log.Printf("WARN: Couldn't get number of deleted tags: %s\n", err)
 	}
 
-	// Chunks go next, they're big
-	result, err = db.Exec("DELETE FROM chunks WHERE fid NOT IN (select fid from meta)")
+	// Thumbnails are small, but they'd never go away otherwise
+	result, err = s.db.ExecContext(ctx, "DELETE FROM thumbnails WHERE fid NOT IN (select fid from meta)")
 	if err != nil {
 		return nil, err
 	}
-	cleanStats.DeletedChunks, err = result.RowsAffected()
+	cleanStats.DeletedThumbnails, err = result.RowsAffected()
 	if err != nil {
-		log.Printf("WARN: Couldn't get number of deleted chunks: %s\n", err)
+		log.Printf("WARN: Couldn't get number of deleted thumbnails: %s\n", err)
 	}
 
-	// who cares about tags
-	result, err = db.Exec("DELETE FROM tags WHERE fid NOT IN (select fid from meta)")
+	// The search index has nothing worth counting
+	if s.fullText {
+		_, err = s.db.ExecContext(ctx, "DELETE FROM meta_search WHERE rowid NOT IN (select fid from meta)")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Old logins
+	result, err = s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expire <= ?", time.Now())
 	if err != nil {
 		return nil, err
 	}
-	cleanStats.DeletedTags, err = result.RowsAffected()
+	cleanStats.DeletedSessions, err = result.RowsAffected()
 	if err != nil {
-		log.Printf("WARN: Couldn't get number of deleted tags: %s\n", err)
+		log.Printf("WARN: Couldn't get number of deleted sessions: %s\n", err)
 	}
 
 	return &cleanStats, nil
 }
 
+// Delete the expired files, taking any that are still counted off the usage
+// counters in the same go. Returns how many were deleted
+func (s *Store) deleteExpiredMeta(ctx context.Context) (int64, error) {
+	now := time.Now()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	err = uncountFiles(ctx, tx, "expire IS NOT NULL AND expire <= ?", now)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM meta WHERE expire IS NOT NULL and expire <= ?", now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("WARN: Couldn't get number of deleted files: %s\n", err)
+	}
+	return deleted, tx.Commit()
+}
+
 type VacuumStatistics struct {
 	Vacuumed      bool
 	OldStatistics *FileStatistics
@@ -283,11 +476,17 @@ type VacuumStatistics struct {
 }
 
 // Attempt to vacuum the database (if it's necessary)
-func TryVacuum(config *Config) (*VacuumStatistics, error) {
-	cleanupMutex.Lock()
-	defer cleanupMutex.Unlock()
+func (s *Store) TryVacuum() (*VacuumStatistics, error) {
+	return s.TryVacuumContext(context.Background())
+}
+
+// Cancelling the context interrupts a running vacuum, which sqlite rolls back safely
+func (s *Store) TryVacuumContext(ctx context.Context) (*VacuumStatistics, error) {
+	s.cleanupMutex.Lock()
+	defer s.cleanupMutex.Unlock()
 
 	var err error
+	config := s.Config
 	result := &VacuumStatistics{}
 
 	// Don't vacuum if not set
@@ -300,20 +499,14 @@ func TryVacuum(config *Config) (*VacuumStatistics, error) {
 		return nil, err
 	}
 
-	result.OldStatistics, err = GetFileStatistics("", config)
+	result.OldStatistics, err = s.GetFileStatisticsContext(ctx, "")
 	if err != nil {
 		return nil, err
 	}
 
-	if result.OldSize-result.OldStatistics.TotalSize > config.VacuumThreshold {
-		db, err := config.OpenDb()
-		if err != nil {
-			return nil, err
-		}
-		defer db.Close()
-
+	if result.OldSize-result.OldStatistics.PhysicalSize > config.VacuumThreshold {
 		result.Vacuumed = true
-		_, err = db.Exec("VACUUM")
+		_, err = s.db.ExecContext(ctx, "VACUUM")
 		if err != nil {
 			return nil, err
 		}
@@ -327,13 +520,17 @@ func TryVacuum(config *Config) (*VacuumStatistics, error) {
 }
 
 // Immediately expire the file
-func ExpireFile(id int64, config *Config) error {
-	db, err := config.OpenDb()
+func (s *Store) ExpireFile(id int64) error {
+	return s.ExpireFileContext(context.Background(), id)
+}
+
+func (s *Store) ExpireFileContext(ctx context.Context, id int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-	info, err := db.Exec("UPDATE meta SET expire=created WHERE fid = ?", id)
+	defer tx.Rollback()
+	info, err := tx.ExecContext(ctx, "UPDATE meta SET expire=created WHERE fid = ?", id)
 	if err != nil {
 		return err
 	}
@@ -342,48 +539,79 @@ func ExpireFile(id int64, config *Config) error {
 		return err
 	}
 	if rows == 0 {
-		return fmt.Errorf("not found: %d", id)
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
 	}
-	return nil
+	// Expiring twice only takes it off the counters once
+	err = uncountFiles(ctx, tx, "fid = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Check file upload for everything we possibly can before actually attempting the upload
-func FilePrecheck(meta *FileInsertMeta, config *Config) (string, int64, error) {
+func (s *Store) FilePrecheck(meta *FileInsertMeta) (string, int64, error) {
+	return s.FilePrecheckContext(context.Background(), meta)
+}
+
+func (s *Store) FilePrecheckContext(ctx context.Context, meta *FileInsertMeta) (string, int64, error) {
+	mimeType, _, remaining, err := s.filePrecheck(ctx, meta)
+	return mimeType, remaining, err
+}
+
+// The prechecks, but also gives back the account limits
+func (s *Store) filePrecheck(ctx context.Context, meta *FileInsertMeta) (string, *AccountConfig, int64, error) {
+	config := s.Config
 	// Make sure the account exists
-	acconf, ok := config.Accounts[meta.Account]
-	if !ok {
-		return "", 0, fmt.Errorf("not allowed to upload")
+	account, err := s.GetAccountByNameContext(ctx, meta.Account)
+	if errors.Is(err, ErrNotFound) || (err == nil && account.IsDisabled()) {
+		return "", nil, 0, fmt.Errorf("%w to upload", ErrForbidden)
+	} else if err != nil {
+		return "", nil, 0, err
 	}
+	acconf := &account.Limits
 
 	if len(meta.Tags) > config.MaxFileTags {
-		return "", 0, fmt.Errorf("too many file tags. max: %d", config.MaxFileTags)
+		return "", nil, 0, fmt.Errorf("%w. max: %d", ErrTooManyTags, config.MaxFileTags)
 	}
 
 	if len(meta.Filename) > config.MaxFileName {
-		return "", 0, fmt.Errorf("filename too long! max: %d", config.MaxFileName)
+		return "", nil, 0, fmt.Errorf("%w! max: %d", ErrNameTooLong, config.MaxFileName)
+	}
+
+	// Nobody gets to put files into someone else's bucket. Buckets never change
+	// hands, so there's no need to check again when the file goes in
+	if meta.Unlisted != "" {
+		var owner string
+		err = s.db.QueryRowContext(ctx, "SELECT account FROM buckets WHERE slug = ?", meta.Unlisted).Scan(&owner)
+		if err == nil && owner != meta.Account {
+			return "", nil, 0, fmt.Errorf("%w: not your bucket", ErrForbidden)
+		} else if err != nil && err != sql.ErrNoRows {
+			return "", nil, 0, err
+		}
 	}
 
 	// Go out to the db and check how many files they have. If they're over, die
-	userStats, err := GetFileStatistics(meta.Account, config)
+	userCount, userSize, err := getUsage(ctx, s.db, meta.Account)
 	if err != nil {
-		return "", 0, err
+		return "", nil, 0, err
 	}
-	if userStats.Count >= int64(acconf.FileLimit) {
-		return "", 0, fmt.Errorf("too many files: %d", userStats.Count)
+	if userCount >= int64(acconf.FileLimit) {
+		return "", nil, 0, fmt.Errorf("%w: %d", ErrFileCountExceeded, userCount)
 	}
-	if userStats.TotalSize >= acconf.UploadLimit {
-		return "", 0, fmt.Errorf("over total upload limit: %d", userStats.TotalSize)
+	if userSize >= acconf.UploadLimit {
+		return "", nil, 0, &QuotaError{Scope: QuotaScopeUser, Remaining: acconf.UploadLimit - userSize}
 	}
 
 	// Check some other values for validity
 	if Duration(meta.Expire) < acconf.MinExpire || Duration(meta.Expire) > acconf.MaxExpire {
-		return "", 0, fmt.Errorf("invalid expire duration: %s -> %s",
+		return "", nil, 0, fmt.Errorf("%w: %s -> %s", ErrBadExpire,
 			time.Duration(acconf.MinExpire), time.Duration(acconf.MaxExpire))
 	}
 
 	// Go figure out the mimetype and make sure it's valid (don't actually check the file)
 	if meta.Filename == "" {
-		return "", 0, fmt.Errorf("must provide filename")
+		return "", nil, 0, ErrNoFilename
 	}
 
 	extension := path.Ext(meta.Filename)
@@ -391,103 +619,279 @@ func FilePrecheck(meta *FileInsertMeta, config *Config) (string, int64, error) {
 		extension = ".bin"
 	}
 
-	mimeType := mime.TypeByExtension(extension)
+	mimeType := meta.Mime
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(extension)
+	}
 	mimeBase, mimeExtra := StringUpTo(";", mimeType)
 	mimeRedirect, ok := config.MimeTypeRedirect[strings.Trim(mimeBase, " ")]
 	if ok {
 		mimeType = mimeRedirect + mimeExtra
 	}
 	if mimeType == "" {
-		return "", 0, fmt.Errorf("unknown mimetype")
+		return "", nil, 0, ErrUnknownMime
 	}
 
 	if len(config.AllowedMimeTypes) != 0 {
 		if !anyStartsWith(mimeType, config.AllowedMimeTypes) {
-			return "", 0, fmt.Errorf("mimetype not allowed: %s", mimeType)
+			return "", nil, 0, fmt.Errorf("%w: %s", ErrForbiddenMime, mimeType)
 		}
 	}
 	if anyStartsWith(mimeType, config.ForbiddenMimeTypes) {
-		return "", 0, fmt.Errorf("mimetype not allowed: %s", mimeType)
+		return "", nil, 0, fmt.Errorf("%w: %s", ErrForbiddenMime, mimeType)
 	}
 
-	return mimeType, acconf.UploadLimit - userStats.TotalSize, nil
+	return mimeType, acconf, acconf.UploadLimit - userSize, nil
 }
 
 // Perform the entire operation of inserting a file into the database, including all checks
 // necessary to ensure valid operation
-func InsertFile(meta *FileInsertMeta, file io.Reader, config *Config) (*UploadFile, error) {
+func (s *Store) InsertFile(meta *FileInsertMeta, file io.Reader) (*UploadFile, error) {
+	return s.InsertFileContext(context.Background(), meta, file)
+}
 
-	// Get safe filename, get extension, check mimetype, etc. Also checks
-	// whether you're going to go over the length limit, etc (it does this while
-	// inserting the file so we don't stream the whole file into memory)
-	mimeType, dataRemaining, err := FilePrecheck(meta, config)
+// Same as InsertFile, but the insert is abandoned as soon as the context is done
+// (such as when the uploading client disconnects). The data is stored a chunk at
+// a time, each in its own short transaction, so the write lock is never held
+// while waiting on the reader. The file only shows up once it's all in
+func (s *Store) InsertFileContext(ctx context.Context, meta *FileInsertMeta, file io.Reader) (*UploadFile, error) {
+	mimeType, limits, _, err := s.filePrecheck(ctx, meta)
 	if err != nil {
 		return nil, err
 	}
 
-	// Go see how much space is left for us
-	sysstats, err := GetFileStatistics("", config)
+	// The data waits in an upload session nobody else knows about, so it counts
+	// against the quotas while it's arriving
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	totalRemaining := config.TotalUploadLimit - sysstats.TotalSize
-
-	// Open the database file
-	db, err := config.OpenDb()
+	defer tx.Rollback()
+	us, err := insertUploadSession(ctx, tx, meta, unknownLength, s.Config.CompressionFor(mimeType))
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
 
-	// Get a transaction going
-	tx, err := db.Begin()
+	fid, err := s.insertStagedFile(ctx, us, mimeType, limits, file)
 	if err != nil {
+		// Still clean up if the context is why it failed
+		_, derr := s.deleteUploadSessions(context.WithoutCancel(ctx), "usid = ?", us.usid)
+		if derr != nil {
+			log.Printf("WARN: Couldn't delete staged upload for %s: %s\n", meta.Filename, derr)
+		}
 		return nil, err
 	}
+
+	return s.GetFileByIdContext(ctx, fid)
+}
+
+// Read the whole file into the session, then make it a file and get rid of the
+// session. Returns the new fid
+func (s *Store) insertStagedFile(ctx context.Context, us *UploadSession, mimeType string, limits *AccountConfig, file io.Reader) (int64, error) {
+	chunk := make([]byte, ChunkSize)
+	for seq := int64(0); ; seq++ {
+		// The reader might block for a long time (network), so check for cancellation
+		// before every chunk rather than waiting for the exec to notice
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		length, err := io.ReadFull(file, chunk)
+		stillReading := err == nil
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, err
+		}
+		// Do nothing for 0 length reads
+		if length == 0 {
+			break
+		}
+		err = s.stageChunk(ctx, us, limits, seq, chunk[:length])
+		if err != nil {
+			return 0, err
+		}
+		if !stillReading {
+			break
+		}
+	}
+
+	meta := us.Meta
+	staged := &stagedFile{usid: us.usid, compression: us.compression, hasher: us.hasher}
+	staged.thumbnail = s.makeFileThumbnail(s.openStagedReader(ctx, staged), mimeType, meta.Filename)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	fid, err := s.insertStagedFileTx(ctx, tx, &meta, mimeType, limits, staged)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM uploadsessions WHERE usid = ?", us.usid)
+	if err != nil {
+		return 0, err
+	}
+	return fid, tx.Commit()
+}
+
+// Store the next chunk of a normal upload in the session, as long as it still
+// fits in the quotas (which count everything the session has so far)
+func (s *Store) stageChunk(ctx context.Context, us *UploadSession, limits *AccountConfig, seq int64, chunk []byte) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
 	defer tx.Rollback()
+	quota, err := checkQuota(ctx, tx, s.Config, us.Meta.Account, limits, 0)
+	if err != nil {
+		return err
+	}
+	if quota.User < int64(len(chunk)) {
+		return &QuotaError{Scope: QuotaScopeUser, Remaining: quota.User}
+	}
+	if quota.Total < int64(len(chunk)) {
+		return &QuotaError{Scope: QuotaScopeSystem, Remaining: quota.Total}
+	}
+	err = storeUploadChunk(ctx, tx, us.usid, seq, us.compression, chunk)
+	if err != nil {
+		return err
+	}
+	newOffset := us.Offset + int64(len(chunk))
+	_, err = tx.ExecContext(ctx, "UPDATE uploadsessions SET received = ?, updated = ? WHERE usid = ?",
+		newOffset, time.Now(), us.usid)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	us.Offset = newOffset
+	us.hasher.write(chunk)
+	return nil
+}
+
+// The data for a file that's already stored, held by an upload session until
+// it's made into a file
+type stagedFile struct {
+	usid        int64
+	compression string
+	hasher      *fileHasher
+	thumbnail   *Thumbnail // Made ahead of time, or nil
+}
+
+// Make the staged data into a file within the transaction. Nothing big happens
+// in here, so the write lock isn't held for long. Returns the new fid
+func (s *Store) insertStagedFileTx(ctx context.Context, tx *sql.Tx, meta *FileInsertMeta, mimeType string, limits *AccountConfig, staged *stagedFile) (int64, error) {
+	// The prechecks don't look inside the transaction, so this is the check that
+	// counts. The data was already checked as it came in, but that was then
+	quota, err := checkQuota(ctx, tx, s.Config, meta.Account, limits, staged.usid)
+	if err != nil {
+		return 0, err
+	}
+	if quota.User < staged.hasher.length {
+		return 0, &QuotaError{Scope: QuotaScopeUser, Remaining: quota.User}
+	}
+	if quota.Total < staged.hasher.length {
+		return 0, &QuotaError{Scope: QuotaScopeSystem, Remaining: quota.Total}
+	}
+	if meta.Digest != "" && staged.hasher.digest() != meta.Digest {
+		return 0, fmt.Errorf("%w: expected %s, data is %s", ErrDigestMismatch, meta.Digest, staged.hasher.digest())
+	}
+
+	fid, err := s.insertMetaTx(ctx, tx, meta, mimeType, staged.compression)
+	if err != nil {
+		return 0, err
+	}
 
-	// Insert the main file entry
-	sqlresult, err := tx.Exec(
-		"INSERT INTO meta(name, account, mime, created, expire, length, unlisted) VALUES(?,?,?,?,?,?,?)",
-		meta.Filename, meta.Account, mimeType, time.Now(), time.Now().Add(meta.Expire), 0, meta.Unlisted,
+	// The session's references to the chunks become the file's
+	_, err = tx.ExecContext(ctx, "INSERT INTO filechunks(fid, seq, hash) SELECT ?, seq, hash FROM uploadchunks WHERE usid = ?",
+		fid, staged.usid)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM uploadchunks WHERE usid = ?", staged.usid)
+	if err != nil {
+		return 0, err
+	}
+
+	err = completeFileTx(ctx, tx, fid, meta.Account, staged.compression, staged.hasher)
+	if err != nil {
+		return 0, err
+	}
+
+	if staged.thumbnail != nil {
+		err = insertThumbnail(ctx, tx, fid, staged.thumbnail)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return fid, nil
+}
+
+// Insert the main file entry, its tags and its search index. The length and
+// digest aren't known yet, completeFileTx fills them in. Returns the new fid
+func (s *Store) insertMetaTx(ctx context.Context, tx *sql.Tx, meta *FileInsertMeta, mimeType string, compression string) (int64, error) {
+	slug, err := randomHex(SlugBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	created := meta.Created
+	if created.IsZero() {
+		created = now
+	}
+
+	sqlresult, err := tx.ExecContext(ctx,
+		"INSERT INTO meta(name, account, mime, created, expire, length, unlisted, slug, compression) VALUES(?,?,?,?,?,?,?,?,?)",
+		meta.Filename, meta.Account, mimeType, created, now.Add(meta.Expire), 0, meta.Unlisted, slug, compression,
 	)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	fid, err := sqlresult.LastInsertId()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	// Insert the tags
-	err = insertTags(fid, meta.Tags, tx)
+	err = insertTags(ctx, fid, meta.Tags, tx)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	// Insert the actual data!
-	totalLength, err := insertChunks(fid, file, tx, dataRemaining, totalRemaining)
+	err = s.insertSearchIndex(ctx, tx, fid, meta.Filename, meta.Tags)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return fid, nil
+}
 
-	// Now that we have the real length, update the existing meta
-	_, err = tx.Exec("UPDATE meta SET length = ? WHERE fid = ?", totalLength, fid)
+// Now that we have the real length and digest, update the existing meta and
+// count the file
+func completeFileTx(ctx context.Context, tx *sql.Tx, fid int64, account string, compression string, hasher *fileHasher) error {
+	trailer, err := hasher.trailer(compression)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// We're good now
-	tx.Commit()
-
-	return GetFileById(fid, config)
+	_, err = tx.ExecContext(ctx, "UPDATE meta SET length = ?, digest = ?, trailer = ?, counted = 1 WHERE fid = ?",
+		hasher.length, hasher.digest(), trailer, fid)
+	if err != nil {
+		return err
+	}
+	return addUsage(ctx, tx, account, 1, hasher.length)
 }
 
 // Insert tags for the given fid
-func insertTags(fid int64, tags []string, tx *sql.Tx) error {
+func insertTags(ctx context.Context, fid int64, tags []string, tx *sql.Tx) error {
 	// Insert all the tags (pretty simple)
-	tagInsert, err := tx.Prepare("INSERT INTO tags(fid, tag) VALUES(?,?)")
+	tagInsert, err := tx.PrepareContext(ctx, "INSERT INTO tags(fid, tag) VALUES(?,?)")
 	if err != nil {
 		return err
 	}
@@ -495,53 +899,10 @@ func insertTags(fid int64, tags []string, tx *sql.Tx) error {
 
 	distinctTags := sliceDistinct(tags)
 	for _, tag := range distinctTags {
-		_, err = tagInsert.Exec(fid, tag)
+		_, err = tagInsert.ExecContext(ctx, fid, tag)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
-
-// Insert individual chunks for the given fid
-func insertChunks(fid int64, file io.Reader, tx *sql.Tx, userRemaining int64, totalRemaining int64) (int64, error) {
-	// Now insert the actual file data, one chunk at a time. After each chunk, check the
-	// user's total file size
-	chunk := make([]byte, ChunkSize)
-	stillReading := true
-	chunkInsert, err := tx.Prepare("INSERT INTO chunks(fid, length, data) VALUES(?,?,?)")
-	if err != nil {
-		return 0, err
-	}
-	defer chunkInsert.Close()
-
-	totalLength := int64(0)
-
-	for stillReading {
-		length, err := io.ReadFull(file, chunk)
-		if err != nil {
-			if err == io.ErrUnexpectedEOF || err == io.EOF {
-				chunk = chunk[:length]
-				stillReading = false
-			} else {
-				return 0, err
-			}
-		}
-		// Do nothing for 0 length reads
-		if length == 0 {
-			continue
-		}
-		totalLength += int64(length)
-		if userRemaining-totalLength < 0 {
-			return 0, fmt.Errorf("out of user storage")
-		}
-		if totalRemaining-totalLength < 0 {
-			return 0, fmt.Errorf("out of system storage")
-		}
-		_, err = chunkInsert.Exec(fid, length, chunk)
-		if err != nil {
-			return 0, err
-		}
-	}
-	return totalLength, nil
-}
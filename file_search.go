@@ -1,51 +1,38 @@
 package quickfile
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 )
 
 type FileStatistics struct {
-	TotalSize int64
-	Count     int64
+	TotalSize    int64 // Size of all the files as uploaded. This is what quotas count
+	Count        int64
+	PhysicalSize int64 // Space the chunks actually take, after compression and deduplication. Only in the global statistics
 }
 
 // Retrieve file statistics for a given user. If no user is given, the global
-// file statistics will be given
-func GetFileStatistics(user string, config *Config) (*FileStatistics, error) {
-	db, err := config.OpenDb()
+// file statistics will be given. The count and size come from the usage
+// counters, so files that expired since the last cleanup are still in them.
+// The global physical size is everything stored, a user's is every unique
+// chunk their files use (which may be shared)
+func (s *Store) GetFileStatistics(user string) (*FileStatistics, error) {
+	return s.GetFileStatisticsContext(context.Background(), user)
+}
+
+func (s *Store) GetFileStatisticsContext(ctx context.Context, user string) (*FileStatistics, error) {
+	var err error
+	var result FileStatistics
+	result.Count, result.TotalSize, err = getUsage(ctx, s.db, user)
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
-	var result FileStatistics
 	if user == "" {
-		err = db.QueryRow(
-			"SELECT COUNT(*) FROM meta WHERE (expire IS NULL OR expire > ?)",
-			time.Now(),
-		).Scan(&result.Count)
-		if err != nil {
-			return nil, err
-		}
-		err = db.QueryRow(
-			"SELECT IFNULL(SUM(length), 0) FROM meta WHERE (expire IS NULL OR expire > ?)",
-			time.Now(),
-		).Scan(&result.TotalSize)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		err = db.QueryRow(
-			"SELECT COUNT(*) FROM meta WHERE account = ? AND (expire IS NULL OR expire > ?)",
-			user, time.Now(),
-		).Scan(&result.Count)
-		if err != nil {
-			return nil, err
-		}
-		err = db.QueryRow(
-			"SELECT IFNULL(SUM(length), 0) FROM meta WHERE account = ? AND (expire IS NULL OR expire > ?)",
-			user, time.Now(),
-		).Scan(&result.TotalSize)
+		result.PhysicalSize, err = getPhysicalSize(ctx, s.db)
 		if err != nil {
 			return nil, err
 		}
@@ -53,20 +40,38 @@ func GetFileStatistics(user string, config *Config) (*FileStatistics, error) {
 	return &result, nil
 }
 
+// Space the account's files take after compression and deduplication. Chunks
+// shared with other accounts count in full. This adds up every chunk the
+// account uses, so only ask when it's actually going to be shown
+func (s *Store) GetAccountPhysicalSize(account string) (int64, error) {
+	return s.GetAccountPhysicalSizeContext(context.Background(), account)
+}
+
+func (s *Store) GetAccountPhysicalSizeContext(ctx context.Context, account string) (int64, error) {
+	var size int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT IFNULL(SUM(length), 0) FROM chunkdata WHERE hash IN
+		 (SELECT f.hash FROM filechunks f JOIN meta m ON m.fid = f.fid
+		  WHERE m.account = ? AND m.counted = 1 AND m.expire > ?)`,
+		account, time.Now(),
+	).Scan(&size)
+	return size, err
+}
+
 // Lookup a set of files by id. Get all information about them.
-func GetFilesById(ids []int64, config *Config) (map[int64]*UploadFile, error) {
-	db, err := config.OpenDb()
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
+func (s *Store) GetFilesById(ids []int64) (map[int64]*UploadFile, error) {
+	return s.GetFilesByIdContext(context.Background(), ids)
+}
+
+func (s *Store) GetFilesByIdContext(ctx context.Context, ids []int64) (map[int64]*UploadFile, error) {
 	result := make(map[int64]*UploadFile)
 
 	placeholder := sliceToPlaceholder(ids)
 	anyIds := sliceToAny(ids)
 
 	// Go get the main data
-	rows, err := db.Query(fmt.Sprintf("SELECT fid,name,account,mime,created,expire,length FROM meta WHERE fid IN (%s)", placeholder), anyIds...)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT fid,slug,unlisted,name,account,mime,created,expire,length,IFNULL(compression,''),IFNULL(digest,''),
+		 EXISTS(SELECT 1 FROM thumbnails t WHERE t.fid = meta.fid) FROM meta WHERE fid IN (%s)`, placeholder), anyIds...)
 	if err != nil {
 		return nil, err
 	}
@@ -76,15 +81,15 @@ func GetFilesById(ids []int64, config *Config) (map[int64]*UploadFile, error) {
 		thisFile := UploadFile{
 			Tags: make([]string, 0, 5),
 		}
-		err := rows.Scan(&thisFile.ID, &thisFile.Name, &thisFile.Account, &thisFile.Mime,
-			&thisFile.Date, &thisFile.Expire, &thisFile.Length)
+		err := rows.Scan(&thisFile.ID, &thisFile.Slug, &thisFile.Unlisted, &thisFile.Name, &thisFile.Account, &thisFile.Mime,
+			&thisFile.Date, &thisFile.Expire, &thisFile.Length, &thisFile.Compression, &thisFile.Digest, &thisFile.Thumbnail)
 		if err != nil {
 			return nil, err
 		}
 		result[thisFile.ID] = &thisFile
 	}
 
-	rows, err = db.Query(fmt.Sprintf("SELECT fid,tag FROM tags WHERE fid IN (%s)", placeholder), anyIds...)
+	rows, err = s.db.QueryContext(ctx, fmt.Sprintf("SELECT fid,tag FROM tags WHERE fid IN (%s)", placeholder), anyIds...)
 	if err != nil {
 		return nil, err
 	}
@@ -104,41 +109,195 @@ func GetFilesById(ids []int64, config *Config) (map[int64]*UploadFile, error) {
 }
 
 // Get a single file by id
-func GetFileById(id int64, config *Config) (*UploadFile, error) {
-	results, err := GetFilesById([]int64{id}, config)
+func (s *Store) GetFileById(id int64) (*UploadFile, error) {
+	return s.GetFileByIdContext(context.Background(), id)
+}
+
+func (s *Store) GetFileByIdContext(ctx context.Context, id int64) (*UploadFile, error) {
+	results, err := s.GetFilesByIdContext(ctx, []int64{id})
 	if err != nil {
 		return nil, err
 	}
 	result, ok := results[id]
 	if !ok {
-		return nil, fmt.Errorf("not found: %d", id)
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
 	}
 	return result, nil
 }
 
-// Return file ids ordered by newest first
-func GetPaginatedFiles(page int, config *Config, unlisted string, account string) ([]int64, error) {
-	perpage := config.ResultsPerPage
-	skip := perpage * page
-	db, err := config.OpenDb()
-	if err != nil {
+// Get a single file by the random slug from its share link
+func (s *Store) GetFileBySlug(slug string) (*UploadFile, error) {
+	return s.GetFileBySlugContext(context.Background(), slug)
+}
+
+func (s *Store) GetFileBySlugContext(ctx context.Context, slug string) (*UploadFile, error) {
+	var fid int64
+	err := s.db.QueryRowContext(ctx, "SELECT fid FROM meta WHERE slug = ?", slug).Scan(&fid)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, slug)
+	} else if err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	return s.GetFileByIdContext(ctx, fid)
+}
 
-	result := make([]int64, 0, perpage)
+// Get the account's newest unexpired file with exactly this data (by its sha256
+// digest). An empty account looks through everyone's files
+func (s *Store) GetFileByDigest(digest string, account string) (*UploadFile, error) {
+	return s.GetFileByDigestContext(context.Background(), digest, account)
+}
+
+func (s *Store) GetFileByDigestContext(ctx context.Context, digest string, account string) (*UploadFile, error) {
+	var fid int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT fid FROM meta WHERE digest = ? AND (? = '' OR account = ?) AND (expire IS NULL OR expire > ?)
+		 ORDER BY fid DESC LIMIT 1`,
+		digest, account, account, time.Now()).Scan(&fid)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: digest %s", ErrNotFound, digest)
+	} else if err != nil {
+		return nil, err
+	}
+	return s.GetFileByIdContext(ctx, fid)
+}
 
-	// Setup params and where and stuff
-	params := make([]any, 0)
-	extraWhere := ""
-	if account != "" {
-		params = append(params, account)
-		extraWhere = "account=? AND"
+// Return file ids ordered by newest first
+func (s *Store) GetPaginatedFiles(page int, unlisted string, account string) ([]int64, error) {
+	return s.GetPaginatedFilesContext(context.Background(), page, unlisted, account)
+}
+
+func (s *Store) GetPaginatedFilesContext(ctx context.Context, page int, unlisted string, account string) ([]int64, error) {
+	return s.SearchFilesContext(ctx, &FileQuery{Unlisted: unlisted, Account: account}, page)
+}
+
+// What to look for in SearchFiles. Unlisted is always matched exactly (empty
+// for public files), every other empty field matches everything
+type FileQuery struct {
+	Unlisted   string
+	Account    string
+	Tags       []string
+	AnyTag     bool   // Match files with any of the tags rather than all of them
+	Text       string // Words to find in the name or tags. Quote for phrases, end a word in * for prefixes
+	MimePrefix string // Like "image/"
+	MinSize    int64
+	MaxSize    int64
+	After      time.Time // Uploaded at or after this
+	Before     time.Time // Uploaded before this
+}
+
+// One word or quoted phrase from the search text
+type searchTerm struct {
+	text   string
+	prefix bool
+}
+
+// Split search text into words and "quoted phrases". Words ending in * are
+// prefixes. Quotes that aren't closed just run to the end
+func parseSearchText(text string) []searchTerm {
+	result := make([]searchTerm, 0)
+	for {
+		text = strings.TrimLeft(text, " \t")
+		if text == "" {
+			return result
+		}
+		var term searchTerm
+		if text[0] == '"' {
+			phrase, rest, _ := strings.Cut(text[1:], "\"")
+			term.text, text = phrase, rest
+		} else {
+			word, rest, _ := strings.Cut(text, " ")
+			term.text, text = word, rest
+			term.text, term.prefix = strings.CutSuffix(term.text, "*")
+		}
+		term.text = strings.Trim(term.text, " \t*")
+		if term.text != "" {
+			result = append(result, term)
+		}
+	}
+}
+
+// The terms as an fts5 match expression. Every term is quoted so nothing the
+// user types gets treated as fts syntax
+func ftsMatch(terms []searchTerm) string {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		part := "\"" + strings.ReplaceAll(term.text, "\"", "\"\"") + "\""
+		if term.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Build the where clause (without WHERE) and params for the query. Expired files
+// never match. Without full text search, the text is matched against the name only
+func (q *FileQuery) where(fullText bool) (string, []any) {
+	clauses := []string{"unlisted = ?", "(expire IS NULL OR expire > ?)"}
+	params := []any{q.Unlisted, time.Now()}
+	if q.Account != "" {
+		clauses = append(clauses, "account = ?")
+		params = append(params, q.Account)
+	}
+	if terms := parseSearchText(q.Text); len(terms) > 0 {
+		if fullText {
+			clauses = append(clauses, "fid IN (SELECT rowid FROM meta_search WHERE meta_search MATCH ?)")
+			params = append(params, ftsMatch(terms))
+		} else {
+			for _, term := range terms {
+				clauses = append(clauses, "instr(lower(name), lower(?)) > 0")
+				params = append(params, term.text)
+			}
+		}
+	}
+	if q.MimePrefix != "" {
+		clauses = append(clauses, "substr(mime, 1, ?) = ?")
+		params = append(params, len(q.MimePrefix), q.MimePrefix)
 	}
-	params = append(params, unlisted, time.Now(), perpage, skip)
+	if q.MinSize > 0 {
+		clauses = append(clauses, "length >= ?")
+		params = append(params, q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		clauses = append(clauses, "length <= ?")
+		params = append(params, q.MaxSize)
+	}
+	if !q.After.IsZero() {
+		clauses = append(clauses, "created >= ?")
+		params = append(params, q.After)
+	}
+	if !q.Before.IsZero() {
+		clauses = append(clauses, "created < ?")
+		params = append(params, q.Before)
+	}
+	tags := sliceDistinct(q.Tags)
+	if len(tags) > 0 {
+		tagClause := fmt.Sprintf("fid IN (SELECT fid FROM tags WHERE tag IN (%s)", sliceToPlaceholder(tags))
+		params = append(params, sliceToAny(tags)...)
+		if !q.AnyTag && len(tags) > 1 {
+			tagClause += " GROUP BY fid HAVING COUNT(DISTINCT tag) = ?"
+			params = append(params, len(tags))
+		}
+		clauses = append(clauses, tagClause+")")
+	}
+	return strings.Join(clauses, " AND "), params
+}
 
-	rows, err := db.Query(
-		fmt.Sprintf("SELECT fid FROM meta WHERE %s unlisted=? AND (expire IS NULL OR expire > ?) ORDER BY fid DESC LIMIT ? OFFSET ?", extraWhere),
+// Return one page of file ids matching the query, newest first
+func (s *Store) SearchFiles(query *FileQuery, page int) ([]int64, error) {
+	return s.SearchFilesContext(context.Background(), query, page)
+}
+
+func (s *Store) SearchFilesContext(ctx context.Context, query *FileQuery, page int) ([]int64, error) {
+	perpage := s.Config.ResultsPerPage
+	skip := perpage * page
+
+	result := make([]int64, 0, perpage)
+	where, params := query.where(s.fullText)
+	params = append(params, perpage, skip)
+
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT fid FROM meta WHERE %s ORDER BY fid DESC LIMIT ? OFFSET ?", where),
 		params...,
 	)
 	if err != nil {
@@ -157,3 +316,115 @@ func GetPaginatedFiles(page int, config *Config, unlisted string, account string
 
 	return result, nil
 }
+
+// Total amount of files matching the query, for figuring out pages
+func (s *Store) CountFiles(query *FileQuery) (int64, error) {
+	return s.CountFilesContext(context.Background(), query)
+}
+
+func (s *Store) CountFilesContext(ctx context.Context, query *FileQuery) (int64, error) {
+	var count int64
+	where, params := query.where(s.fullText)
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM meta WHERE %s", where), params...).Scan(&count)
+	return count, err
+}
+
+type TagCount struct {
+	Tag   string
+	Count int64
+}
+
+// The most used tags on public, unexpired files, most used first. Tags on
+// unlisted files are left out so they don't give anything away
+func (s *Store) GetTagCounts(limit int) ([]TagCount, error) {
+	return s.GetTagCountsContext(context.Background(), limit)
+}
+
+func (s *Store) GetTagCountsContext(ctx context.Context, limit int) ([]TagCount, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT t.tag, COUNT(*) AS c FROM tags t JOIN meta m ON m.fid = t.fid
+		 WHERE m.unlisted = '' AND (m.expire IS NULL OR m.expire > ?)
+		 GROUP BY t.tag ORDER BY c DESC, t.tag LIMIT ?`,
+		time.Now(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]TagCount, 0, limit)
+	for rows.Next() {
+		var tc TagCount
+		err := rows.Scan(&tc.Tag, &tc.Count)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, tc)
+	}
+
+	return result, rows.Err()
+}
+
+// Whether the sqlite we were built with has fts5 (build with -tags sqlite_fts5).
+// Without it, text searches fall back to plain substring matching on the name
+func (s *Store) HasFullText() bool {
+	return s.fullText
+}
+
+// Set up the full text index on names and tags if this sqlite supports it.
+// The index is filled in whenever it doesn't cover exactly the files we have,
+// which happens on first creation or if a build without fts5 touched the database
+func (s *Store) createSearchIndex() error {
+	var used int
+	err := s.db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used)
+	if err != nil {
+		return err
+	}
+	s.fullText = used == 1
+	if !s.fullText {
+		log.Printf("WARN: sqlite built without fts5, file search will be slow and limited\n")
+		return nil
+	}
+	_, err = s.db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS meta_search USING fts5(name, tags)")
+	if err != nil {
+		return err
+	}
+	var files, indexed int64
+	err = s.db.QueryRow("SELECT COUNT(*) FROM meta").Scan(&files)
+	if err != nil {
+		return err
+	}
+	err = s.db.QueryRow("SELECT COUNT(*) FROM meta_search").Scan(&indexed)
+	if err != nil {
+		return err
+	}
+	if files == indexed {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM meta_search")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO meta_search(rowid, name, tags)
+		SELECT fid, name, IFNULL((SELECT group_concat(tag, ' ') FROM tags WHERE tags.fid = meta.fid), '') FROM meta`)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilt search index for %d files\n", files)
+	return tx.Commit()
+}
+
+// Add a newly inserted file to the search index, if there is one
+func (s *Store) insertSearchIndex(ctx context.Context, tx *sql.Tx, fid int64, name string, tags []string) error {
+	if !s.fullText {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO meta_search(rowid, name, tags) VALUES(?,?,?)",
+		fid, name, strings.Join(sliceDistinct(tags), " "))
+	return err
+}
@@ -0,0 +1,49 @@
+//go:build sqlite_fts5
+
+package quickfile
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Only built with the sqlite_fts5 tag (make test), so the index is checked for real
+func TestSearchIndex(t *testing.T) {
+	store := createTables(t, "searchindex")
+	if !store.HasFullText() {
+		t.Fatalf("Built with sqlite_fts5 but the store has no full text search\n")
+	}
+	meta := workingMeta()
+	meta.Filename = "tagged.txt"
+	meta.Tags = []string{"findme"}
+	uf, err := store.InsertFile(&meta, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("Couldn't insert: %s\n", err)
+	}
+	check := func(text string, expected ...int64) {
+		fids, err := store.SearchFiles(&FileQuery{Text: text}, 0)
+		if err != nil {
+			t.Fatalf("Couldn't search %s: %s\n", text, err)
+		}
+		if fmt.Sprint(fids) != fmt.Sprint(expected) {
+			t.Fatalf("Search %s expected %v, got %v\n", text, expected, fids)
+		}
+	}
+	check("findme", uf.ID)
+	check("find*", uf.ID)
+
+	// An index that doesn't match the files is rebuilt when the store opens
+	_, err = store.db.Exec("DELETE FROM meta_search")
+	if err != nil {
+		t.Fatalf("Couldn't clear index: %s\n", err)
+	}
+	check("findme")
+	store.Close()
+	store, err = OpenStore(store.Config)
+	if err != nil {
+		t.Fatalf("Couldn't reopen store: %s\n", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	check("findme", uf.ID)
+}
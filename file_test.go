@@ -2,12 +2,17 @@ package quickfile
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -22,26 +27,43 @@ func uniqueFile(prefix, extension string) string {
 
 const DefaultUser = "testuser"
 
-func createTables(t *testing.T, name string) *Config {
+func createTables(t testing.TB, name string) *Store {
 	config_raw := GetDefaultConfig_Toml()
 	var config Config
 	err := toml.Unmarshal([]byte(config_raw), &config) //GetDefaultConfig()
 	if err != nil {
 		t.Fatalf("Couldn't parse config toml: %s\n", err)
 	}
-	config.Accounts[DefaultUser] = nil
 	config.ApplyDefaults()
 	config.Datapath = uniqueFile(name, ".db")
-	err = CreateTables(&config)
+	store, err := OpenStore(&config)
 	if err != nil {
-		t.Fatalf("Couldn't create tables: %s\n", err)
+		t.Fatalf("Couldn't open store: %s\n", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	_, err = store.AddAccount(DefaultUser, nil)
+	if err != nil {
+		t.Fatalf("Couldn't add default user: %s\n", err)
+	}
+	return store
+}
+
+// Change the limits on an existing account
+func setLimits(t testing.TB, store *Store, name string, modify func(*AccountConfig)) {
+	account, err := store.GetAccountByName(name)
+	if err != nil {
+		t.Fatalf("Couldn't get account %s: %s\n", name, err)
+	}
+	modify(&account.Limits)
+	err = store.SetAccountLimits(name, &account.Limits)
+	if err != nil {
+		t.Fatalf("Couldn't set limits for %s: %s\n", name, err)
 	}
-	return &config
 }
 
 func TestEmptyFind(t *testing.T) {
-	config := createTables(t, "emptyfind")
-	result, err := GetFilesById([]int64{1, 2, 3}, config)
+	store := createTables(t, "emptyfind")
+	result, err := store.GetFilesById([]int64{1, 2, 3})
 	if err != nil {
 		t.Fatalf("Couldn't do an empty search: %s\n", err)
 	}
@@ -66,30 +88,30 @@ func randomizeArray(arr []byte) {
 }
 
 func TestVariousPrechecks(t *testing.T) {
-	config := createTables(t, "prechecks")
+	store := createTables(t, "prechecks")
 	meta := workingMeta()
 	// First, need to make sure a normal precheck passes
-	mime, left, err := FilePrecheck(&meta, config)
+	mime, left, err := store.FilePrecheck(&meta)
 	if err != nil {
 		t.Fatalf("Default meta was supposed to work: %s\n", err)
 	}
 	if mime != "image/png" {
 		t.Fatalf("Expected mime to be image/png, was %s\n", mime)
 	}
-	if left < config.DefaultUploadLimit {
-		t.Fatalf("Expected to have %d space left, got %d\n", config.DefaultUploadLimit, left)
+	if left < store.Config.DefaultUploadLimit {
+		t.Fatalf("Expected to have %d space left, got %d\n", store.Config.DefaultUploadLimit, left)
 	}
 	// Now all the weird failures
 	meta = workingMeta()
 	meta.Account = "notauser"
-	mime, left, err = FilePrecheck(&meta, config)
-	if err == nil {
-		t.Fatalf("Should've failed because no user found!")
+	mime, left, err = store.FilePrecheck(&meta)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Should've failed because no user found, got %v", err)
 	}
 	log.Printf("Expected error no user: %s\n", err)
 	meta = workingMeta()
 	meta.Filename = "whatever"
-	mime, left, err = FilePrecheck(&meta, config)
+	mime, left, err = store.FilePrecheck(&meta)
    if err != nil {
 		t.Fatalf("Expected no error on no extension, got %s", err)
    }
@@ -99,14 +121,14 @@ func TestVariousPrechecks(t *testing.T) {
 	//log.Printf("Expected error no extension: %s\n", err)
 	meta = workingMeta()
 	meta.Expire = time.Millisecond
-	mime, left, err = FilePrecheck(&meta, config)
-	if err == nil {
-		t.Fatalf("Should've failed because too short expire!")
+	mime, left, err = store.FilePrecheck(&meta)
+	if !errors.Is(err, ErrBadExpire) {
+		t.Fatalf("Should've failed because too short expire, got %v", err)
 	}
 	log.Printf("Expected error expire: %s\n", err)
 	meta = workingMeta()
 	meta.Filename = "thing.css"
-	mime, _, err = FilePrecheck(&meta, config)
+	mime, _, err = store.FilePrecheck(&meta)
 	if err != nil {
 		t.Fatalf("Error: %s", err)
 	}
@@ -115,7 +137,7 @@ func TestVariousPrechecks(t *testing.T) {
 	}
 	meta = workingMeta()
 	meta.Filename = "thing.html" //This should convert to plain
-	mime, _, err = FilePrecheck(&meta, config)
+	mime, _, err = store.FilePrecheck(&meta)
 	if err != nil {
 		t.Fatalf("Error: %s", err)
 	}
@@ -125,11 +147,11 @@ func TestVariousPrechecks(t *testing.T) {
 }
 
 func TestLive(t *testing.T) {
-	config := createTables(t, "live")
+	store := createTables(t, "live")
 	meta := workingMeta()
 	expectedData := []byte("Not exactly a png")
 	file := bytes.NewBuffer(expectedData)
-	result, err := InsertFile(&meta, file, config)
+	result, err := store.InsertFile(&meta, file)
 	if err != nil {
 		t.Fatalf("Failed to insert file: %s", err)
 	}
@@ -148,8 +170,22 @@ func TestLive(t *testing.T) {
 	if result.ID <= 0 {
 		t.Fatalf("Needed a nonzero id, got %d\n", result.ID)
 	}
+	if len(result.Slug) != SlugBytes*2 {
+		t.Fatalf("Expected a random slug, got '%s'\n", result.Slug)
+	}
+	bySlug, err := store.GetFileBySlug(result.Slug)
+	if err != nil {
+		t.Fatalf("Couldn't look up by slug: %s\n", err)
+	}
+	if bySlug.ID != result.ID {
+		t.Fatalf("Slug lookup found the wrong file: %d vs %d\n", bySlug.ID, result.ID)
+	}
+	_, err = store.GetFileBySlug("notaslug")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found for bad slug, got %v\n", err)
+	}
 	// Now we spawn a reader and see if the data we pull is the same
-	reader, err := OpenChunkReader(result.ID, config)
+	reader, err := store.OpenChunkReader(result.ID)
 	if err != nil {
 		t.Fatalf("Failed to open chunk reader: %s\n", err)
 	}
@@ -176,7 +212,7 @@ func TestLive(t *testing.T) {
 		meta.Tags = append(meta.Tags, fmt.Sprintf("extra:%d", l))
 		meta.Unlisted = fmt.Sprintf("bucket_%d", l)
 		file = bytes.NewBuffer(expectedData)
-		result, err = InsertFile(&meta, file, config)
+		result, err = store.InsertFile(&meta, file)
 		if err != nil {
 			t.Fatalf("Failed to insert %s: %s", meta.Filename, err)
 		}
@@ -187,7 +223,7 @@ func TestLive(t *testing.T) {
 			t.Fatalf("Tag amount doesn't match for %s: %d vs %d\n", meta.Filename, len(result.Tags), len(meta.Tags))
 		}
 		// Now we do the reader stuff... again
-		reader, err := OpenChunkReader(result.ID, config)
+		reader, err := store.OpenChunkReader(result.ID)
 		if err != nil {
 			t.Fatalf("Failed to open chunk reader for %s: %s\n", meta.Filename, err)
 		}
@@ -210,9 +246,9 @@ func TestCleanup(t *testing.T) {
 
 	const NUMCHUNKS = 100
 
-	config := createTables(t, "cleanup")
+	store := createTables(t, "cleanup")
 	meta := workingMeta()
-	config.Accounts[meta.Account].MinExpire = Duration(0)
+	setLimits(t, store, meta.Account, func(l *AccountConfig) { l.MinExpire = 0 })
 	expectedData := make([]byte, ChunkSize*NUMCHUNKS)
 
 	var err error
@@ -222,7 +258,7 @@ func TestCleanup(t *testing.T) {
 	meta.Filename = fmt.Sprintf("file_0.zip")
 	meta.Expire = 0
 	file0 := bytes.NewBuffer(expectedData)
-	_, err = InsertFile(&meta, file0, config)
+	_, err = store.InsertFile(&meta, file0)
 	if err != nil {
 		t.Fatalf("Couldn't insert file 0: %s\n", err)
 	}
@@ -231,13 +267,13 @@ func TestCleanup(t *testing.T) {
 	meta.Filename = fmt.Sprintf("file_1.zip")
 	meta.Expire = 5 * time.Minute
 	file1 := bytes.NewBuffer(expectedData)
-	result1, err := InsertFile(&meta, file1, config)
+	result1, err := store.InsertFile(&meta, file1)
 	if err != nil {
 		t.Fatalf("Couldn't insert file 1: %s\n", err)
 	}
 
 	// Ensure only the one is there
-	fids, err := GetPaginatedFiles(0, config, "", "")
+	fids, err := store.GetPaginatedFiles(0, "", "")
 	if err != nil {
 		t.Fatalf("Couldn't get file ids: %s\n", err)
 	}
@@ -245,7 +281,7 @@ func TestCleanup(t *testing.T) {
 		t.Fatalf("Expected 1 files after insert, got %d\n", len(fids))
 	}
 
-	files, err := GetFilesById(fids, config)
+	files, err := store.GetFilesById(fids)
 	if err != nil {
 		t.Fatalf("Couldn't get files: %s\n", err)
 	}
@@ -260,7 +296,7 @@ func TestCleanup(t *testing.T) {
 	}
 
 	// Delete expired (only the second one)
-	stats, err := CleanupExpired(config)
+	stats, err := store.CleanupExpired()
 	if err != nil {
 		t.Fatalf("Couldn't cleanup: %s\n", err)
 	}
@@ -275,7 +311,7 @@ func TestCleanup(t *testing.T) {
 		t.Fatalf("Expected %d deleted chunks, got %d\n", NUMCHUNKS, stats.DeletedChunks)
 	}
 
-	fids, err = GetPaginatedFiles(0, config, "", "")
+	fids, err = store.GetPaginatedFiles(0, "", "")
 	if err != nil {
 		t.Fatalf("Couldn't get file ids: %s\n", err)
 	}
@@ -287,8 +323,8 @@ func TestCleanup(t *testing.T) {
 	}
 
 	// Vacuum without threshold (no vacuum)
-	config.VacuumThreshold = 0
-	vstats, err := TryVacuum(config)
+	store.Config.VacuumThreshold = 0
+	vstats, err := store.TryVacuum()
 	if err != nil {
 		t.Fatalf("Couldn't vacuum none: %s\n", err)
 	}
@@ -297,8 +333,8 @@ func TestCleanup(t *testing.T) {
 	}
 
 	// Vacuum with threshold (WAY lower than the amount we deleted)
-	config.VacuumThreshold = ChunkSize
-	vstats, err = TryVacuum(config)
+	store.Config.VacuumThreshold = ChunkSize
+	vstats, err = store.TryVacuum()
 	if err != nil {
 		t.Fatalf("Couldn't vacuum real: %s\n", err)
 	}
@@ -313,7 +349,7 @@ func TestCleanup(t *testing.T) {
 	}
 
 	// Since we're here, let's also test the seeking capabilities
-	reader, err := openChunkReaderRaw(result1.ID, config)
+	reader, err := store.openChunkReaderRaw(context.Background(), result1.ID)
 	if err != nil {
 		t.Fatalf("Couldn't open the chunk reader: %s\n", err)
 	}
@@ -360,14 +396,148 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+func TestQuota(t *testing.T) {
+	store := createTables(t, "quota")
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.UploadLimit = ChunkSize * 2 })
+	meta := workingMeta()
+	data := make([]byte, ChunkSize*3)
+	_, err := store.InsertFile(&meta, bytes.NewReader(data))
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		t.Fatalf("Expected quota error, got %v\n", err)
+	}
+	if quotaErr.Scope != QuotaScopeUser {
+		t.Fatalf("Expected user quota scope, got %s\n", quotaErr.Scope)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Quota error should match ErrQuotaExceeded\n")
+	}
+	_, err = store.GetFileById(1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Failed insert should leave nothing behind, got %v\n", err)
+	}
+	err = store.ExpireFile(1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found on expire, got %v\n", err)
+	}
+	var sessions, chunks int
+	err = store.db.QueryRow("SELECT (SELECT COUNT(*) FROM uploadsessions), (SELECT COUNT(*) FROM uploadchunks)").Scan(&sessions, &chunks)
+	if err != nil || sessions != 0 || chunks != 0 {
+		t.Fatalf("Expected no staged data left, got %d sessions and %d chunks: %v\n", sessions, chunks, err)
+	}
+}
+
+func TestInsertDigest(t *testing.T) {
+	store := createTables(t, "insertdigest")
+	meta := workingMeta()
+	data := make([]byte, ChunkSize+10)
+	randomizeArray(data)
+	meta.Digest = strings.Repeat("0", 64)
+	_, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch, got %v\n", err)
+	}
+	checkUsage(t, store, DefaultUser, 0, 0)
+	sum := sha256.Sum256(data)
+	meta.Digest = hex.EncodeToString(sum[:])
+	uf, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if err != nil || uf.Digest != meta.Digest {
+		t.Fatalf("Expected matching digest to insert, got %v\n", err)
+	}
+}
+
+// Uploads only take the write lock for a moment per chunk, so a slow one
+// doesn't hold everyone else up
+func TestSlowUpload(t *testing.T) {
+	store := createTables(t, "slowupload")
+	meta := workingMeta()
+	data := make([]byte, ChunkSize*2+10)
+	randomizeArray(data)
+	reader, writer := io.Pipe()
+	type insertResult struct {
+		file *UploadFile
+		err  error
+	}
+	done := make(chan insertResult)
+	go func() {
+		file, err := store.InsertFile(&meta, reader)
+		done <- insertResult{file, err}
+	}()
+	_, err := writer.Write(data[:ChunkSize+10])
+	if err != nil {
+		t.Fatalf("Couldn't write first part: %s\n", err)
+	}
+	start := time.Now()
+	_, err = store.CreateBucket(DefaultUser, "meanwhile")
+	if err != nil {
+		t.Fatalf("Couldn't make bucket during upload: %s\n", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Bucket had to wait for the upload: %s\n", time.Since(start))
+	}
+	_, err = writer.Write(data[ChunkSize+10:])
+	if err != nil {
+		t.Fatalf("Couldn't write the rest: %s\n", err)
+	}
+	writer.Close()
+	result := <-done
+	if result.err != nil {
+		t.Fatalf("Couldn't insert slow file: %s\n", result.err)
+	}
+	if !bytes.Equal(readAllFile(t, store, result.file.ID), data) {
+		t.Fatalf("Slow file has the wrong data\n")
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	store := createTables(t, "cancelled")
+	meta := workingMeta()
+	expectedData := make([]byte, ChunkSize*3)
+	randomizeArray(expectedData)
+	result, err := store.InsertFile(&meta, bytes.NewReader(expectedData))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+
+	// A reader whose context dies partway through should stop producing data
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := store.OpenChunkReaderContext(ctx, result.ID)
+	if err != nil {
+		t.Fatalf("Couldn't open chunk reader: %s\n", err)
+	}
+	defer reader.Close()
+	buf := make([]byte, ChunkSize)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		t.Fatalf("Couldn't read first chunk: %s\n", err)
+	}
+	cancel()
+	_, err = io.ReadFull(reader, buf)
+	if err != context.Canceled {
+		t.Fatalf("Expected canceled read, got %v\n", err)
+	}
+
+	// An insert with a dead context should leave nothing behind
+	_, err = store.InsertFileContext(ctx, &meta, bytes.NewReader(expectedData))
+	if err == nil {
+		t.Fatalf("Insert with canceled context should have failed\n")
+	}
+	stats, err := store.GetFileStatistics(meta.Account)
+	if err != nil {
+		t.Fatalf("Couldn't get statistics: %s\n", err)
+	}
+	if stats.Count != 1 {
+		t.Fatalf("Expected only 1 file after canceled insert, got %d\n", stats.Count)
+	}
+}
+
 func TestConcurrentWrites(t *testing.T) {
 	const Concurrency int = 16
 	const Repeat int = 10
-	config := createTables(t, "concurrentwrites")
+	store := createTables(t, "concurrentwrites")
 	errors := make([]error, 0)
 	var wg sync.WaitGroup
 	var errmu sync.Mutex
-	var confmu sync.Mutex
 	adderr := func(err error) {
 		errmu.Lock()
 		errors = append(errors, err)
@@ -378,10 +548,12 @@ func TestConcurrentWrites(t *testing.T) {
 	for i := 0; i < Concurrency; i++ {
 		go func(id int) {
 			account := fmt.Sprintf("account_%d", id)
-			confmu.Lock()
-			config.Accounts[account] = nil
-			config.ApplyDefaults()
-			confmu.Unlock()
+			_, err := store.AddAccount(account, nil)
+			if err != nil {
+				adderr(err)
+				wg.Done()
+				return
+			}
 			meta := workingMeta()
 			meta.Filename = fmt.Sprintf("file%d.png", id)
 			meta.Account = account
@@ -390,12 +562,12 @@ func TestConcurrentWrites(t *testing.T) {
 				data[j] = byte(j & 0xFF)
 			}
 			for n := 0; n < Repeat; n++ {
-				uf, err := InsertFile(&meta, bytes.NewReader(data), config)
+				uf, err := store.InsertFile(&meta, bytes.NewReader(data))
 				if err != nil {
 					adderr(err)
 					break
 				}
-				err = ExpireFile(uf.ID, config)
+				err = store.ExpireFile(uf.ID)
 				if err != nil {
 					adderr(err)
 					break
@@ -411,3 +583,230 @@ func TestConcurrentWrites(t *testing.T) {
 		t.Fatalf("Errors while concurrent write: %v", errors)
 	}
 }
+
+// Same as above, but everyone uploads into one account at once. Every upload
+// checks the limits, so no matter how they interleave the limits have to hold
+func TestConcurrentQuota(t *testing.T) {
+	const Concurrency int = 16
+	const Repeat int = 5
+	const FileSize int = 1000
+	store := createTables(t, "concurrentquota")
+	data := make([]byte, FileSize)
+	randomizeArray(data)
+
+	// Run everyone at once and return how many uploads worked
+	hammer := func() int {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		inserted := 0
+		unexpected := make([]error, 0)
+		wg.Add(Concurrency)
+		for i := 0; i < Concurrency; i++ {
+			go func(id int) {
+				defer wg.Done()
+				meta := workingMeta()
+				meta.Filename = fmt.Sprintf("file%d.png", id)
+				for n := 0; n < Repeat; n++ {
+					_, err := store.InsertFile(&meta, bytes.NewReader(data))
+					mu.Lock()
+					if err == nil {
+						inserted += 1
+					} else if !errors.Is(err, ErrQuotaExceeded) && !errors.Is(err, ErrFileCountExceeded) {
+						unexpected = append(unexpected, err)
+					}
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		if len(unexpected) > 0 {
+			t.Fatalf("Errors while concurrent write: %v\n", unexpected)
+		}
+		return inserted
+	}
+	expireAll := func() {
+		_, err := store.db.Exec("UPDATE meta SET expire = created")
+		if err != nil {
+			t.Fatalf("Couldn't expire files: %s\n", err)
+		}
+		// Going around ExpireFile leaves the counters behind
+		_, err = store.ReconcileUsage()
+		if err != nil {
+			t.Fatalf("Couldn't reconcile usage: %s\n", err)
+		}
+	}
+
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) {
+		l.FileLimit = 7
+		l.UploadLimit = 1_000_000_000
+	})
+	if inserted := hammer(); inserted != 7 {
+		t.Fatalf("Expected exactly 7 files under the file limit, got %d\n", inserted)
+	}
+	expireAll()
+
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) {
+		l.FileLimit = 1000
+		l.UploadLimit = int64(FileSize * 5)
+	})
+	if inserted := hammer(); inserted != 5 {
+		t.Fatalf("Expected exactly 5 files under the upload limit, got %d\n", inserted)
+	}
+	expireAll()
+
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.UploadLimit = 1_000_000_000 })
+	store.Config.TotalUploadLimit = int64(FileSize * 3)
+	if inserted := hammer(); inserted != 3 {
+		t.Fatalf("Expected exactly 3 files under the total limit, got %d\n", inserted)
+	}
+}
+
+// Seeking to the end of a file and reading the last byte should cost the same
+// no matter how many chunks come before it
+func BenchmarkSeekToEnd(b *testing.B) {
+	store := createTables(b, "seektoend")
+	setLimits(b, store, DefaultUser, func(l *AccountConfig) { l.UploadLimit = 1_000_000_000 })
+	for _, numchunks := range []int{16, 128, 1024} {
+		meta := workingMeta()
+		meta.Filename = fmt.Sprintf("file_%d.zip", numchunks)
+		data := make([]byte, ChunkSize*numchunks)
+		randomizeArray(data)
+		result, err := store.InsertFile(&meta, bytes.NewReader(data))
+		if err != nil {
+			b.Fatalf("Couldn't insert %d chunk file: %s\n", numchunks, err)
+		}
+		b.Run(fmt.Sprintf("chunks_%d", numchunks), func(b *testing.B) {
+			reader, err := store.OpenChunkReader(result.ID)
+			if err != nil {
+				b.Fatalf("Couldn't open chunk reader: %s\n", err)
+			}
+			defer reader.Close()
+			buf := make([]byte, 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = reader.Seek(-1, io.SeekEnd)
+				if err != nil {
+					b.Fatalf("Couldn't seek: %s\n", err)
+				}
+				_, err = io.ReadFull(reader, buf)
+				if err != nil {
+					b.Fatalf("Couldn't read last byte: %s\n", err)
+				}
+				if buf[0] != data[len(data)-1] {
+					b.Fatalf("Last byte doesn't match\n")
+				}
+			}
+		})
+	}
+}
+
+func TestTagSearch(t *testing.T) {
+	store := createTables(t, "tagsearch")
+	insert := func(unlisted string, tags ...string) int64 {
+		meta := workingMeta()
+		meta.Tags = tags
+		meta.Unlisted = unlisted
+		uf, err := store.InsertFile(&meta, bytes.NewReader([]byte("tagged")))
+		if err != nil {
+			t.Fatalf("Couldn't insert file: %s\n", err)
+		}
+		return uf.ID
+	}
+	both := insert("", "project", "art")
+	project := insert("", "project")
+	art := insert("", "art")
+	insert("default", "project", "secret")
+
+	check := func(query FileQuery, expected ...int64) {
+		fids, err := store.SearchFiles(&query, 0)
+		if err != nil {
+			t.Fatalf("Couldn't search %v: %s\n", query, err)
+		}
+		if fmt.Sprint(fids) != fmt.Sprint(expected) {
+			t.Fatalf("Search %v expected %v, got %v\n", query, expected, fids)
+		}
+		count, err := store.CountFiles(&query)
+		if err != nil {
+			t.Fatalf("Couldn't count %v: %s\n", query, err)
+		}
+		if count != int64(len(expected)) {
+			t.Fatalf("Count %v expected %d, got %d\n", query, len(expected), count)
+		}
+	}
+	check(FileQuery{Tags: []string{"project"}}, project, both)
+	check(FileQuery{Tags: []string{"project", "art"}}, both)
+	check(FileQuery{Tags: []string{"project", "art"}, AnyTag: true}, art, project, both)
+	check(FileQuery{Tags: []string{"project", "project"}}, project, both)
+	check(FileQuery{Tags: []string{"secret"}})
+	check(FileQuery{Tags: []string{"nothing"}})
+
+	// Tags on unlisted files don't show up in the counts
+	counts, err := store.GetTagCounts(10)
+	if err != nil {
+		t.Fatalf("Couldn't get tag counts: %s\n", err)
+	}
+	if fmt.Sprint(counts) != "[{art 2} {project 2}]" {
+		t.Fatalf("Unexpected tag counts: %v\n", counts)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	store := createTables(t, "search")
+	other, err := store.AddAccount("other", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add account: %s\n", err)
+	}
+	insert := func(name string, account string, size int, tags ...string) int64 {
+		meta := workingMeta()
+		meta.Filename = name
+		meta.Account = account
+		meta.Tags = tags
+		uf, err := store.InsertFile(&meta, bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatalf("Couldn't insert %s: %s\n", name, err)
+		}
+		return uf.ID
+	}
+	start := time.Now()
+	photo := insert("holiday photo.png", DefaultUser, 1000, "beach")
+	notes := insert("Holiday notes.txt", DefaultUser, 10)
+	report := insert("report.txt", other.Name, 100)
+
+	check := func(query FileQuery, expected ...int64) {
+		fids, err := store.SearchFiles(&query, 0)
+		if err != nil {
+			t.Fatalf("Couldn't search %v: %s\n", query, err)
+		}
+		if fmt.Sprint(fids) != fmt.Sprint(expected) {
+			t.Fatalf("Search %v expected %v, got %v\n", query, expected, fids)
+		}
+	}
+	check(FileQuery{Text: "holiday"}, notes, photo)
+	check(FileQuery{Text: "phot*"}, photo)
+	check(FileQuery{Text: "\"holiday photo\""}, photo)
+	check(FileQuery{Text: "holiday report"})
+	check(FileQuery{Text: "\"unclosed"})
+	check(FileQuery{Text: "holiday", Account: other.Name})
+	check(FileQuery{Account: other.Name}, report)
+	check(FileQuery{MimePrefix: "image/"}, photo)
+	check(FileQuery{MimePrefix: "text/"}, report, notes)
+	check(FileQuery{MinSize: 50}, report, photo)
+	check(FileQuery{MinSize: 50, MaxSize: 500}, report)
+	check(FileQuery{After: start}, report, notes, photo)
+	check(FileQuery{Before: start})
+	check(FileQuery{After: time.Now()})
+	if store.HasFullText() {
+		check(FileQuery{Text: "beach"}, photo)
+	}
+
+	// Expired files leave the index on cleanup
+	err = store.ExpireFile(photo)
+	if err != nil {
+		t.Fatalf("Couldn't expire: %s\n", err)
+	}
+	_, err = store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	check(FileQuery{Text: "holiday"}, notes)
+}
@@ -0,0 +1,165 @@
+package quickfile
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// A schema change taking the database from the version before it to Version.
+// Each one runs in its own transaction along with the version bump, so a
+// failure leaves the database at the last version that worked
+type Migration struct {
+	Version     int
+	Description string
+	apply       func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Migrations that are just a list of statements
+func sqlMigration(statements ...string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, statement := range statements {
+			_, err := tx.ExecContext(ctx, statement)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Every migration, in order. Only add to the end, and bump DatabaseVersion to
+// match. Anything that only needs new tables can go in CreateTables instead,
+// that runs after these. Migrations only see the tables of their own version
+var migrations = []*Migration{
+	{2, "Unlisted files", sqlMigration(
+		`ALTER TABLE meta ADD unlisted TEXT NOT NULL DEFAULT ""`,
+		"DROP INDEX IF EXISTS idx_meta_expire",
+		"DROP INDEX IF EXISTS idx_meta_account_expire",
+	)},
+	// Old numeric links still work for listed files, so existing files just need something unique
+	{3, "Random file slugs", sqlMigration(
+		"ALTER TABLE meta ADD slug TEXT",
+		"UPDATE meta SET slug = lower(hex(randomblob(12)))",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_meta_slug ON meta (slug)",
+	)},
+	// Existing files don't get a digest until "quickfile verify" fills it in
+	{4, "File digests", sqlMigration(
+		"ALTER TABLE meta ADD digest TEXT",
+	)},
+	{5, "Deduplicated chunks", migrateDedupChunks},
+	{6, "Usage counters", migrateUsage},
+}
+
+// What MigrateDatabase did, or would do on a dry run
+type MigrationReport struct {
+	From    int
+	To      int
+	Pending []*Migration // Applied, unless it was a dry run
+	Backup  string       // Copy of the database from before, if anything was applied
+	DryRun  bool
+}
+
+// Bring an existing database up to DatabaseVersion, backing it up first. New
+// databases (no version at all) are left for CreateTables. With dryRun, nothing
+// is touched and the report says what would happen
+func MigrateDatabase(config *Config, dryRun bool) (*MigrationReport, error) {
+	return MigrateDatabaseContext(context.Background(), config, dryRun)
+}
+
+func MigrateDatabaseContext(ctx context.Context, config *Config, dryRun bool) (*MigrationReport, error) {
+	db, err := config.OpenDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrateDb(ctx, db, config, dryRun)
+}
+
+func migrateDb(ctx context.Context, db *sql.DB, config *Config, dryRun bool) (*MigrationReport, error) {
+	target, err := strconv.Atoi(DatabaseVersion)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrationReport{To: target, DryRun: dryRun, Pending: make([]*Migration, 0)}
+	report.From, err = readDbVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if report.From == 0 {
+		report.From = target
+		return report, nil
+	}
+	if report.From > target {
+		return nil, fmt.Errorf("database version %d is newer than this program (%d)", report.From, target)
+	}
+	for _, m := range migrations {
+		if m.Version > report.From {
+			report.Pending = append(report.Pending, m)
+		}
+	}
+	if dryRun || len(report.Pending) == 0 {
+		return report, nil
+	}
+	report.Backup = fmt.Sprintf("%s.v%d-%s.bak", config.Datapath, report.From, time.Now().Format("20060102-150405"))
+	err = backupDb(ctx, db, report.Backup)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't back up before migrating: %w", err)
+	}
+	log.Printf("Backed up version %d database to %s\n", report.From, report.Backup)
+	for _, m := range report.Pending {
+		err = applyMigration(ctx, db, m)
+		if err != nil {
+			return nil, fmt.Errorf("migration to version %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+		log.Printf("Migrated database to version %d: %s\n", m.Version, m.Description)
+	}
+	return report, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m *Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = m.apply(ctx, tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE sysvalues SET value = ? WHERE \"key\" = ?", strconv.Itoa(m.Version), "version")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Anything that can run queries: the pool or a transaction
+type queryer interface {
+	queryRower
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// The version in sysvalues, or 0 if the database is brand new
+func readDbVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var tables int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'sysvalues'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var raw string
+	err = db.QueryRowContext(ctx, "SELECT value FROM sysvalues WHERE \"key\" = ?", "version").Scan(&raw)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("bad database version %q: %w", raw, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,224 @@
+package quickfile
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// The database as the very first version made it
+var version1Sql = []string{
+	`CREATE TABLE meta (
+      fid INTEGER PRIMARY KEY,
+      name TEXT NOT NULL,
+      account TEXT NOT NULL,
+      mime TEXT NOT NULL,
+      created DATETIME NOT NULL,
+      expire DATETIME,
+      length INT NOT NULL,
+	  compression TEXT
+    );`,
+	`CREATE TABLE tags (
+      tid INTEGER PRIMARY KEY,
+      fid INTEGER NOT NULL,
+      tag TEXT NOT NULL
+    );`,
+	`CREATE TABLE chunks (
+      cid INTEGER PRIMARY KEY,
+      fid INTEGER NOT NULL,
+      length INTEGER NOT NULL,
+      data BLOB NOT NULL
+    );`,
+	`CREATE TABLE sysvalues (
+	  "key" TEXT PRIMARY KEY,
+	  value TEXT
+	);`,
+	`CREATE INDEX idx_meta_expire ON meta (expire)`,
+	`CREATE INDEX idx_meta_account_expire ON meta (account,expire)`,
+	`CREATE INDEX idx_tags_fid ON tags (fid)`,
+	`CREATE INDEX idx_tags_tag ON tags (tag)`,
+	`CREATE INDEX idx_chunks_fid ON chunks (fid)`,
+	`INSERT INTO sysvalues VALUES('version', '1')`,
+}
+
+// A config pointing at a new version 1 database with the given files in it
+func createVersion1(t *testing.T, name string, files map[string][]byte) *Config {
+	var config Config
+	err := toml.Unmarshal([]byte(GetDefaultConfig_Toml()), &config)
+	if err != nil {
+		t.Fatalf("Couldn't parse config toml: %s\n", err)
+	}
+	config.Accounts = nil
+	config.Datapath = uniqueFile(name, ".db")
+	db, err := config.OpenDb()
+	if err != nil {
+		t.Fatalf("Couldn't open db: %s\n", err)
+	}
+	defer db.Close()
+	for _, sql := range version1Sql {
+		_, err = db.Exec(sql)
+		if err != nil {
+			t.Fatalf("Couldn't make version 1 db: %s\n", err)
+		}
+	}
+	for filename, data := range files {
+		result, err := db.Exec("INSERT INTO meta(name, account, mime, created, expire, length) VALUES(?,?,?,?,?,?)",
+			filename, DefaultUser, "application/octet-stream", time.Now(), time.Now().Add(time.Hour), len(data))
+		if err != nil {
+			t.Fatalf("Couldn't insert old file: %s\n", err)
+		}
+		fid, _ := result.LastInsertId()
+		_, err = db.Exec("INSERT INTO tags(fid, tag) VALUES(?,?)", fid, "old")
+		if err != nil {
+			t.Fatalf("Couldn't insert old tag: %s\n", err)
+		}
+		for start := 0; start < len(data); start += ChunkSize {
+			chunk := data[start:min(start+ChunkSize, len(data))]
+			_, err = db.Exec("INSERT INTO chunks(fid, length, data) VALUES(?,?,?)", fid, len(chunk), chunk)
+			if err != nil {
+				t.Fatalf("Couldn't insert old chunk: %s\n", err)
+			}
+		}
+	}
+	return &config
+}
+
+func TestMigrationsMatchVersion(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+2 {
+			t.Fatalf("Migration %d should be to version %d, is to %d\n", i, i+2, m.Version)
+		}
+	}
+	if strconv.Itoa(migrations[len(migrations)-1].Version) != DatabaseVersion {
+		t.Fatalf("Last migration isn't to DatabaseVersion %s\n", DatabaseVersion)
+	}
+}
+
+func TestMigrateVersion1(t *testing.T) {
+	first := make([]byte, ChunkSize*2+10)
+	randomizeArray(first)
+	second := []byte("a small file")
+	config := createVersion1(t, "migrate1", map[string][]byte{"first.bin": first, "second.bin": second})
+
+	// A dry run says what it would do and doesn't touch anything
+	report, err := MigrateDatabase(config, true)
+	if err != nil {
+		t.Fatalf("Couldn't dry run: %s\n", err)
+	}
+	if report.From != 1 || len(report.Pending) != len(migrations) || report.Backup != "" {
+		t.Fatalf("Unexpected dry run report: %+v\n", report)
+	}
+	report, err = MigrateDatabase(config, true)
+	if err != nil || report.From != 1 {
+		t.Fatalf("Dry run should've left the database at version 1: %v %v\n", report, err)
+	}
+
+	store, err := OpenStore(config)
+	if err != nil {
+		t.Fatalf("Couldn't open old database: %s\n", err)
+	}
+	defer store.Close()
+	backups, err := filepath.Glob(config.Datapath + ".v1-*.bak")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Expected one backup, got %v (%v)\n", backups, err)
+	}
+	err = store.VerifyDatabase()
+	if err != nil {
+		t.Fatalf("Database not at the current version: %s\n", err)
+	}
+	_, err = store.AddAccount(DefaultUser, nil)
+	if err != nil {
+		t.Fatalf("Couldn't add account: %s\n", err)
+	}
+
+	fids, err := store.GetPaginatedFiles(0, "", DefaultUser)
+	if err != nil {
+		t.Fatalf("Couldn't list migrated files: %s\n", err)
+	}
+	files, err := store.GetFilesById(fids)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 migrated files, got %d (%v)\n", len(files), err)
+	}
+	for _, f := range files {
+		expected := first
+		if f.Name == "second.bin" {
+			expected = second
+		}
+		if f.Slug == "" || len(f.Tags) != 1 || f.Tags[0] != "old" {
+			t.Fatalf("Migrated file %s is missing its slug or tags: %+v\n", f.Name, f)
+		}
+		if !bytes.Equal(readAllFile(t, store, f.ID), expected) {
+			t.Fatalf("Data for %s wrong after migrating\n", f.Name)
+		}
+	}
+	checkUsage(t, store, DefaultUser, 2, int64(len(first)+len(second)))
+	stats, err := store.GetFileStatistics("")
+	if err != nil || stats.PhysicalSize != int64(len(first)+len(second)) {
+		t.Fatalf("Expected physical size %d, got %v (%v)\n", len(first)+len(second), stats, err)
+	}
+
+	// Already current, nothing more to do
+	report, err = MigrateDatabase(config, false)
+	if err != nil || len(report.Pending) != 0 {
+		t.Fatalf("Expected nothing to migrate, got %v %v\n", report, err)
+	}
+}
+
+// Files in old databases belong to the raw config key, and the account made for
+// it has to take over their usage too
+func TestMigrateConfigAccount(t *testing.T) {
+	data := []byte("owned by a config key")
+	config := createVersion1(t, "migrateconfig", map[string][]byte{"old.bin": data})
+	db, err := config.OpenDb()
+	if err != nil {
+		t.Fatalf("Couldn't open db: %s\n", err)
+	}
+	err = applyMigration(context.Background(), db, migrations[0])
+	db.Close()
+	if err != nil {
+		t.Fatalf("Couldn't make version 2 db: %s\n", err)
+	}
+	config.Accounts = map[string]*AccountConfig{DefaultUser: {}}
+
+	store, err := OpenStore(config)
+	if err != nil {
+		t.Fatalf("Couldn't open old database: %s\n", err)
+	}
+	defer store.Close()
+	account, err := store.GetAccountByKey(DefaultUser)
+	if err != nil {
+		t.Fatalf("Config account wasn't imported: %s\n", err)
+	}
+	checkUsage(t, store, account.Name, 1, int64(len(data)))
+	var leftover int
+	err = store.Db().QueryRow("SELECT COUNT(*) FROM usage WHERE account = ?", DefaultUser).Scan(&leftover)
+	if err != nil || leftover != 0 {
+		t.Fatalf("Expected the key gone from the usage counters, found %d: %v\n", leftover, err)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	config := createVersion1(t, "migratenewer", nil)
+	db, err := config.OpenDb()
+	if err != nil {
+		t.Fatalf("Couldn't open db: %s\n", err)
+	}
+	_, err = db.Exec("UPDATE sysvalues SET value = '1000' WHERE \"key\" = 'version'")
+	db.Close()
+	if err != nil {
+		t.Fatalf("Couldn't change version: %s\n", err)
+	}
+	_, err = OpenStore(config)
+	if err == nil {
+		t.Fatalf("Shouldn't be able to open a newer database\n")
+	}
+	backups, err := filepath.Glob(config.Datapath + ".*.bak")
+	if err != nil || len(backups) != 0 {
+		t.Fatalf("Shouldn't have backed up a database we can't migrate: %v (%v)\n", backups, err)
+	}
+}
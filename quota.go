@@ -0,0 +1,47 @@
+package quickfile
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Bytes left for an upload, for the account and the whole system
+type quotaRemaining struct {
+	User  int64
+	Total int64
+}
+
+// Check the account's file count and sizes from inside the transaction that's
+// about to add to them. Transactions take the write lock as soon as they begin
+// (see OpenDb), so no other upload can sneak in between this and the commit.
+// Unfinished upload sessions have their length set aside already (or whatever
+// they've received, if they don't know their length), so that's taken off
+// what's left, except for the session with the given usid (the one being
+// finished, if any)
+func checkQuota(ctx context.Context, tx *sql.Tx, config *Config, account string, limits *AccountConfig, usid int64) (*quotaRemaining, error) {
+	count, userSize, err := getUsage(ctx, tx, account)
+	if err != nil {
+		return nil, err
+	}
+	_, totalSize, err := getUsage(ctx, tx, globalUsage)
+	if err != nil {
+		return nil, err
+	}
+	var userPending, totalPending int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT IFNULL(SUM(CASE WHEN account = ? THEN MAX(length, received) ELSE 0 END), 0), IFNULL(SUM(MAX(length, received)), 0)
+		 FROM uploadsessions WHERE fid IS NULL AND usid != ?`, account, usid).Scan(&userPending, &totalPending)
+	if err != nil {
+		return nil, err
+	}
+	userSize += userPending
+	totalSize += totalPending
+	if count >= int64(limits.FileLimit) {
+		return nil, fmt.Errorf("%w: %d", ErrFileCountExceeded, count)
+	}
+	if userSize >= limits.UploadLimit {
+		return nil, &QuotaError{Scope: QuotaScopeUser, Remaining: limits.UploadLimit - userSize}
+	}
+	return &quotaRemaining{User: limits.UploadLimit - userSize, Total: config.TotalUploadLimit - totalSize}, nil
+}
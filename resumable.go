@@ -0,0 +1,392 @@
+package quickfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Resumable uploads: the client says how big the file is up front, then sends
+// the data in as many pieces as it likes. Everything that arrives is saved
+// right away, so a dropped connection only has to resend from wherever it got
+// to. Whole chunks go straight into chunkdata (the session holds a reference
+// to them in uploadchunks), and the chunk still being filled is kept with the
+// session. Once all the data is in, the chunks are handed over to a new file
+// without being copied, so finishing is quick
+
+const (
+	UploadSessionBytes         = 16
+	DefaultUploadSessionExpire = 24 * time.Hour
+	unknownLength              = -1 // The length of sessions for normal uploads, which find out at the end
+)
+
+type UploadSession struct {
+	ID      string // Random token, which is what the client uses to find it again
+	Meta    FileInsertMeta
+	Length  int64 // Declared when the session was made
+	Offset  int64 // How much data has arrived so far
+	Created time.Time
+	Updated time.Time
+	Fid     int64 // The finished file, 0 until all the data is in
+	usid    int64
+
+	compression string      // Picked when the session is made, every chunk uses it
+	partial     []byte      // The start of the next chunk, until there's enough to store it
+	hasher      *fileHasher // Everything received so far
+}
+
+func (us *UploadSession) Done() bool {
+	return us.Fid != 0
+}
+
+// Sessions nobody has written to in this long are thrown away (finished ones too,
+// they're only kept so the client can find out what file it made)
+func (c *Config) uploadSessionExpire() time.Duration {
+	if c.UploadSessionExpire <= 0 {
+		return DefaultUploadSessionExpire
+	}
+	return time.Duration(c.UploadSessionExpire)
+}
+
+// Start a resumable upload of the given length. The file is checked the same as
+// a normal upload, and the length has to fit in what's left of the quotas
+// (counting any other unfinished uploads)
+func (s *Store) CreateUploadSession(meta *FileInsertMeta, length int64) (*UploadSession, error) {
+	return s.CreateUploadSessionContext(context.Background(), meta, length)
+}
+
+func (s *Store) CreateUploadSessionContext(ctx context.Context, meta *FileInsertMeta, length int64) (*UploadSession, error) {
+	if length < 0 || length > int64(s.Config.UploadSizeLimit) {
+		return nil, fmt.Errorf("%w: must be 0 to %d", ErrUploadLength, s.Config.UploadSizeLimit)
+	}
+	mimeType, limits, _, err := s.filePrecheck(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	quota, err := checkQuota(ctx, tx, s.Config, meta.Account, limits, 0)
+	if err != nil {
+		return nil, err
+	}
+	if quota.User < length {
+		return nil, &QuotaError{Scope: QuotaScopeUser, Remaining: quota.User}
+	}
+	if quota.Total < length {
+		return nil, &QuotaError{Scope: QuotaScopeSystem, Remaining: quota.Total}
+	}
+
+	us, err := insertUploadSession(ctx, tx, meta, length, s.Config.CompressionFor(mimeType))
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	// Nothing to wait for
+	if length == 0 {
+		err = s.finishUploadSession(ctx, us)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return us, nil
+}
+
+// Add a new session for the file within the transaction. The length can be
+// unknownLength, in which case only the data received so far is set aside
+func insertUploadSession(ctx context.Context, tx *sql.Tx, meta *FileInsertMeta, length int64, compression string) (*UploadSession, error) {
+	token, err := randomHex(UploadSessionBytes)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := json.Marshal(meta.Tags)
+	if err != nil {
+		return nil, err
+	}
+	us := &UploadSession{
+		ID:          token,
+		Meta:        *meta,
+		Length:      length,
+		Created:     time.Now(),
+		compression: compression,
+		hasher:      newFileHasher(),
+	}
+	us.Updated = us.Created
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO uploadsessions(token, account, name, tags, expire, unlisted, length, created, updated, compression)
+		 VALUES(?,?,?,?,?,?,?,?,?,?)`,
+		token, meta.Account, meta.Filename, string(tags), int64(meta.Expire), meta.Unlisted, length, us.Created, us.Updated,
+		compression)
+	if err != nil {
+		return nil, err
+	}
+	us.usid, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+// Get an upload session, which has to belong to the given account
+func (s *Store) GetUploadSession(id string, account string) (*UploadSession, error) {
+	return s.GetUploadSessionContext(context.Background(), id, account)
+}
+
+func (s *Store) GetUploadSessionContext(ctx context.Context, id string, account string) (*UploadSession, error) {
+	us := UploadSession{ID: id}
+	var tags string
+	var expire int64
+	var hashState []byte
+	err := s.db.QueryRowContext(ctx,
+		`SELECT usid, account, name, tags, expire, unlisted, length, received, created, updated, IFNULL(fid, 0),
+		 compression, partial, hashstate FROM uploadsessions WHERE token = ?`, id).Scan(&us.usid, &us.Meta.Account,
+		&us.Meta.Filename, &tags, &expire, &us.Meta.Unlisted, &us.Length, &us.Offset, &us.Created, &us.Updated, &us.Fid,
+		&us.compression, &us.partial, &hashState)
+	// Other people's uploads may as well not exist
+	if err == sql.ErrNoRows || (err == nil && us.Meta.Account != account) {
+		return nil, fmt.Errorf("%w: upload %s", ErrNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	us.Meta.Expire = time.Duration(expire)
+	err = json.Unmarshal([]byte(tags), &us.Meta.Tags)
+	if err != nil {
+		return nil, err
+	}
+	us.hasher, err = unmarshalFileHasher(hashState)
+	if err != nil {
+		return nil, err
+	}
+	return &us, nil
+}
+
+// Add data to the upload starting at offset, which has to be exactly how much
+// has been received so far. Everything read from data is kept even if reading
+// fails partway. When the last of the data arrives, the file is inserted and
+// the returned session has its Fid
+func (s *Store) WriteUploadSession(id string, account string, offset int64, data io.Reader) (*UploadSession, error) {
+	return s.WriteUploadSessionContext(context.Background(), id, account, offset, data)
+}
+
+func (s *Store) WriteUploadSessionContext(ctx context.Context, id string, account string, offset int64, data io.Reader) (*UploadSession, error) {
+	us, err := s.GetUploadSessionContext(ctx, id, account)
+	if err != nil {
+		return nil, err
+	}
+	if us.Done() || offset != us.Offset {
+		return us, fmt.Errorf("%w: expected %d, got %d", ErrUploadOffset, us.Offset, offset)
+	}
+	for us.Offset < us.Length {
+		if err := ctx.Err(); err != nil {
+			return us, err
+		}
+		// Pieces don't have to line up with chunks, so fill up whatever chunk was
+		// started last time
+		want := min(ChunkSize-int64(len(us.partial)), us.Length-us.Offset)
+		piece := make([]byte, want)
+		length, readErr := io.ReadFull(data, piece)
+		if length > 0 {
+			err = s.writeUploadPiece(ctx, us, piece[:length])
+			if err != nil {
+				return us, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return us, nil
+		} else if readErr != nil {
+			return us, readErr
+		}
+	}
+	// Anything past the declared length is a mistake
+	length, _ := io.ReadFull(data, make([]byte, 1))
+	if length > 0 {
+		return us, fmt.Errorf("%w: more data than the declared %d bytes", ErrUploadLength, us.Length)
+	}
+	err = s.finishUploadSession(ctx, us)
+	return us, err
+}
+
+// Add the piece onto the end of the upload and move the offset along. Once the
+// chunk it's part of is whole (or it's the end of the data) the chunk is stored,
+// otherwise it waits with the session. Only works if nobody else moved the
+// offset in the meantime
+func (s *Store) writeUploadPiece(ctx context.Context, us *UploadSession, piece []byte) error {
+	seq := us.Offset / ChunkSize
+	chunk := append(bytes.Clone(us.partial), piece...)
+	newOffset := us.Offset + int64(len(piece))
+	// Only our copy moves on, in case this doesn't work out
+	state, err := us.hasher.marshal()
+	if err != nil {
+		return err
+	}
+	hasher, err := unmarshalFileHasher(state)
+	if err != nil {
+		return err
+	}
+	hasher.write(piece)
+	state, err = hasher.marshal()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	partial := chunk
+	if len(chunk) == ChunkSize || newOffset == us.Length {
+		err = storeUploadChunk(ctx, tx, us.usid, seq, us.compression, chunk)
+		if err != nil {
+			return err
+		}
+		partial = nil
+	}
+	now := time.Now()
+	result, err := tx.ExecContext(ctx,
+		`UPDATE uploadsessions SET received = ?, updated = ?, partial = ?, hashstate = ?
+		 WHERE usid = ? AND received = ? AND fid IS NULL`,
+		newOffset, now, partial, state, us.usid, us.Offset)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: upload changed while writing", ErrUploadOffset)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	us.Offset = newOffset
+	us.Updated = now
+	us.partial = partial
+	us.hasher = hasher
+	return nil
+}
+
+// Store a whole chunk of an upload, with the session holding the reference to it
+func storeUploadChunk(ctx context.Context, tx *sql.Tx, usid int64, seq int64, compression string, chunk []byte) error {
+	cw, err := newChunkWriter(ctx, tx)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+	hash, err := cw.store(ctx, compression, chunk)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO uploadchunks(usid, seq, hash) VALUES(?,?,?)", usid, seq, hash)
+	if err != nil {
+		return err
+	}
+	return addPhysicalSize(ctx, tx, cw.added)
+}
+
+// Turn the uploaded data into a real file. It's all one transaction, so the
+// session is either still complete and waiting or it's a file
+func (s *Store) finishUploadSession(ctx context.Context, us *UploadSession) error {
+	meta := us.Meta
+	mimeType, limits, _, err := s.filePrecheck(ctx, &meta)
+	if err != nil {
+		return err
+	}
+	staged := &stagedFile{usid: us.usid, compression: us.compression, hasher: us.hasher}
+	staged.thumbnail = s.makeFileThumbnail(s.openStagedReader(ctx, staged), mimeType, meta.Filename)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var received, fid int64
+	err = tx.QueryRowContext(ctx, "SELECT received, IFNULL(fid, 0) FROM uploadsessions WHERE usid = ?", us.usid).Scan(&received, &fid)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: upload %s", ErrNotFound, us.ID)
+	} else if err != nil {
+		return err
+	}
+	if fid != 0 || received != us.Length {
+		return fmt.Errorf("%w: upload already finished or changed", ErrUploadOffset)
+	}
+	fid, err = s.insertStagedFileTx(ctx, tx, &meta, mimeType, limits, staged)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, "UPDATE uploadsessions SET fid = ?, updated = ?, partial = NULL, hashstate = NULL WHERE usid = ?",
+		fid, now, us.usid)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	us.Fid = fid
+	us.Updated = now
+	return nil
+}
+
+// Read the staged data like it was already a file
+func (s *Store) openStagedReader(ctx context.Context, staged *stagedFile) *ChunkReader {
+	return &ChunkReader{Fid: staged.usid, Stmt: s.uploadChunkReadStmt, Ctx: ctx, Length: staged.hasher.length,
+		Compression: staged.compression}
+}
+
+// Give up on an upload. Finished files stay, only the session goes away
+func (s *Store) DeleteUploadSession(id string, account string) error {
+	return s.DeleteUploadSessionContext(context.Background(), id, account)
+}
+
+func (s *Store) DeleteUploadSessionContext(ctx context.Context, id string, account string) error {
+	us, err := s.GetUploadSessionContext(ctx, id, account)
+	if err != nil {
+		return err
+	}
+	_, err = s.deleteUploadSessions(ctx, "usid = ?", us.usid)
+	return err
+}
+
+// Delete the matching sessions and let go of any data they had. The chunks
+// themselves go with the next cleanup, if nothing else uses them. Returns how
+// many sessions went away
+func (s *Store) deleteUploadSessions(ctx context.Context, where string, args ...any) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "DELETE FROM uploadsessions WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE chunkdata SET refs = refs - (SELECT COUNT(*) FROM uploadchunks u
+		   WHERE u.hash = chunkdata.hash AND u.usid NOT IN (SELECT usid FROM uploadsessions))
+		 WHERE hash IN (SELECT hash FROM uploadchunks WHERE usid NOT IN (SELECT usid FROM uploadsessions))`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM uploadchunks WHERE usid NOT IN (SELECT usid FROM uploadsessions)")
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
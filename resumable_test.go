@@ -0,0 +1,133 @@
+package quickfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// Gives out the data and then fails, like a dropped connection
+type droppedReader struct {
+	data []byte
+}
+
+func (dr *droppedReader) Read(out []byte) (int, error) {
+	if len(dr.data) == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	length := copy(out, dr.data)
+	dr.data = dr.data[length:]
+	return length, nil
+}
+
+func TestResumableUpload(t *testing.T) {
+	store := createTables(t, "resumable")
+	data := make([]byte, ChunkSize*2+500)
+	randomizeArray(data)
+	meta := workingMeta()
+	meta.Filename = "big.bin"
+	meta.Tags = []string{"resumed"}
+
+	us, err := store.CreateUploadSession(&meta, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Couldn't create upload session: %s\n", err)
+	}
+	_, err = store.GetUploadSession(us.ID, "someoneelse")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected other accounts to not find the upload, got %v\n", err)
+	}
+
+	// Pieces that don't line up with chunks, and one that drops partway
+	us, err = store.WriteUploadSession(us.ID, DefaultUser, 0, bytes.NewReader(data[:1000]))
+	if err != nil || us.Offset != 1000 {
+		t.Fatalf("Couldn't write first piece (offset %d): %v\n", us.Offset, err)
+	}
+	us, err = store.WriteUploadSession(us.ID, DefaultUser, 1000, &droppedReader{data: data[1000 : ChunkSize+20]})
+	if err == nil || us.Offset != ChunkSize+20 {
+		t.Fatalf("Expected dropped piece to keep its data (offset %d): %v\n", us.Offset, err)
+	}
+	_, err = store.WriteUploadSession(us.ID, DefaultUser, 1000, bytes.NewReader(data[1000:]))
+	if !errors.Is(err, ErrUploadOffset) {
+		t.Fatalf("Expected offset error, got %v\n", err)
+	}
+	us, err = store.GetUploadSession(us.ID, DefaultUser)
+	if err != nil || us.Offset != ChunkSize+20 || us.Done() {
+		t.Fatalf("Expected to resume from %d, got %d: %v\n", ChunkSize+20, us.Offset, err)
+	}
+	us, err = store.WriteUploadSession(us.ID, DefaultUser, us.Offset, bytes.NewReader(data[us.Offset:]))
+	if err != nil {
+		t.Fatalf("Couldn't write the rest: %s\n", err)
+	}
+	if !us.Done() {
+		t.Fatalf("Upload should be finished\n")
+	}
+	file, err := store.GetFileById(us.Fid)
+	if err != nil {
+		t.Fatalf("Couldn't get finished file: %s\n", err)
+	}
+	if file.Name != meta.Filename || file.Length != len(data) || len(file.Tags) != 1 || file.Tags[0] != "resumed" {
+		t.Fatalf("Finished file has the wrong meta: %+v\n", file)
+	}
+	if !bytes.Equal(readAllFile(t, store, us.Fid), data) {
+		t.Fatalf("Finished file has the wrong data\n")
+	}
+	sum := sha256.Sum256(data)
+	if file.Digest != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Finished file has the wrong digest: %s\n", file.Digest)
+	}
+	var leftover int
+	err = store.db.QueryRow("SELECT COUNT(*) FROM uploadchunks").Scan(&leftover)
+	if err != nil || leftover != 0 {
+		t.Fatalf("Expected no leftover upload chunks, got %d: %v\n", leftover, err)
+	}
+
+	// Too much data, and lengths that don't fit the quota
+	small, err := store.CreateUploadSession(&meta, 10)
+	if err != nil {
+		t.Fatalf("Couldn't create small upload: %s\n", err)
+	}
+	_, err = store.WriteUploadSession(small.ID, DefaultUser, 0, bytes.NewReader(data[:11]))
+	if !errors.Is(err, ErrUploadLength) {
+		t.Fatalf("Expected length error, got %v\n", err)
+	}
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.UploadLimit = int64(len(data)) + 100 })
+	_, err = store.CreateUploadSession(&meta, 95)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected unfinished uploads to count against the quota, got %v\n", err)
+	}
+	_, err = store.InsertFile(&meta, bytes.NewReader(data[:95]))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected unfinished uploads to count against normal uploads, got %v\n", err)
+	}
+
+	// Abandoned uploads get cleaned up
+	_, err = store.db.Exec("UPDATE uploadsessions SET updated = ?", time.Now().Add(-DefaultUploadSessionExpire))
+	if err != nil {
+		t.Fatalf("Couldn't age upload sessions: %s\n", err)
+	}
+	cleanStats, err := store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	if cleanStats.DeletedUploads != 2 {
+		t.Fatalf("Expected 2 uploads cleaned up, got %d\n", cleanStats.DeletedUploads)
+	}
+	_, err = store.GetFileById(us.Fid)
+	if err != nil {
+		t.Fatalf("Finished file should outlive its upload session: %s\n", err)
+	}
+	// The abandoned upload's chunk goes too, the finished file's stay
+	var chunks, stored int64
+	err = store.db.QueryRow("SELECT COUNT(*), IFNULL(SUM(length), 0) FROM chunkdata").Scan(&chunks, &stored)
+	if err != nil || chunks != 3 {
+		t.Fatalf("Expected only the file's 3 chunks left, got %d: %v\n", chunks, err)
+	}
+	stats, err := store.GetFileStatistics("")
+	if err != nil || stats.PhysicalSize != stored {
+		t.Fatalf("Expected physical size %d, got %+v: %v\n", stored, stats, err)
+	}
+}
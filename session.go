@@ -0,0 +1,93 @@
+package quickfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	SessionTokenBytes      = 32
+	DefaultSessionDuration = Duration(30 * 24 * time.Hour)
+)
+
+// Sessions are looked up by a hash of the token, so a database dump doesn't
+// hand out working cookies. Tokens are long and random, so no salt is needed
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// How long new sessions last, falling back to the default if the config has nothing
+func (s *Store) SessionDuration() time.Duration {
+	if s.Config.SessionDuration <= 0 {
+		return time.Duration(DefaultSessionDuration)
+	}
+	return time.Duration(s.Config.SessionDuration)
+}
+
+// Log in with the account key, producing a random session token to hand to the
+// client instead of the key. Fails with ErrForbidden if the key is bad
+func (s *Store) CreateSession(key string) (string, *Account, error) {
+	return s.CreateSessionContext(context.Background(), key)
+}
+
+func (s *Store) CreateSessionContext(ctx context.Context, key string) (string, *Account, error) {
+	account, err := s.GetAccountByKeyContext(ctx, key)
+	if err != nil || account.IsDisabled() {
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return "", nil, fmt.Errorf("%w: bad account key", ErrForbidden)
+		}
+		return "", nil, err
+	}
+	token, err := randomHex(SessionTokenBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	_, err = s.db.ExecContext(ctx, "INSERT INTO sessions(token, aid, created, expire) VALUES(?,?,?,?)",
+		hashSessionToken(token), account.ID, now, now.Add(s.SessionDuration()))
+	if err != nil {
+		return "", nil, err
+	}
+	return token, account, nil
+}
+
+// Find the account a session belongs to. Expired sessions and sessions for
+// disabled accounts give ErrNotFound
+func (s *Store) GetSessionAccount(token string) (*Account, error) {
+	return s.GetSessionAccountContext(context.Background(), token)
+}
+
+func (s *Store) GetSessionAccountContext(ctx context.Context, token string) (*Account, error) {
+	var aid int64
+	err := s.db.QueryRowContext(ctx, "SELECT aid FROM sessions WHERE token = ? AND expire > ?",
+		hashSessionToken(token), time.Now()).Scan(&aid)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: session", ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	account, err := s.getAccountBy(ctx, "aid", aid)
+	if err != nil {
+		return nil, err
+	}
+	if account.IsDisabled() {
+		return nil, fmt.Errorf("%w: session", ErrNotFound)
+	}
+	return account, nil
+}
+
+// Log out. Deleting a session that doesn't exist is not an error
+func (s *Store) DeleteSession(token string) error {
+	return s.DeleteSessionContext(context.Background(), token)
+}
+
+func (s *Store) DeleteSessionContext(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", hashSessionToken(token))
+	return err
+}
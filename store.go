@@ -0,0 +1,104 @@
+package quickfile
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// A long-lived handle to a quickfile database. It owns a single connection
+// pool plus the statements we run constantly, and is safe to share across
+// goroutines. Always create with OpenStore and Close when you're done.
+type Store struct {
+	Config *Config
+	db     *sql.DB
+
+	cleanupMutex sync.Mutex // Cleanup and vacuum should never run at the same time
+	fullText     bool       // Whether the meta_search fts5 table is available
+
+	fileLengthStmt      *sql.Stmt
+	chunkReadStmt       *sql.Stmt
+	uploadChunkReadStmt *sql.Stmt
+}
+
+// Open the database given in the config, migrating it to the current version
+// (after a backup) or creating the tables if necessary, verifying the version,
+// and importing the accounts from the config the first time. The returned store is ready to use.
+func OpenStore(config *Config) (*Store, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	db, err := config.OpenDb()
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{Config: config, db: db}
+	_, err = migrateDb(context.Background(), db, config, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = store.CreateTables()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = store.VerifyDatabase()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = store.createSearchIndex()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	_, err = store.ImportConfigAccounts()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = store.prepareStatements()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Statements are prepared once against the pool; database/sql takes care of
+// re-preparing them on whatever connection ends up running them
+func (s *Store) prepareStatements() error {
+	var err error
+	s.fileLengthStmt, err = s.db.Prepare("SELECT length, IFNULL(compression, '') FROM meta WHERE fid = ?")
+	if err != nil {
+		return err
+	}
+	s.chunkReadStmt, err = s.db.Prepare(
+		"SELECT d.data FROM filechunks f JOIN chunkdata d ON d.hash = f.hash WHERE f.fid = ? AND f.seq = ?")
+	if err != nil {
+		return err
+	}
+	s.uploadChunkReadStmt, err = s.db.Prepare(
+		"SELECT d.data FROM uploadchunks u JOIN chunkdata d ON d.hash = u.hash WHERE u.usid = ? AND u.seq = ?")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// The raw database pool, in case you need to do something the store doesn't support
+func (s *Store) Db() *sql.DB {
+	return s.db
+}
+
+// Close all statements and the underlying connection pool. Don't use the store after this
+func (s *Store) Close() error {
+	for _, stmt := range []*sql.Stmt{s.fileLengthStmt, s.chunkReadStmt, s.uploadChunkReadStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,156 @@
+package quickfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+)
+
+// Images bigger than this (in pixels) don't get thumbnails, decoding them would
+// take too much memory
+const ThumbnailMaxPixels = 40_000_000
+
+// How many samples to average along each side of a thumbnail pixel
+const thumbnailSamples = 4
+
+// Mimetypes we can make thumbnails for, all with the standard library
+var ThumbnailMimeTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+type Thumbnail struct {
+	Fid    int64
+	Mime   string
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// Get the thumbnail for the file, if it has one
+func (s *Store) GetThumbnail(id int64) (*Thumbnail, error) {
+	return s.GetThumbnailContext(context.Background(), id)
+}
+
+func (s *Store) GetThumbnailContext(ctx context.Context, id int64) (*Thumbnail, error) {
+	thumb := Thumbnail{Fid: id}
+	err := s.db.QueryRowContext(ctx, "SELECT mime, width, height, data FROM thumbnails WHERE fid = ?", id).
+		Scan(&thumb.Mime, &thumb.Width, &thumb.Height, &thumb.Data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: thumbnail %d", ErrNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	return &thumb, nil
+}
+
+// Make a thumbnail from the file's data, if it's an image we understand. Images
+// that are broken or too big just don't get one. Decoding takes a while, so do
+// this before taking the write lock
+func (s *Store) makeFileThumbnail(reader io.ReadSeeker, mimeType string, name string) *Thumbnail {
+	size := s.Config.ThumbnailSize
+	if size <= 0 || !anyStartsWith(mimeType, ThumbnailMimeTypes) {
+		return nil
+	}
+	thumb, err := makeThumbnail(reader, size)
+	if err != nil {
+		log.Printf("WARN: couldn't make thumbnail for %s: %s\n", name, err)
+		return nil
+	}
+	return thumb
+}
+
+// Save the thumbnail for the file just inserted in the transaction
+func insertThumbnail(ctx context.Context, tx *sql.Tx, fid int64, thumb *Thumbnail) error {
+	thumb.Fid = fid
+	_, err := tx.ExecContext(ctx, "INSERT INTO thumbnails(fid, mime, width, height, data) VALUES(?,?,?,?,?)",
+		thumb.Fid, thumb.Mime, thumb.Width, thumb.Height, thumb.Data)
+	return err
+}
+
+// Decode the image and shrink it to fit in a size x size box. Images already
+// small enough are kept at their size. Jpegs stay jpegs, everything else is a
+// png so transparency survives
+func makeThumbnail(reader io.ReadSeeker, size int) (*Thumbnail, error) {
+	config, format, err := image.DecodeConfig(reader)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > ThumbnailMaxPixels {
+		return nil, fmt.Errorf("image too big: %dx%d", config.Width, config.Height)
+	}
+	_, err = reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var src image.Image
+	switch format {
+	case "png":
+		src, err = png.Decode(reader)
+	case "jpeg":
+		src, err = jpeg.Decode(reader)
+	case "gif":
+		src, err = gif.Decode(reader) // Just the first frame
+	default:
+		return nil, fmt.Errorf("can't thumbnail %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	width, height := thumbnailSize(src.Bounds().Dx(), src.Bounds().Dy(), size)
+	dst := scaleImage(src, width, height)
+	var buf bytes.Buffer
+	thumb := &Thumbnail{Width: width, Height: height}
+	if format == "jpeg" {
+		thumb.Mime = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		thumb.Mime = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	thumb.Data = buf.Bytes()
+	return thumb, nil
+}
+
+// Fit the dimensions in the box, keeping the aspect ratio. Never zero
+func thumbnailSize(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return max(width, 1), max(height, 1)
+	}
+	if width >= height {
+		return size, max(height*size/width, 1)
+	}
+	return max(width*size/height, 1), size
+}
+
+// Resize by averaging a grid of samples for every pixel. Not the prettiest
+// filter, but good enough for thumbnails and it only reads a few pixels each
+func scaleImage(src image.Image, width, height int) *image.NRGBA {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a uint64
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				py := bounds.Min.Y + ((y*thumbnailSamples+sy)*bounds.Dy()+bounds.Dy()/2)/(height*thumbnailSamples)
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := bounds.Min.X + ((x*thumbnailSamples+sx)*bounds.Dx()+bounds.Dx()/2)/(width*thumbnailSamples)
+					// Premultiplied, so transparent pixels don't bleed their color
+					pr, pg, pb, pa := src.At(px, py).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+				}
+			}
+			n := uint64(thumbnailSamples * thumbnailSamples)
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,102 @@
+package quickfile
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	for _, c := range [][5]int{
+		{100, 50, 200, 100, 50},
+		{1000, 500, 200, 200, 100},
+		{500, 1000, 200, 100, 200},
+		{10000, 1, 200, 200, 1},
+	} {
+		width, height := thumbnailSize(c[0], c[1], c[2])
+		if width != c[3] || height != c[4] {
+			t.Fatalf("Expected %dx%d in %d to be %dx%d, got %dx%d\n", c[0], c[1], c[2], c[3], c[4], width, height)
+		}
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	store := createTables(t, "thumbnails")
+	store.Config.ThumbnailSize = 50
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatalf("Couldn't encode png: %s\n", err)
+	}
+
+	meta := workingMeta()
+	meta.Filename = "picture.png"
+	picture, err := store.InsertFile(&meta, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Couldn't insert picture: %s\n", err)
+	}
+	if !picture.Thumbnail {
+		t.Fatalf("Picture should have a thumbnail\n")
+	}
+	thumb, err := store.GetThumbnail(picture.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get thumbnail: %s\n", err)
+	}
+	if thumb.Mime != "image/png" || thumb.Width != 50 || thumb.Height != 25 {
+		t.Fatalf("Expected 50x25 png thumbnail, got %dx%d %s\n", thumb.Width, thumb.Height, thumb.Mime)
+	}
+	decoded, err := png.Decode(bytes.NewReader(thumb.Data))
+	if err != nil {
+		t.Fatalf("Thumbnail isn't a png: %s\n", err)
+	}
+	if decoded.Bounds().Dx() != 50 || decoded.Bounds().Dy() != 25 {
+		t.Fatalf("Thumbnail data is the wrong size: %v\n", decoded.Bounds())
+	}
+
+	// Broken images and things that aren't images still upload, just without one
+	meta.Filename = "broken.png"
+	broken, err := store.InsertFile(&meta, bytes.NewReader(buf.Bytes()[:100]))
+	if err != nil {
+		t.Fatalf("Couldn't insert broken picture: %s\n", err)
+	}
+	meta.Filename = "notes.txt"
+	notes, err := store.InsertFile(&meta, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("Couldn't insert text: %s\n", err)
+	}
+	for _, uf := range []*UploadFile{broken, notes} {
+		if uf.Thumbnail {
+			t.Fatalf("%s shouldn't have a thumbnail\n", uf.Name)
+		}
+		_, err = store.GetThumbnail(uf.ID)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected no thumbnail for %s, got %v\n", uf.Name, err)
+		}
+	}
+
+	// The thumbnail goes with the file
+	err = store.ExpireFile(picture.ID)
+	if err != nil {
+		t.Fatalf("Couldn't expire picture: %s\n", err)
+	}
+	cleanStats, err := store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	if cleanStats.DeletedThumbnails != 1 {
+		t.Fatalf("Expected 1 thumbnail deleted, got %d\n", cleanStats.DeletedThumbnails)
+	}
+	_, err = store.GetThumbnail(picture.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected thumbnail gone after cleanup, got %v\n", err)
+	}
+}
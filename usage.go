@@ -0,0 +1,236 @@
+package quickfile
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// File counts and sizes are kept in the usage table so nobody has to add up
+// meta to find them. Every file with counted set is in its account's row and
+// the global row (account ''), and the flag is only ever changed in the same
+// transaction as the counters. Files that run out their expire stay in the
+// counters until the cleanup deletes them, but getUsage leaves them out, so
+// they stop counting against quotas the moment they expire. The global row
+// also keeps the physical size: the bytes stored in chunkdata
+
+const globalUsage = ""
+
+// Either a db or a transaction, so counters can be read inside or outside one
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// The file count and total size for the account (or globalUsage), not counting
+// files that expired but haven't been cleaned up yet
+func getUsage(ctx context.Context, db queryRower, account string) (int64, int64, error) {
+	var count, size int64
+	err := db.QueryRowContext(ctx, "SELECT count, size FROM usage WHERE account = ?", account).Scan(&count, &size)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	// The cleanup gets rid of these regularly, so there aren't many to look at
+	var expiredCount, expiredSize int64
+	err = db.QueryRowContext(ctx,
+		`SELECT COUNT(*), IFNULL(SUM(length), 0) FROM meta
+		 WHERE expire <= ? AND counted = 1 AND (? = '' OR account = ?)`,
+		time.Now(), account, account,
+	).Scan(&expiredCount, &expiredSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	return count - expiredCount, size - expiredSize, nil
+}
+
+// The bytes actually stored for every file, after compression and deduplication
+func getPhysicalSize(ctx context.Context, db queryRower) (int64, error) {
+	var size int64
+	err := db.QueryRowContext(ctx, "SELECT physical FROM usage WHERE account = ?", globalUsage).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return size, err
+}
+
+// Add (or take away) stored chunk bytes from the physical size
+func addPhysicalSize(ctx context.Context, tx *sql.Tx, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO usage(account, count, size, physical) VALUES(?,0,0,?)
+		 ON CONFLICT(account) DO UPDATE SET physical = physical + excluded.physical`,
+		globalUsage, size)
+	return err
+}
+
+// Add (or with negatives, take away) files from the account's and the global counters
+func addUsage(ctx context.Context, tx *sql.Tx, account string, count int64, size int64) error {
+	for _, a := range []string{account, globalUsage} {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO usage(account, count, size) VALUES(?,?,?)
+			 ON CONFLICT(account) DO UPDATE SET count = count + excluded.count, size = size + excluded.size`,
+			a, count, size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take the counted files matching the where clause off the counters and mark
+// them uncounted, all within the transaction
+func uncountFiles(ctx context.Context, tx *sql.Tx, where string, args ...any) error {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT account, COUNT(*), IFNULL(SUM(length), 0) FROM meta WHERE counted = 1 AND "+where+" GROUP BY account",
+		args...)
+	if err != nil {
+		return err
+	}
+	type accountUsage struct {
+		account     string
+		count, size int64
+	}
+	usages := make([]accountUsage, 0)
+	for rows.Next() {
+		var u accountUsage
+		err = rows.Scan(&u.account, &u.count, &u.size)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		usages = append(usages, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range usages {
+		err = addUsage(ctx, tx, u.account, -u.count, -u.size)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE meta SET counted = 0 WHERE counted = 1 AND "+where, args...)
+	return err
+}
+
+// Throw away the usage counters and build them again from meta, counting every
+// file that hasn't expired. Only needed if meta was changed by hand (or by a
+// bug). Returns how many counters had to change
+func (s *Store) ReconcileUsage() (int64, error) {
+	return s.ReconcileUsageContext(context.Background())
+}
+
+func (s *Store) ReconcileUsageContext(ctx context.Context) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	changed, err := reconcileUsage(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	return changed, tx.Commit()
+}
+
+func reconcileUsage(ctx context.Context, tx *sql.Tx) (int64, error) {
+	old, err := readUsage(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE meta SET counted = (expire IS NULL OR expire > ?)", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	physical, err := getPhysicalSize(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	for _, sql := range []string{
+		"DELETE FROM usage",
+		`INSERT INTO usage(account, count, size)
+		 SELECT account, COUNT(*), IFNULL(SUM(length), 0) FROM meta WHERE counted = 1 GROUP BY account`,
+		`INSERT INTO usage(account, count, size)
+		 SELECT '', COUNT(*), IFNULL(SUM(length), 0) FROM meta WHERE counted = 1`,
+	} {
+		_, err = tx.ExecContext(ctx, sql)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Only the file counters are rebuilt, the physical size is kept as it was
+	_, err = tx.ExecContext(ctx, "UPDATE usage SET physical = ? WHERE account = ?", physical, globalUsage)
+	if err != nil {
+		return 0, err
+	}
+	rebuilt, err := readUsage(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	changed := int64(0)
+	for account, usage := range rebuilt {
+		if old[account] != usage {
+			changed += 1
+		}
+		delete(old, account)
+	}
+	// Accounts that had files counted but have none at all now
+	for _, usage := range old {
+		if usage != [2]int64{} {
+			changed += 1
+		}
+	}
+	return changed, nil
+}
+
+// Every counter as [count, size], by account
+func readUsage(ctx context.Context, tx *sql.Tx) (map[string][2]int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT account, count, size FROM usage")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][2]int64)
+	for rows.Next() {
+		var account string
+		var usage [2]int64
+		err = rows.Scan(&account, &usage[0], &usage[1])
+		if err != nil {
+			return nil, err
+		}
+		result[account] = usage
+	}
+	return result, rows.Err()
+}
+
+// Old databases need the counters built once, from meta and the chunks the
+// migration before this moved into chunkdata. The same as reconcileUsage did
+// at this version
+func migrateUsage(ctx context.Context, tx *sql.Tx) error {
+	err := sqlMigration(
+		"ALTER TABLE meta ADD counted INTEGER NOT NULL DEFAULT 0",
+		`CREATE TABLE usage (
+      account TEXT PRIMARY KEY,
+      count INTEGER NOT NULL,
+      size INTEGER NOT NULL,
+      physical INTEGER NOT NULL DEFAULT 0
+    );`,
+	)(ctx, tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE meta SET counted = (expire IS NULL OR expire > ?)", time.Now())
+	if err != nil {
+		return err
+	}
+	return sqlMigration(
+		`INSERT INTO usage(account, count, size)
+		 SELECT account, COUNT(*), IFNULL(SUM(length), 0) FROM meta WHERE counted = 1 GROUP BY account`,
+		`INSERT INTO usage(account, count, size, physical)
+		 SELECT '', COUNT(*), IFNULL(SUM(length), 0), (SELECT IFNULL(SUM(length), 0) FROM chunkdata) FROM meta WHERE counted = 1`,
+	)(ctx, tx)
+}
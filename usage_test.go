@@ -0,0 +1,91 @@
+package quickfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func checkUsage(t *testing.T, store *Store, account string, count int64, size int64) {
+	t.Helper()
+	stats, err := store.GetFileStatistics(account)
+	if err != nil {
+		t.Fatalf("Couldn't get statistics for '%s': %s\n", account, err)
+	}
+	if stats.Count != count || stats.TotalSize != size {
+		t.Fatalf("Expected '%s' to have %d files of %d bytes, got %d and %d\n", account, count, size, stats.Count, stats.TotalSize)
+	}
+}
+
+func TestUsageCounters(t *testing.T) {
+	store := createTables(t, "usage")
+	setLimits(t, store, DefaultUser, func(l *AccountConfig) { l.MinExpire = 0 })
+	_, err := store.AddAccount("other", nil)
+	if err != nil {
+		t.Fatalf("Couldn't add other account: %s\n", err)
+	}
+	checkUsage(t, store, "", 0, 0)
+
+	meta := workingMeta()
+	first, err := store.InsertFile(&meta, bytes.NewReader(make([]byte, 1000)))
+	if err != nil {
+		t.Fatalf("Couldn't insert first: %s\n", err)
+	}
+	meta.Expire = 0
+	_, err = store.InsertFile(&meta, bytes.NewReader(make([]byte, 200)))
+	if err != nil {
+		t.Fatalf("Couldn't insert already expired: %s\n", err)
+	}
+	meta = workingMeta()
+	meta.Account = "other"
+	_, err = store.InsertFile(&meta, bytes.NewReader(make([]byte, 30)))
+	if err != nil {
+		t.Fatalf("Couldn't insert other: %s\n", err)
+	}
+	// Expired files stop counting right away, even before they're cleaned up
+	checkUsage(t, store, DefaultUser, 1, 1000)
+	checkUsage(t, store, "other", 1, 30)
+	checkUsage(t, store, "", 2, 1030)
+
+	// Expiring twice only counts once, and the cleanup doesn't count it again
+	for i := 0; i < 2; i++ {
+		err = store.ExpireFile(first.ID)
+		if err != nil {
+			t.Fatalf("Couldn't expire first: %s\n", err)
+		}
+	}
+	checkUsage(t, store, DefaultUser, 0, 0)
+	checkUsage(t, store, "", 1, 30)
+	cleanStats, err := store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("Couldn't cleanup: %s\n", err)
+	}
+	if cleanStats.DeletedFiles != 2 {
+		t.Fatalf("Expected 2 files deleted, got %d\n", cleanStats.DeletedFiles)
+	}
+	checkUsage(t, store, DefaultUser, 0, 0)
+	checkUsage(t, store, "other", 1, 30)
+	checkUsage(t, store, "", 1, 30)
+
+	// Nothing to fix unless someone messes with the counters
+	changed, err := store.ReconcileUsage()
+	if err != nil {
+		t.Fatalf("Couldn't reconcile: %s\n", err)
+	}
+	if changed != 0 {
+		t.Fatalf("Expected no counters to change, got %d\n", changed)
+	}
+	_, err = store.db.Exec("UPDATE usage SET count = 50, size = 5000")
+	if err != nil {
+		t.Fatalf("Couldn't break counters: %s\n", err)
+	}
+	changed, err = store.ReconcileUsage()
+	if err != nil {
+		t.Fatalf("Couldn't reconcile: %s\n", err)
+	}
+	if changed != 2 {
+		t.Fatalf("Expected 2 counters fixed, got %d\n", changed)
+	}
+	checkUsage(t, store, DefaultUser, 0, 0)
+	checkUsage(t, store, "other", 1, 30)
+	checkUsage(t, store, "", 1, 30)
+}
@@ -0,0 +1,195 @@
+package quickfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// How many chunks or files to pull per query while verifying
+const verifyBatchSize = 100
+
+type VerifyStatistics struct {
+	Chunks    int64    // Stored chunks checked
+	Files     int64    // Files checked
+	Filled    int64    // Old files which got their digest for the first time
+	BadChunks []string // Stored chunks whose data doesn't match their hash
+	BadFiles  []int64  // Files whose data doesn't match their digest, or can't be read at all
+}
+
+func (vs *VerifyStatistics) Ok() bool {
+	return len(vs.BadChunks) == 0 && len(vs.BadFiles) == 0
+}
+
+// Re-hash every stored chunk and every file, reporting anything that doesn't
+// match. Files from before digests existed are given one, unless their data is
+// already known to be bad. This reads the whole database, so it's slow
+func (s *Store) VerifyFiles() (*VerifyStatistics, error) {
+	return s.VerifyFilesContext(context.Background())
+}
+
+func (s *Store) VerifyFilesContext(ctx context.Context) (*VerifyStatistics, error) {
+	var stats VerifyStatistics
+	badChunks, err := s.verifyChunks(ctx, &stats)
+	if err != nil {
+		return nil, err
+	}
+	err = s.verifyFileDigests(ctx, &stats, badChunks)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Chunks are keyed by the hash of their data and compression, so they can be
+// checked without knowing anything about the files
+func (s *Store) verifyChunks(ctx context.Context, stats *VerifyStatistics) (map[string]bool, error) {
+	badChunks := make(map[string]bool)
+	last := ""
+	for {
+		rows, err := s.db.QueryContext(ctx,
+			"SELECT hash, compression, data FROM chunkdata WHERE hash > ? ORDER BY hash LIMIT ?", last, verifyBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for rows.Next() {
+			var hash, compression string
+			var data []byte
+			err = rows.Scan(&hash, &compression, &data)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			// Only files know how long their chunks should be, the hash is enough here
+			chunk, err := decompressChunkData(compression, data, ChunkSize)
+			if err != nil || hashChunk(compression, chunk) != hash {
+				badChunks[hash] = true
+				stats.BadChunks = append(stats.BadChunks, hash)
+			}
+			last = hash
+			count += 1
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		stats.Chunks += int64(count)
+		if count < verifyBatchSize {
+			return badChunks, nil
+		}
+	}
+}
+
+type verifyFile struct {
+	fid    int64
+	digest string
+}
+
+func (s *Store) verifyFileDigests(ctx context.Context, stats *VerifyStatistics, badChunks map[string]bool) error {
+	last := int64(0)
+	for {
+		rows, err := s.db.QueryContext(ctx,
+			"SELECT fid, IFNULL(digest, '') FROM meta WHERE fid > ? ORDER BY fid LIMIT ?", last, verifyBatchSize)
+		if err != nil {
+			return err
+		}
+		files := make([]verifyFile, 0, verifyBatchSize)
+		for rows.Next() {
+			var vf verifyFile
+			err = rows.Scan(&vf.fid, &vf.digest)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			files = append(files, vf)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		// Reading the files happens outside the query so we're not holding it open
+		// for the whole batch
+		for _, vf := range files {
+			err = s.verifyFile(ctx, stats, badChunks, vf)
+			if err != nil {
+				return err
+			}
+			last = vf.fid
+		}
+		if len(files) < verifyBatchSize {
+			return nil
+		}
+	}
+}
+
+func (s *Store) verifyFile(ctx context.Context, stats *VerifyStatistics, badChunks map[string]bool, vf verifyFile) error {
+	bad := false
+	if len(badChunks) > 0 {
+		rows, err := s.db.QueryContext(ctx, "SELECT hash FROM filechunks WHERE fid = ?", vf.fid)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var hash string
+			err = rows.Scan(&hash)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			bad = bad || badChunks[hash]
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	digest := ""
+	if !bad {
+		reader, err := s.openChunkReaderRaw(ctx, vf.fid)
+		if errors.Is(err, ErrNotFound) {
+			return nil // Deleted while we were busy, nothing to check
+		} else if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, reader)
+		reader.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Missing chunks or data that won't decompress
+			bad = true
+		} else {
+			digest = hex.EncodeToString(hash.Sum(nil))
+		}
+	}
+	stats.Files += 1
+	if !bad && vf.digest == "" {
+		result, err := s.db.ExecContext(ctx, "UPDATE meta SET digest = ? WHERE fid = ? AND digest IS NULL", digest, vf.fid)
+		if err != nil {
+			return err
+		}
+		filled, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		stats.Filled += filled
+	} else if bad || digest != vf.digest {
+		// A file deleted partway through reading looks broken, so check it's still there
+		var exists int
+		err := s.db.QueryRowContext(ctx, "SELECT 1 FROM meta WHERE fid = ?", vf.fid).Scan(&exists)
+		if err == sql.ErrNoRows {
+			stats.Files -= 1
+			return nil
+		} else if err != nil {
+			return err
+		}
+		stats.BadFiles = append(stats.BadFiles, vf.fid)
+	}
+	return nil
+}
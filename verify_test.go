@@ -0,0 +1,109 @@
+package quickfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	store := createTables(t, "verify")
+	data := textData(ChunkSize*2 + 100)
+	digest := sha256.Sum256(data)
+	meta := workingMeta()
+	meta.Filename = "notes.txt"
+	store.Config.Compression = map[string]string{"text/": CompressionGzip}
+	good, err := store.InsertFile(&meta, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+	if good.Digest != hex.EncodeToString(digest[:]) {
+		t.Fatalf("Expected digest %x, got %s\n", digest, good.Digest)
+	}
+	other := make([]byte, ChunkSize+5)
+	randomizeArray(other)
+	meta.Filename = "other.bin"
+	bad, err := store.InsertFile(&meta, bytes.NewReader(other))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+
+	// Files from before digests get one filled in
+	_, err = store.db.Exec("UPDATE meta SET digest = NULL WHERE fid = ?", good.ID)
+	if err != nil {
+		t.Fatalf("Couldn't clear digest: %s\n", err)
+	}
+	stats, err := store.VerifyFiles()
+	if err != nil {
+		t.Fatalf("Couldn't verify: %s\n", err)
+	}
+	if !stats.Ok() || stats.Files != 2 || stats.Chunks != 5 || stats.Filled != 1 {
+		t.Fatalf("Unexpected verify results: %+v\n", stats)
+	}
+	refilled, err := store.GetFileById(good.ID)
+	if err != nil {
+		t.Fatalf("Couldn't get file: %s\n", err)
+	}
+	if refilled.Digest != good.Digest {
+		t.Fatalf("Expected filled digest %s, got %s\n", good.Digest, refilled.Digest)
+	}
+
+	// Corrupt a stored chunk, and separately make a digest lie
+	var hash string
+	err = store.db.QueryRow("SELECT hash FROM filechunks WHERE fid = ? AND seq = 1", bad.ID).Scan(&hash)
+	if err != nil {
+		t.Fatalf("Couldn't get chunk hash: %s\n", err)
+	}
+	_, err = store.db.Exec("UPDATE chunkdata SET data = zeroblob(length) WHERE hash = ?", hash)
+	if err != nil {
+		t.Fatalf("Couldn't corrupt chunk: %s\n", err)
+	}
+	_, err = store.db.Exec("UPDATE meta SET digest = ? WHERE fid = ?", hex.EncodeToString(make([]byte, 32)), good.ID)
+	if err != nil {
+		t.Fatalf("Couldn't change digest: %s\n", err)
+	}
+	stats, err = store.VerifyFiles()
+	if err != nil {
+		t.Fatalf("Couldn't verify: %s\n", err)
+	}
+	if stats.Ok() || len(stats.BadChunks) != 1 || stats.BadChunks[0] != hash {
+		t.Fatalf("Expected bad chunk %s, got %+v\n", hash, stats)
+	}
+	if len(stats.BadFiles) != 2 || stats.BadFiles[0] != good.ID || stats.BadFiles[1] != bad.ID {
+		t.Fatalf("Expected bad files %d and %d, got %v\n", good.ID, bad.ID, stats.BadFiles)
+	}
+
+	// A chunk missing from the middle is an error, not a short file, and doesn't get a digest
+	meta.Filename = "holes.bin"
+	randomizeArray(other)
+	holes, err := store.InsertFile(&meta, bytes.NewReader(other))
+	if err != nil {
+		t.Fatalf("Couldn't insert file: %s\n", err)
+	}
+	_, err = store.db.Exec("DELETE FROM filechunks WHERE fid = ? AND seq = 0", holes.ID)
+	if err != nil {
+		t.Fatalf("Couldn't remove chunk: %s\n", err)
+	}
+	_, err = store.db.Exec("UPDATE meta SET digest = NULL WHERE fid = ?", holes.ID)
+	if err != nil {
+		t.Fatalf("Couldn't clear digest: %s\n", err)
+	}
+	reader, err := store.OpenChunkReader(holes.ID)
+	if err != nil {
+		t.Fatalf("Couldn't open file: %s\n", err)
+	}
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	if err == nil {
+		t.Fatalf("Expected an error reading a file with a missing chunk\n")
+	}
+	stats, err = store.VerifyFiles()
+	if err != nil {
+		t.Fatalf("Couldn't verify: %s\n", err)
+	}
+	if len(stats.BadFiles) != 3 || stats.BadFiles[2] != holes.ID || stats.Filled != 0 {
+		t.Fatalf("Expected file %d to be bad and not filled, got %+v\n", holes.ID, stats)
+	}
+}